@@ -0,0 +1,39 @@
+
+package main
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// Backfill records a one-off data migration that has already been applied,
+// so it is not repeated on the next start against rows created since.
+type Backfill struct {
+    Name      string    `gorm:"primaryKey;size:100" json:"name"`
+    AppliedAt time.Time `json:"applied_at"`
+}
+
+// runBackfill applies fn once per database. The marker row is written in the
+// same transaction, so a failed backfill is retried on the next start.
+func runBackfill(db *gorm.DB, name string, fn func(tx *gorm.DB) error) error {
+    return db.Transaction(func(tx *gorm.DB) error {
+        res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Backfill{Name: name, AppliedAt: time.Now()})
+        if res.Error != nil {
+            return res.Error
+        }
+        if res.RowsAffected == 0 {
+            return nil
+        }
+        return fn(tx)
+    })
+}
+
+// backfillEmailVerified treats accounts that predate email verification as
+// verified; otherwise RequireEmailVerification would lock them all out.
+func backfillEmailVerified(db *gorm.DB) error {
+    return runBackfill(db, "users-email-verified", func(tx *gorm.DB) error {
+        return tx.Model(&User{}).Where("email_verified_at IS NULL").Update("email_verified_at", time.Now()).Error
+    })
+}
@@ -0,0 +1,86 @@
+
+package main
+
+import (
+    "fmt"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// boxOfficeProvider marks payments taken at the counter. They never went
+// through the payment provider, so refunds for them are paid out in cash.
+const boxOfficeProvider = "box_office"
+
+// sellAtBoxOffice lets a cashier sell seats over the counter. The money is
+// taken on the spot, so the booking is confirmed immediately and the
+// payment is recorded as settled instead of opening a provider intent. The
+// sale belongs to no customer account; the cashier is kept in SoldBy.
+func sellAtBoxOffice(db *gorm.DB, currency string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        actorID := c.GetUint("user_id")
+        var req BookingRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        session, tickets, ok := loadBookingSession(c, db, req)
+        if !ok {
+            return
+        }
+
+        var booking Booking
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var err error
+            booking, err = insertBooking(tx, 0, session, tickets, req.PaymentMethod, 0)
+            if err != nil {
+                return err
+            }
+            if err := tx.Model(&booking).Updates(map[string]interface{}{"status": "confirmed", "sold_by": actorID}).Error; err != nil {
+                return err
+            }
+            if err := tx.Create(&Payment{
+                BookingID: booking.ID,
+                Provider:  boxOfficeProvider,
+                IntentID:  fmt.Sprintf("box-office-%d", booking.ID),
+                Amount:    booking.TotalPrice,
+                Currency:  currency,
+                Status:    "succeeded",
+            }).Error; err != nil {
+                return err
+            }
+            return recordAudit(tx, actorID, "booking.sell", "booking", booking.ID, "", gin.H{
+                "session_id":     session.ID,
+                "seat_ids":       req.SeatIDs,
+                "payment_method": booking.PaymentMethod,
+                "total_price":    booking.TotalPrice,
+            })
+        })
+        if err != nil {
+            respondBookingConflict(c, err)
+            return
+        }
+
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").Preload("Payment").First(&booking, booking.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load booking"})
+            return
+        }
+        c.JSON(http.StatusCreated, booking)
+    }
+}
+
+// backfillBoxOfficeSellers moves counter sales made before SoldBy existed
+// off the cashier's account, and withdraws the transfer offers that a
+// session cancellation addressed to the cashier for them.
+func backfillBoxOfficeSellers(db *gorm.DB) error {
+    return runBackfill(db, "bookings-box-office-sold-by", func(tx *gorm.DB) error {
+        sales := tx.Model(&Payment{}).Select("booking_id").Where("provider = ?", boxOfficeProvider)
+        if err := tx.Model(&SessionTransferOffer{}).Where("booking_id IN (?) AND status = ?", sales, "open").
+            Update("status", "withdrawn").Error; err != nil {
+            return err
+        }
+        return tx.Model(&Booking{}).Where("id IN (?) AND user_id <> 0", sales).
+            Updates(map[string]interface{}{"sold_by": gorm.Expr("user_id"), "user_id": 0}).Error
+    })
+}
@@ -0,0 +1,206 @@
+
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+const ticketCodePrefix = "KF1"
+
+// checkinOpensBefore is how long before the start ushers may admit guests.
+const checkinOpensBefore = time.Hour
+
+type TicketClaims struct {
+    BookingID uint  `json:"b"`
+    SessionID uint  `json:"s"`
+    IssuedAt  int64 `json:"iat"`
+}
+
+// Admission marks a seat of a booking as having passed the door. The unique
+// index guarantees every seat is admitted at most once.
+type Admission struct {
+    ID         uint      `gorm:"primaryKey" json:"id"`
+    BookingID  uint      `gorm:"not null;uniqueIndex:idx_admission_seat" json:"booking_id"`
+    SeatID     uint      `gorm:"not null;uniqueIndex:idx_admission_seat" json:"seat_id"`
+    SessionID  uint      `gorm:"index" json:"session_id"`
+    AdmittedBy uint      `json:"admitted_by"`
+    AdmittedAt time.Time `json:"admitted_at"`
+}
+
+type CheckinRequest struct {
+    Code      string `json:"code"`
+    SessionID uint   `json:"session_id"`
+    SeatIDs   []uint `json:"seat_ids"`
+}
+
+var errInvalidTicket = errors.New("invalid ticket code")
+
+// signTicket produces the QR payload for a booking: a versioned, base64url
+// encoded claim set followed by its HMAC-SHA256 signature.
+func signTicket(key []byte, booking Booking) string {
+    claims := TicketClaims{BookingID: booking.ID, SessionID: booking.SessionID, IssuedAt: time.Now().Unix()}
+    raw, _ := json.Marshal(claims)
+    body := ticketCodePrefix + "." + base64.RawURLEncoding.EncodeToString(raw)
+    return body + "." + base64.RawURLEncoding.EncodeToString(ticketMAC(key, body))
+}
+
+func verifyTicket(key []byte, code string) (TicketClaims, error) {
+    parts := strings.Split(strings.TrimSpace(code), ".")
+    if len(parts) != 3 || parts[0] != ticketCodePrefix {
+        return TicketClaims{}, errInvalidTicket
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return TicketClaims{}, errInvalidTicket
+    }
+    if !hmac.Equal(sig, ticketMAC(key, parts[0]+"."+parts[1])) {
+        return TicketClaims{}, errInvalidTicket
+    }
+    raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return TicketClaims{}, errInvalidTicket
+    }
+    var claims TicketClaims
+    if err := json.Unmarshal(raw, &claims); err != nil || claims.BookingID == 0 {
+        return TicketClaims{}, errInvalidTicket
+    }
+    return claims, nil
+}
+
+func ticketMAC(key []byte, body string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(body))
+    return mac.Sum(nil)
+}
+
+// deriveKey turns the server secret into a purpose-specific key so QR codes
+// cannot be replayed as JWTs or vice versa.
+func deriveKey(secret, purpose string) []byte {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(purpose))
+    return mac.Sum(nil)
+}
+
+func rejectCheckin(c *gin.Context, reason, message string) {
+    c.JSON(http.StatusOK, gin.H{"accepted": false, "reason": reason, "message": message})
+}
+
+func checkinHandler(db *gorm.DB, key []byte, loc *time.Location) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        staffID := c.GetUint("user_id")
+        var req CheckinRequest
+        if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+            return
+        }
+
+        claims, err := verifyTicket(key, req.Code)
+        if err != nil {
+            rejectCheckin(c, "invalid_signature", "ticket code is forged or damaged")
+            return
+        }
+        var booking Booking
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").First(&booking, claims.BookingID).Error; err != nil {
+            rejectCheckin(c, "unknown_booking", "booking does not exist")
+            return
+        }
+        if booking.SessionID != claims.SessionID {
+            rejectCheckin(c, "invalid_signature", "ticket does not match booking")
+            return
+        }
+        if req.SessionID != 0 && req.SessionID != booking.SessionID {
+            rejectCheckin(c, "wrong_session", "ticket is for another session")
+            return
+        }
+        if booking.Status != "confirmed" {
+            rejectCheckin(c, "not_confirmed", "booking is "+booking.Status)
+            return
+        }
+
+        now := time.Now()
+        start := booking.Session.StartTime
+        end := start.Add(movieRuntime(booking.Session.Movie.DurationMins))
+        if now.Before(start.Add(-checkinOpensBefore)) {
+            rejectCheckin(c, "too_early", "check-in opens "+start.Add(-checkinOpensBefore).In(loc).Format("15:04"))
+            return
+        }
+        if now.After(end) {
+            rejectCheckin(c, "session_ended", "session has already ended")
+            return
+        }
+
+        seats := booking.Seats
+        if len(req.SeatIDs) > 0 {
+            wanted := map[uint]bool{}
+            for _, id := range req.SeatIDs {
+                wanted[id] = true
+            }
+            seats = make([]Seat, 0, len(req.SeatIDs))
+            for _, seat := range booking.Seats {
+                if wanted[seat.ID] {
+                    seats = append(seats, seat)
+                }
+            }
+            if len(seats) != len(wanted) {
+                rejectCheckin(c, "wrong_seat", "some seats do not belong to this booking")
+                return
+            }
+        }
+
+        admitted := make([]Seat, 0, len(seats))
+        already := make([]Seat, 0)
+        err = db.Transaction(func(tx *gorm.DB) error {
+            for _, seat := range seats {
+                res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Admission{
+                    BookingID:  booking.ID,
+                    SeatID:     seat.ID,
+                    SessionID:  booking.SessionID,
+                    AdmittedBy: staffID,
+                    AdmittedAt: now,
+                })
+                if res.Error != nil {
+                    return res.Error
+                }
+                if res.RowsAffected == 0 {
+                    already = append(already, seat)
+                } else {
+                    admitted = append(admitted, seat)
+                }
+            }
+            return nil
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record admission"})
+            return
+        }
+        if len(admitted) == 0 {
+            c.JSON(http.StatusOK, gin.H{
+                "accepted":         false,
+                "reason":           "already_admitted",
+                "message":          "all seats were already admitted",
+                "booking_id":       booking.ID,
+                "already_admitted": already,
+            })
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{
+            "accepted":         true,
+            "reason":           "ok",
+            "booking_id":       booking.ID,
+            "session":          booking.Session,
+            "admitted":         admitted,
+            "already_admitted": already,
+        })
+    }
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "encoding/base64"
+    "errors"
+    "strings"
+    "testing"
+)
+
+func TestVerifyTicket(t *testing.T) {
+    key := deriveKey("test-secret", "ticket-qr")
+    booking := Booking{ID: 42, SessionID: 7}
+    code := signTicket(key, booking)
+    parts := strings.Split(code, ".")
+
+    // forge signs an arbitrary claim body with the real key.
+    forge := func(claims string) string {
+        body := ticketCodePrefix + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+        return body + "." + base64.RawURLEncoding.EncodeToString(ticketMAC(key, body))
+    }
+    otherClaims := base64.RawURLEncoding.EncodeToString([]byte(`{"b":43,"s":7,"iat":0}`))
+
+    cases := []struct {
+        name string
+        code string
+        ok   bool
+    }{
+        {"valid", code, true},
+        {"surrounding whitespace", "  " + code + "\n", true},
+        {"claims swapped for another booking", parts[0] + "." + otherClaims + "." + parts[2], false},
+        {"signature flipped", parts[0] + "." + parts[1] + "." + flipFirstChar(parts[2]), false},
+        {"signature not base64", parts[0] + "." + parts[1] + ".!!!", false},
+        {"signature missing", parts[0] + "." + parts[1], false},
+        {"wrong prefix", "KF0." + parts[1] + "." + parts[2], false},
+        {"extra part", code + ".x", false},
+        {"signed with another key", signTicket(deriveKey("test-secret", "other"), booking), false},
+        {"signed but not json", forge("not json"), false},
+        {"signed without a booking", forge(`{"b":0,"s":7}`), false},
+        {"empty", "", false},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            claims, err := verifyTicket(key, tc.code)
+            if !tc.ok {
+                if !errors.Is(err, errInvalidTicket) {
+                    t.Fatalf("expected errInvalidTicket, got %+v, %v", claims, err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if claims.BookingID != booking.ID || claims.SessionID != booking.SessionID {
+                t.Errorf("claims = %+v, want booking %d session %d", claims, booking.ID, booking.SessionID)
+            }
+        })
+    }
+}
+
+func TestDeriveKeySeparatesPurposes(t *testing.T) {
+    if string(deriveKey("secret", "ticket-qr")) == string(deriveKey("secret", "guest-access")) {
+        t.Error("different purposes must yield different keys")
+    }
+    if string(deriveKey("secret", "ticket-qr")) != string(deriveKey("secret", "ticket-qr")) {
+        t.Error("the same purpose must yield the same key")
+    }
+}
+
+// flipFirstChar changes the first character; unlike the last one it carries
+// no padding bits, so the decoded value always differs.
+func flipFirstChar(s string) string {
+    replacement := "A"
+    if s[0] == 'A' {
+        replacement = "B"
+    }
+    return replacement + s[1:]
+}
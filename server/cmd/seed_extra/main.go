@@ -6,10 +6,13 @@ import (
 	"os"
 	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+
+	"kinoform/scheduling"
 )
 
 type SeedHall struct {
@@ -80,9 +83,12 @@ func main() {
 		for r := 1; r <= hall.Rows; r++ {
 			for n := 1; n <= hall.Cols; n++ {
 				seats = append(seats, map[string]any{
-					"hall_id": hall.ID,
-					"row":     r,
-					"number":  n,
+					"hall_id":   hall.ID,
+					"row":       r,
+					"number":    n,
+					"row_label": fmt.Sprint(r),
+					"grid_row":  r - 1,
+					"grid_col":  n - 1,
 				})
 			}
 		}
@@ -99,83 +105,52 @@ func main() {
 		log.Fatal("no movies found")
 	}
 
-	now := time.Now()
-	location := now.Location()
-	newSessions := make([]SeedSession, 0)
-	const (
-		dayStartHour      = 6
-		dayEndHour        = 23
-		breakBetweenShows = 20 * time.Minute
-	)
-
-	nextMovieIndex := 0
-	for day := 0; day < 7; day++ {
-		baseDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location).AddDate(0, 0, day)
-
-		dayStart := baseDate.Add(dayStartHour * time.Hour)
-		dayEnd := baseDate.Add(dayEndHour * time.Hour)
-		hallCursor := make([]time.Time, len(halls))
-		for i := range halls {
-			// Slight staggering avoids every hall starting at exactly the same minute.
-			hallCursor[i] = dayStart.Add(time.Duration(i*10) * time.Minute)
-		}
-
-		// Ensure each movie appears at least once per day across all halls.
-		for _, movie := range movies {
-			hallIndex := earliestAvailableHall(hallCursor)
-			startTime := hallCursor[hallIndex]
-			if startTime.After(dayEnd) {
-				break
-			}
-
-			duration := safeDuration(movie.DurationMins)
-			var existingCount int64
-			if err := db.Table("sessions").
-				Where("hall_id = ? AND start_time = ?", halls[hallIndex].ID, startTime).
-				Count(&existingCount).Error; err != nil {
-				log.Fatalf("failed to check sessions: %v", err)
-			}
-			if existingCount == 0 {
-				newSessions = append(newSessions, SeedSession{
-					MovieID:   movie.ID,
-					HallID:    halls[hallIndex].ID,
-					StartTime: startTime,
-					BasePrice: calcBasePrice(startTime, hallIndex),
-				})
-			}
-
-			hallCursor[hallIndex] = startTime.Add(duration).Add(breakBetweenShows)
-		}
-
-		// Fill remaining daily slots up to 23:00 with realistic intervals.
-		for {
-			hallIndex := earliestAvailableHall(hallCursor)
-			startTime := hallCursor[hallIndex]
-			if startTime.After(dayEnd) {
-				break
-			}
+	zone := strings.TrimSpace(os.Getenv("CINEMA_TIMEZONE"))
+	if zone == "" {
+		zone = "Asia/Almaty"
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		log.Fatalf("invalid CINEMA_TIMEZONE: %v", err)
+	}
+	now := time.Now().In(loc)
+	opts := scheduling.DefaultOptions(now)
 
-			movie := movies[nextMovieIndex%len(movies)]
-			nextMovieIndex++
-			duration := safeDuration(movie.DurationMins)
+	var existing []struct {
+		HallID       uint      `gorm:"column:hall_id"`
+		StartTime    time.Time `gorm:"column:start_time"`
+		DurationMins int       `gorm:"column:duration_mins"`
+	}
+	if err := db.Table("sessions").
+		Select("sessions.hall_id, sessions.start_time, movies.duration_mins").
+		Joins("JOIN movies ON movies.id = sessions.movie_id").
+		Where("sessions.start_time >= ? AND sessions.start_time < ?", opts.From.Add(-24*time.Hour), opts.To.AddDate(0, 0, 1)).
+		Scan(&existing).Error; err != nil {
+		log.Fatalf("failed to check sessions: %v", err)
+	}
+	busy := make([]scheduling.Busy, 0, len(existing))
+	for _, s := range existing {
+		end := s.StartTime.Add(scheduling.SafeDuration(s.DurationMins)).Add(opts.Break)
+		busy = append(busy, scheduling.Busy{HallID: s.HallID, Start: s.StartTime, End: end})
+	}
 
-			var existingCount int64
-			if err := db.Table("sessions").
-				Where("hall_id = ? AND start_time = ?", halls[hallIndex].ID, startTime).
-				Count(&existingCount).Error; err != nil {
-				log.Fatalf("failed to check sessions: %v", err)
-			}
-			if existingCount == 0 {
-				newSessions = append(newSessions, SeedSession{
-					MovieID:   movie.ID,
-					HallID:    halls[hallIndex].ID,
-					StartTime: startTime,
-					BasePrice: calcBasePrice(startTime, hallIndex),
-				})
-			}
+	planHalls := make([]scheduling.Hall, 0, len(halls))
+	for _, hall := range halls {
+		planHalls = append(planHalls, scheduling.Hall{ID: hall.ID})
+	}
+	planMovies := make([]scheduling.Movie, 0, len(movies))
+	for _, movie := range movies {
+		planMovies = append(planMovies, scheduling.Movie{ID: movie.ID, DurationMins: movie.DurationMins})
+	}
 
-			hallCursor[hallIndex] = startTime.Add(duration).Add(breakBetweenShows)
-		}
+	newSessions := make([]SeedSession, 0)
+	for _, slot := range scheduling.Generate(planHalls, planMovies, busy, opts) {
+		newSessions = append(newSessions, SeedSession{
+			MovieID:   slot.MovieID,
+			HallID:    slot.HallID,
+			StartTime: slot.Start,
+			BasePrice: slot.BasePrice,
+		})
 	}
 
 	if len(newSessions) == 0 {
@@ -189,37 +164,3 @@ func main() {
 
 	fmt.Printf("Added %d sessions across %d halls.\n", len(newSessions), len(halls))
 }
-
-func safeDuration(minutes int) time.Duration {
-	if minutes <= 0 {
-		minutes = 100
-	}
-	return time.Duration(minutes) * time.Minute
-}
-
-func earliestAvailableHall(cursor []time.Time) int {
-	minIndex := 0
-	for i := 1; i < len(cursor); i++ {
-		if cursor[i].Before(cursor[minIndex]) {
-			minIndex = i
-		}
-	}
-	return minIndex
-}
-
-func calcBasePrice(start time.Time, hallIndex int) int {
-	price := 420 + hallIndex*20
-	hour := start.Hour()
-	if hour >= 18 {
-		price += 120
-	} else if hour >= 12 {
-		price += 60
-	}
-	if hour < 9 {
-		price -= 40
-	}
-	if price < 300 {
-		price = 300
-	}
-	return price
-}
@@ -0,0 +1,305 @@
+
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+)
+
+var errInvalidGuestAccess = errors.New("invalid booking access link")
+
+// GuestCustomer is the identity behind bookings made without an account. One
+// record is kept per email until a verified user with that address claims it.
+type GuestCustomer struct {
+    ID              uint       `gorm:"primaryKey" json:"id"`
+    Name            string     `json:"name"`
+    Email           string     `gorm:"index;not null" json:"email"`
+    Phone           string     `json:"phone"`
+    ClaimedByUserID *uint      `gorm:"index" json:"claimed_by_user_id,omitempty"`
+    ClaimedAt       *time.Time `json:"claimed_at,omitempty"`
+    AccessNonce     string     `gorm:"size:32;not null;default:''" json:"-"`
+    CreatedAt       time.Time  `json:"created_at"`
+}
+
+// guestAccessGrace is how long a guest link keeps working after the
+// screening ends, e.g. for a refund receipt.
+const guestAccessGrace = 24 * time.Hour
+
+type GuestBookingRequest struct {
+    BookingRequest
+    Name  string `json:"name"`
+    Email string `json:"email"`
+    Phone string `json:"phone"`
+}
+
+// signGuestAccess builds the "<booking>.<guest>.<expiry>.<signature>" token
+// carried by guest links. The guest's email and access nonce are part of the
+// signed data, so rotating the nonce revokes every link issued so far.
+func signGuestAccess(key []byte, bookingID uint, guest GuestCustomer, expires time.Time) string {
+    body := fmt.Sprintf("%d.%d.%d", bookingID, guest.ID, expires.Unix())
+    return body + "." + base64.RawURLEncoding.EncodeToString(ticketMAC(key, guestAccessData(body, guest)))
+}
+
+func guestAccessData(body string, guest GuestCustomer) string {
+    return body + "." + guest.Email + "." + guest.AccessNonce
+}
+
+// guestAccessExpiry lets a guest link work until a day after the screening.
+func guestAccessExpiry(session Session) time.Time {
+    return session.StartTime.Add(time.Duration(session.Movie.DurationMins)*time.Minute + guestAccessGrace)
+}
+
+func guestAccessURL(publicURL string, bookingID uint, token string) string {
+    return fmt.Sprintf("%s/api/guest/bookings/%d/ticket?access=%s", strings.TrimRight(publicURL, "/"), bookingID, url.QueryEscape(token))
+}
+
+// verifyGuestAccess checks token against the booking in the route. The token
+// may come in the "access" query parameter or the X-Booking-Access header.
+func verifyGuestAccess(db *gorm.DB, key []byte, c *gin.Context) (uint, error) {
+    token := c.Query("access")
+    if token == "" {
+        token = c.GetHeader("X-Booking-Access")
+    }
+    parts := strings.Split(strings.TrimSpace(token), ".")
+    if len(parts) != 4 || parts[0] != c.Param("id") {
+        return 0, errInvalidGuestAccess
+    }
+    bookingID, err := strconv.ParseUint(parts[0], 10, 64)
+    if err != nil {
+        return 0, errInvalidGuestAccess
+    }
+    guestID, err := strconv.ParseUint(parts[1], 10, 64)
+    if err != nil {
+        return 0, errInvalidGuestAccess
+    }
+    expires, err := strconv.ParseInt(parts[2], 10, 64)
+    if err != nil || time.Now().Unix() > expires {
+        return 0, errInvalidGuestAccess
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+    if err != nil {
+        return 0, errInvalidGuestAccess
+    }
+    var guest GuestCustomer
+    if err := db.First(&guest, uint(guestID)).Error; err != nil {
+        return 0, errInvalidGuestAccess
+    }
+    // Once claimed the bookings belong to an account and the link is void.
+    if guest.ClaimedByUserID != nil {
+        return 0, errInvalidGuestAccess
+    }
+    if !hmac.Equal(sig, ticketMAC(key, guestAccessData(strings.Join(parts[:3], "."), guest))) {
+        return 0, errInvalidGuestAccess
+    }
+    var count int64
+    if err := db.Model(&Booking{}).Where("id = ? AND guest_id = ?", bookingID, guest.ID).Count(&count).Error; err != nil || count == 0 {
+        return 0, errInvalidGuestAccess
+    }
+    return uint(bookingID), nil
+}
+
+// guestBookingLoader is the bookingLoader for routes opened from a guest link.
+func guestBookingLoader(key []byte) bookingLoader {
+    return func(db *gorm.DB, c *gin.Context) (Booking, error) {
+        var booking Booking
+        bookingID, err := verifyGuestAccess(db, key, c)
+        if err != nil {
+            c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+            return booking, err
+        }
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").Preload("Payment").Preload("Guest").First(&booking, bookingID).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
+            return booking, err
+        }
+        return booking, nil
+    }
+}
+
+func validPhone(phone string) bool {
+    digits := 0
+    for _, r := range phone {
+        switch {
+        case r >= '0' && r <= '9':
+            digits++
+        case strings.ContainsRune("+-() ", r):
+        default:
+            return false
+        }
+    }
+    return digits >= 6 && digits <= 15
+}
+
+// guestIdentity returns the unclaimed guest record for email, refreshing the
+// contact details, or creates one.
+func guestIdentity(tx *gorm.DB, name, email, phone string) (GuestCustomer, error) {
+    var guest GuestCustomer
+    err := tx.Where("email = ? AND claimed_by_user_id IS NULL", email).Order("id desc").First(&guest).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        guest = GuestCustomer{Name: name, Email: email, Phone: phone, AccessNonce: randomHex(16)}
+        return guest, tx.Create(&guest).Error
+    }
+    if err != nil {
+        return guest, err
+    }
+    if guest.Name != name || guest.Phone != phone {
+        if err := tx.Model(&guest).Updates(map[string]interface{}{"name": name, "phone": phone}).Error; err != nil {
+            return guest, err
+        }
+    }
+    return guest, nil
+}
+
+func createGuestBooking(db *gorm.DB, payments PaymentProvider, mailer Mailer, cfg Config, logger *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req GuestBookingRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        req.Name = strings.TrimSpace(req.Name)
+        req.Email = strings.TrimSpace(strings.ToLower(req.Email))
+        req.Phone = strings.TrimSpace(req.Phone)
+        if req.Name == "" || req.Email == "" || req.Phone == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "name, email and phone are required"})
+            return
+        }
+        if !strings.Contains(req.Email, "@") {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid email"})
+            return
+        }
+        if !validPhone(req.Phone) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid phone"})
+            return
+        }
+        session, tickets, ok := loadBookingSession(c, db, req.BookingRequest)
+        if !ok {
+            return
+        }
+
+        var booking Booking
+        var guest GuestCustomer
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var err error
+            guest, err = guestIdentity(tx, req.Name, req.Email, req.Phone)
+            if err != nil {
+                return err
+            }
+            booking, err = insertBooking(tx, 0, session, tickets, req.PaymentMethod, 0)
+            if err != nil {
+                return err
+            }
+            return tx.Model(&booking).Update("guest_id", guest.ID).Error
+        })
+        if err != nil {
+            respondBookingConflict(c, err)
+            return
+        }
+        if _, err := startPayment(db, payments, cfg.PaymentCurrency, booking); err != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "failed to start payment"})
+            return
+        }
+
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").Preload("Payment").Preload("Guest").First(&booking, booking.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load booking"})
+            return
+        }
+        token := signGuestAccess(cfg.GuestAccessKey, booking.ID, guest, guestAccessExpiry(booking.Session))
+        link := guestAccessURL(cfg.PublicURL, booking.ID, token)
+        // The response already carries the link, so the mail is sent in the
+        // background.
+        go func(booking Booking) {
+            if err := sendGuestBookingEmail(mailer, guest, booking, link); err != nil {
+                logger.Warn("failed to send guest booking email", zap.Uint("booking_id", booking.ID), zap.Error(err))
+            }
+        }(booking)
+        c.JSON(http.StatusCreated, gin.H{"booking": booking, "access_token": token, "access_url": link})
+    }
+}
+
+func sendGuestBookingEmail(mailer Mailer, guest GuestCustomer, booking Booking, link string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+    defer cancel()
+    return mailer.Send(ctx, Mail{
+        To:      guest.Email,
+        Subject: fmt.Sprintf("Kinoform: бронирование №%d", booking.ID),
+        Text: fmt.Sprintf("Здравствуйте, %s!\n\nВаше бронирование №%d на «%s» создано.\n"+
+            "Билет, QR-код и отмена доступны по ссылке:\n%s\n\n"+
+            "Зарегистрируйтесь с этим адресом, чтобы бронирование появилось в вашем профиле.\n",
+            guest.Name, booking.ID, booking.Session.Movie.Title, link),
+    })
+}
+
+func getGuestBooking(db *gorm.DB, key []byte) gin.HandlerFunc {
+    load := guestBookingLoader(key)
+    return func(c *gin.Context) {
+        booking, err := load(db, c)
+        if err != nil {
+            return
+        }
+        c.JSON(http.StatusOK, booking)
+    }
+}
+
+func guestCancelBooking(db *gorm.DB, payments PaymentProvider, key []byte, policy CancellationPolicy) gin.HandlerFunc {
+    load := guestBookingLoader(key)
+    return func(c *gin.Context) {
+        booking, err := load(db, c)
+        if err != nil {
+            return
+        }
+        customerCancel(c, db, payments, policy, booking)
+    }
+}
+
+// claimGuestBookings moves unclaimed guest bookings made with the user's
+// email onto their account. Callers must have proven the user owns it. The
+// access nonce is rotated so the guest links stop working.
+func claimGuestBookings(tx *gorm.DB, user User) (int64, error) {
+    guests := tx.Model(&GuestCustomer{}).Select("id").Where("email = ? AND claimed_by_user_id IS NULL", user.Email)
+    result := tx.Model(&Booking{}).Where("guest_id IN (?) AND user_id = 0", guests).Update("user_id", user.ID)
+    if result.Error != nil {
+        return 0, result.Error
+    }
+    err := tx.Model(&GuestCustomer{}).Where("email = ? AND claimed_by_user_id IS NULL", user.Email).
+        Updates(map[string]interface{}{"claimed_by_user_id": user.ID, "claimed_at": time.Now(), "access_nonce": randomHex(16)}).Error
+    return result.RowsAffected, err
+}
+
+func claimGuestBookingsHandler(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var user User
+        if err := db.First(&user, c.GetUint("user_id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        // Accounts that predate verification were only marked verified, so
+        // owning the address must have been proven through the link.
+        if user.EmailConfirmedAt == nil {
+            c.JSON(http.StatusForbidden, gin.H{"error": "confirm your email through the verification link first"})
+            return
+        }
+        var claimed int64
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var err error
+            claimed, err = claimGuestBookings(tx, user)
+            return err
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to claim bookings"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"claimed": claimed})
+    }
+}
@@ -0,0 +1,615 @@
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+const (
+    maxLayoutRows = 100
+    maxLayoutCols = 100
+
+    CellSeat  = "seat"
+    CellAisle = "aisle"
+    CellEmpty = "empty"
+)
+
+// layoutSeatCodes maps the letters of a layout row to seat categories. "X"
+// is a seat that exists but is not sold, "_" an aisle and "." or a space an
+// empty cell.
+var layoutSeatCodes = map[rune]string{
+    'S': SeatStandard,
+    'V': SeatVIP,
+    'L': SeatCouple,
+    'W': SeatWheelchair,
+    'C': SeatCompanion,
+    'X': SeatStandard,
+}
+
+// LayoutRow describes one grid row of a hall. Either Cells spells the row out
+// cell by cell ("SSS_SSSS_SSS"), or Seats gives a plain run of standard
+// seats. Offset shifts the row right by that many empty cells; Label is the
+// printed row name and defaults to the row number.
+type LayoutRow struct {
+    Label  string `json:"label,omitempty"`
+    Offset int    `json:"offset,omitempty"`
+    Seats  int    `json:"seats,omitempty"`
+    Cells  string `json:"cells,omitempty"`
+}
+
+type HallLayout struct {
+    Rows []LayoutRow `json:"rows"`
+}
+
+type LayoutCell struct {
+    Col      int    `json:"col"`
+    Kind     string `json:"kind"`
+    SeatID   uint   `json:"seat_id,omitempty"`
+    Number   int    `json:"number,omitempty"`
+    Category string `json:"category,omitempty"`
+    Disabled bool   `json:"disabled,omitempty"`
+}
+
+type LayoutRowView struct {
+    GridRow int          `json:"grid_row"`
+    Row     int          `json:"row,omitempty"`
+    Label   string       `json:"label,omitempty"`
+    Cells   []LayoutCell `json:"cells"`
+}
+
+type HallLayoutView struct {
+    HallID uint            `json:"hall_id"`
+    Name   string          `json:"name"`
+    Width  int             `json:"width"`
+    Height int             `json:"height"`
+    Rows   []LayoutRowView `json:"rows"`
+}
+
+// rectangleLayout is the layout of halls created with only rows and cols.
+func rectangleLayout(rows, cols int) HallLayout {
+    layout := HallLayout{Rows: make([]LayoutRow, 0, rows)}
+    for r := 0; r < rows; r++ {
+        layout.Rows = append(layout.Rows, LayoutRow{Seats: cols})
+    }
+    return layout
+}
+
+// normalize expands every row into its Cells form with the offset applied,
+// so stored layouts can be compared and rendered without further rules.
+// Seats are matched across layout edits by row label and number, so the
+// effective labels of seat rows, explicit or numbered, must be unique.
+func (l HallLayout) normalize() (HallLayout, error) {
+    if len(l.Rows) == 0 {
+        return HallLayout{}, errors.New("layout needs at least one row")
+    }
+    if len(l.Rows) > maxLayoutRows {
+        return HallLayout{}, fmt.Errorf("layout cannot have more than %d rows", maxLayoutRows)
+    }
+    out := HallLayout{Rows: make([]LayoutRow, 0, len(l.Rows))}
+    seats := 0
+    seatRows := 0
+    labels := map[string]bool{}
+    for i, row := range l.Rows {
+        if row.Offset < 0 || row.Seats < 0 {
+            return HallLayout{}, fmt.Errorf("row %d: offset and seats cannot be negative", i+1)
+        }
+        cells := strings.ToUpper(row.Cells)
+        if cells == "" {
+            cells = strings.Repeat("S", row.Seats)
+        } else if row.Seats > 0 {
+            return HallLayout{}, fmt.Errorf("row %d: use either cells or seats", i+1)
+        }
+        cells = strings.Repeat(".", row.Offset) + strings.ReplaceAll(cells, " ", ".")
+        cells = strings.TrimRight(cells, ".")
+        if len(cells) > maxLayoutCols {
+            return HallLayout{}, fmt.Errorf("row %d is wider than %d cells", i+1, maxLayoutCols)
+        }
+        rowSeats := 0
+        for _, ch := range cells {
+            if _, ok := layoutSeatCodes[ch]; ok {
+                rowSeats++
+                continue
+            }
+            if ch != '_' && ch != '.' {
+                return HallLayout{}, fmt.Errorf("row %d: unknown cell %q", i+1, ch)
+            }
+        }
+        label := strings.TrimSpace(row.Label)
+        if rowSeats > 0 {
+            seatRows++
+            effective := label
+            if effective == "" {
+                effective = strconv.Itoa(seatRows)
+            }
+            if labels[effective] {
+                return HallLayout{}, fmt.Errorf("row label %q is used twice", effective)
+            }
+            labels[effective] = true
+        }
+        seats += rowSeats
+        out.Rows = append(out.Rows, LayoutRow{Label: label, Cells: cells})
+    }
+    if seats == 0 {
+        return HallLayout{}, errors.New("layout has no seats")
+    }
+    return out, nil
+}
+
+// Width is the number of grid columns of a normalized layout.
+func (l HallLayout) Width() int {
+    width := 0
+    for _, row := range l.Rows {
+        if len(row.Cells) > width {
+            width = len(row.Cells)
+        }
+    }
+    return width
+}
+
+// SeatRows counts the rows that actually hold seats; aisle rows are not
+// numbered.
+func (l HallLayout) SeatRows() int {
+    count := 0
+    for _, row := range l.Rows {
+        if strings.IndexFunc(row.Cells, func(ch rune) bool { _, ok := layoutSeatCodes[ch]; return ok }) >= 0 {
+            count++
+        }
+    }
+    return count
+}
+
+// seats generates the seats of a normalized layout. Rows and seat numbers
+// count seats only, so aisles and gaps do not shift the numbering.
+func (l HallLayout) seats(hallID uint) []Seat {
+    seats := make([]Seat, 0)
+    rowNumber := 0
+    for gridRow, row := range l.Rows {
+        number := 0
+        for gridCol, ch := range row.Cells {
+            category, ok := layoutSeatCodes[ch]
+            if !ok {
+                continue
+            }
+            if number == 0 {
+                rowNumber++
+            }
+            number++
+            label := row.Label
+            if label == "" {
+                label = strconv.Itoa(rowNumber)
+            }
+            seats = append(seats, Seat{
+                HallID:   hallID,
+                Row:      rowNumber,
+                Number:   number,
+                RowLabel: label,
+                GridRow:  gridRow,
+                GridCol:  gridCol,
+                Category: category,
+                Disabled: ch == 'X',
+            })
+        }
+    }
+    return seats
+}
+
+func encodeLayout(layout HallLayout) (string, error) {
+    raw, err := json.Marshal(layout)
+    return string(raw), err
+}
+
+// hallLayout returns the stored layout of a hall; halls created before
+// layouts existed are rectangles.
+func hallLayout(hall Hall) HallLayout {
+    if hall.Layout != "" {
+        var layout HallLayout
+        if err := json.Unmarshal([]byte(hall.Layout), &layout); err == nil && len(layout.Rows) > 0 {
+            return layout
+        }
+    }
+    layout, _ := rectangleLayout(hall.Rows, hall.Cols).normalize()
+    return layout
+}
+
+// backfillSeatGrid places seats created before grid coordinates existed on
+// the rectangle they were generated from.
+func backfillSeatGrid(db *gorm.DB) error {
+    return db.Exec(`UPDATE seats SET grid_row = row - 1, grid_col = number - 1, row_label = CAST(row AS TEXT)
+        WHERE (grid_row < 0 OR grid_col < 0) AND removed_at IS NULL`).Error
+}
+
+func buildLayoutView(hall Hall, seats []Seat) HallLayoutView {
+    layout := hallLayout(hall)
+    type cellKey struct{ row, col int }
+    byCell := make(map[cellKey]Seat, len(seats))
+    for _, seat := range seats {
+        if seat.GridRow < 0 || seat.GridCol < 0 {
+            // Inserted behind the API's back (e.g. by cmd/seed_extra) since the last backfill.
+            seat.GridRow, seat.GridCol = seat.Row-1, seat.Number-1
+            if seat.RowLabel == "" {
+                seat.RowLabel = strconv.Itoa(seat.Row)
+            }
+        }
+        byCell[cellKey{seat.GridRow, seat.GridCol}] = seat
+    }
+    view := HallLayoutView{HallID: hall.ID, Name: hall.Name, Width: layout.Width(), Height: len(layout.Rows)}
+    for gridRow, row := range layout.Rows {
+        rowView := LayoutRowView{GridRow: gridRow, Cells: make([]LayoutCell, 0, len(row.Cells))}
+        for gridCol, ch := range row.Cells {
+            cell := LayoutCell{Col: gridCol, Kind: CellEmpty}
+            switch {
+            case ch == '_':
+                cell.Kind = CellAisle
+            case ch == '.':
+            default:
+                seat, ok := byCell[cellKey{gridRow, gridCol}]
+                if !ok {
+                    break
+                }
+                cell.Kind = CellSeat
+                cell.SeatID = seat.ID
+                cell.Number = seat.Number
+                cell.Category = seat.Category
+                cell.Disabled = seat.Disabled
+                rowView.Row = seat.Row
+                rowView.Label = seat.RowLabel
+            }
+            rowView.Cells = append(rowView.Cells, cell)
+        }
+        view.Rows = append(view.Rows, rowView)
+    }
+    return view
+}
+
+func getHallLayout(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var hall Hall
+        if err := db.First(&hall, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "hall not found"})
+            return
+        }
+        var seats []Seat
+        if err := db.Where("hall_id = ? AND removed_at IS NULL", hall.ID).Find(&seats).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load seats"})
+            return
+        }
+        c.JSON(http.StatusOK, buildLayoutView(hall, seats))
+    }
+}
+
+type LayoutUpdateRequest struct {
+    Layout HallLayout `json:"layout"`
+    DryRun bool       `json:"dry_run"`
+    Force  bool       `json:"force"`
+}
+
+type SeatChange struct {
+    Before Seat `json:"before"`
+    After  Seat `json:"after"`
+}
+
+// LayoutConflict is a future reservation on a seat the edit would remove,
+// disable or renumber.
+type LayoutConflict struct {
+    SeatID    uint      `json:"seat_id"`
+    SessionID uint      `json:"session_id"`
+    BookingID uint      `json:"booking_id"`
+    StartTime time.Time `json:"start_time"`
+    Change    string    `json:"change"`
+}
+
+type LayoutDiff struct {
+    Added     []Seat           `json:"added"`
+    Removed   []Seat           `json:"removed"`
+    Changed   []SeatChange     `json:"changed"`
+    Unchanged int              `json:"unchanged"`
+    Conflicts []LayoutConflict `json:"conflicts"`
+    // Cancelled lists the bookings a forced edit cancelled because their
+    // seats were removed or taken out of sale.
+    Cancelled []uint           `json:"cancelled,omitempty"`
+}
+
+func (d LayoutDiff) Empty() bool {
+    return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d LayoutDiff) summary() gin.H {
+    return gin.H{"added": len(d.Added), "removed": len(d.Removed), "changed": len(d.Changed), "conflicts": len(d.Conflicts)}
+}
+
+var errLayoutConflict = errors.New("layout change affects seats with upcoming bookings")
+
+// planLayoutChange matches the hall's current seats to the new layout by row
+// label and seat number, so inserting a row or shifting one sideways does not
+// disturb the seats around it; seats whose label is gone are matched by grid
+// position instead. Matched seats keep their ID, so bookings and reservations
+// stay attached; a plain "S" cell keeps whatever category the seat already
+// has.
+func planLayoutChange(tx *gorm.DB, hall Hall, layout HallLayout) (LayoutDiff, error) {
+    diff := LayoutDiff{Added: []Seat{}, Removed: []Seat{}, Changed: []SeatChange{}, Conflicts: []LayoutConflict{}}
+    var current []Seat
+    if err := tx.Where("hall_id = ? AND removed_at IS NULL", hall.ID).Find(&current).Error; err != nil {
+        return diff, err
+    }
+    type seatKey struct {
+        label  string
+        number int
+    }
+    type cellKey struct{ row, col int }
+    byLabel := make(map[seatKey]Seat, len(current))
+    for _, seat := range current {
+        byLabel[seatKey{seat.RowLabel, seat.Number}] = seat
+    }
+
+    // First pass: the same printed seat in the new layout.
+    next := layout.seats(hall.ID)
+    matched := make([]bool, len(next))
+    befores := make([]Seat, len(next))
+    for i, seat := range next {
+        key := seatKey{seat.RowLabel, seat.Number}
+        if before, ok := byLabel[key]; ok {
+            delete(byLabel, key)
+            matched[i], befores[i] = true, before
+        }
+    }
+    // Second pass: whatever is left occupies the same grid cell.
+    byCell := make(map[cellKey]Seat, len(byLabel))
+    for _, seat := range byLabel {
+        byCell[cellKey{seat.GridRow, seat.GridCol}] = seat
+    }
+    for i, seat := range next {
+        if matched[i] {
+            continue
+        }
+        key := cellKey{seat.GridRow, seat.GridCol}
+        if before, ok := byCell[key]; ok {
+            delete(byCell, key)
+            matched[i], befores[i] = true, before
+        }
+    }
+
+    touched := map[uint]string{}
+    for i, seat := range next {
+        if !matched[i] {
+            diff.Added = append(diff.Added, seat)
+            continue
+        }
+        before := befores[i]
+        seat.ID = before.ID
+        if seat.Category == SeatStandard {
+            seat.Category = before.Category
+        }
+        if seat == before {
+            diff.Unchanged++
+            continue
+        }
+        diff.Changed = append(diff.Changed, SeatChange{Before: before, After: seat})
+        switch {
+        case seat.Disabled && !before.Disabled:
+            touched[seat.ID] = "disabled"
+        case seat.Number != before.Number || seat.RowLabel != before.RowLabel:
+            touched[seat.ID] = "renumbered"
+        }
+    }
+    for _, seat := range byCell {
+        diff.Removed = append(diff.Removed, seat)
+        touched[seat.ID] = "removed"
+    }
+
+    if len(touched) > 0 {
+        ids := make([]uint, 0, len(touched))
+        for id := range touched {
+            ids = append(ids, id)
+        }
+        var rows []LayoutConflict
+        if err := tx.Table("session_seats").
+            Select("session_seats.seat_id, session_seats.session_id, session_seats.booking_id, sessions.start_time").
+            Joins("JOIN sessions ON sessions.id = session_seats.session_id").
+            Where("session_seats.seat_id IN ? AND session_seats.booking_id IS NOT NULL AND sessions.start_time > ?", ids, time.Now()).
+            Order("sessions.start_time asc").
+            Scan(&rows).Error; err != nil {
+            return diff, err
+        }
+        for _, row := range rows {
+            row.Change = touched[row.SeatID]
+            diff.Conflicts = append(diff.Conflicts, row)
+        }
+    }
+    return diff, nil
+}
+
+// applyLayoutChange writes a planned diff. Removed seats are retired rather
+// than deleted because past bookings still point at them; their pending
+// holds are dropped.
+func applyLayoutChange(tx *gorm.DB, actorID uint, hall Hall, layout HallLayout, diff LayoutDiff) error {
+    encoded, err := encodeLayout(layout)
+    if err != nil {
+        return err
+    }
+    if len(diff.Added) > 0 {
+        if err := tx.Create(&diff.Added).Error; err != nil {
+            return err
+        }
+    }
+    released := make([]uint, 0, len(diff.Removed))
+    for _, change := range diff.Changed {
+        seat := change.After
+        if err := tx.Model(&Seat{}).Where("id = ?", seat.ID).Updates(map[string]interface{}{
+            "row":       seat.Row,
+            "number":    seat.Number,
+            "row_label": seat.RowLabel,
+            "grid_row":  seat.GridRow,
+            "grid_col":  seat.GridCol,
+            "category":  seat.Category,
+            "disabled":  seat.Disabled,
+        }).Error; err != nil {
+            return err
+        }
+        if seat.Disabled {
+            released = append(released, seat.ID)
+        }
+    }
+    if len(diff.Removed) > 0 {
+        ids := make([]uint, 0, len(diff.Removed))
+        for _, seat := range diff.Removed {
+            ids = append(ids, seat.ID)
+        }
+        if err := tx.Model(&Seat{}).Where("id IN ?", ids).Update("removed_at", time.Now()).Error; err != nil {
+            return err
+        }
+        released = append(released, ids...)
+    }
+    if len(released) > 0 {
+        if err := tx.Where("seat_id IN ? AND hold_id IS NOT NULL", released).Delete(&SessionSeat{}).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("seat_id IN ?", released).Delete(&SeatHoldSeat{}).Error; err != nil {
+            return err
+        }
+    }
+    if err := tx.Model(&Hall{}).Where("id = ?", hall.ID).Updates(map[string]interface{}{
+        "rows":   layout.SeatRows(),
+        "cols":   layout.Width(),
+        "layout": encoded,
+    }).Error; err != nil {
+        return err
+    }
+    return recordAudit(tx, actorID, "hall.layout.update", "hall", hall.ID, "", diff.summary())
+}
+
+// changeHallLayout plans and, unless dryRun, applies a layout edit in one
+// transaction. Edits touching upcoming bookings fail with errLayoutConflict
+// unless forced; a forced edit cancels, with a full refund, the bookings
+// whose seats it removes or disables. The diff is returned either way.
+func changeHallLayout(db *gorm.DB, payments PaymentProvider, actorID uint, hall Hall, layout HallLayout, dryRun, force bool) (LayoutDiff, error) {
+    var diff LayoutDiff
+    err := db.Transaction(func(tx *gorm.DB) error {
+        var err error
+        diff, err = changeHallLayoutTx(tx, actorID, hall, layout, dryRun, force)
+        return err
+    })
+    if err == nil {
+        refundLayoutCancellations(db, payments, diff)
+    }
+    return diff, err
+}
+
+// changeHallLayoutTx is changeHallLayout inside the caller's transaction.
+// The caller must run refundLayoutCancellations once it has committed.
+func changeHallLayoutTx(tx *gorm.DB, actorID uint, hall Hall, layout HallLayout, dryRun, force bool) (LayoutDiff, error) {
+    // Lock the hall so two editors cannot interleave their plans.
+    if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&hall, hall.ID).Error; err != nil {
+        return LayoutDiff{}, err
+    }
+    diff, err := planLayoutChange(tx, hall, layout)
+    if err != nil {
+        return diff, err
+    }
+    if len(diff.Conflicts) > 0 && !force {
+        return diff, errLayoutConflict
+    }
+    if dryRun || diff.Empty() {
+        return diff, nil
+    }
+    cancelled, err := cancelLayoutConflicts(tx, actorID, hall, diff.Conflicts)
+    if err != nil {
+        return diff, err
+    }
+    diff.Cancelled = cancelled
+    return diff, applyLayoutChange(tx, actorID, hall, layout, diff)
+}
+
+func refundLayoutCancellations(db *gorm.DB, payments PaymentProvider, diff LayoutDiff) {
+    for _, bookingID := range diff.Cancelled {
+        // Failed refunds stay pending for runRefundSweeper.
+        _ = processRefund(db, payments, bookingID)
+    }
+}
+
+// cancelLayoutConflicts cancels the bookings holding seats that a forced
+// layout edit removes or takes out of sale. Renumbered seats keep their
+// bookings.
+func cancelLayoutConflicts(tx *gorm.DB, actorID uint, hall Hall, conflicts []LayoutConflict) ([]uint, error) {
+    seen := map[uint]bool{}
+    ids := make([]uint, 0)
+    for _, conflict := range conflicts {
+        if conflict.Change == "renumbered" || seen[conflict.BookingID] {
+            continue
+        }
+        seen[conflict.BookingID] = true
+        ids = append(ids, conflict.BookingID)
+    }
+    if len(ids) == 0 {
+        return nil, nil
+    }
+    var bookings []Booking
+    if err := tx.Where("id IN ?", ids).Find(&bookings).Error; err != nil {
+        return nil, err
+    }
+    const reason = "seat removed from the hall layout"
+    cancelled := make([]uint, 0, len(bookings))
+    for _, booking := range bookings {
+        err := cancelBookingTx(tx, booking.ID, booking.TotalPrice, reason, func(tx *gorm.DB) error {
+            return recordAudit(tx, actorID, "booking.cancel", "booking", booking.ID, reason, gin.H{
+                "refund_amount": booking.TotalPrice,
+                "hall_id":       hall.ID,
+            })
+        })
+        if errors.Is(err, errBookingNotActive) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        cancelled = append(cancelled, booking.ID)
+    }
+    return cancelled, nil
+}
+
+func respondLayoutChange(c *gin.Context, db *gorm.DB, hall Hall, diff LayoutDiff, err error, dryRun bool) {
+    if errors.Is(err, errLayoutConflict) {
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "diff": diff})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update layout"})
+        return
+    }
+    if err := db.First(&hall, hall.ID).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load hall"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"hall": hall, "diff": diff, "applied": !dryRun && !diff.Empty()})
+}
+
+func updateHallLayout(db *gorm.DB, payments PaymentProvider) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var hall Hall
+        if err := db.First(&hall, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "hall not found"})
+            return
+        }
+        var req LayoutUpdateRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        layout, err := req.Layout.normalize()
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        diff, err := changeHallLayout(db, payments, c.GetUint("user_id"), hall, layout, req.DryRun, req.Force)
+        respondLayoutChange(c, db, hall, diff, err, req.DryRun)
+    }
+}
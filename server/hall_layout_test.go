@@ -0,0 +1,86 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestHallLayoutNormalize(t *testing.T) {
+    wide := LayoutRow{Seats: maxLayoutCols + 1}
+    tooMany := make([]LayoutRow, maxLayoutRows+1)
+    for i := range tooMany {
+        tooMany[i] = LayoutRow{Seats: 1}
+    }
+
+    cases := []struct {
+        name    string
+        rows    []LayoutRow
+        want    []LayoutRow
+        wantErr string
+    }{
+        {"seats become cells", []LayoutRow{{Seats: 3}}, []LayoutRow{{Cells: "SSS"}}, ""},
+        {"offset and lower case", []LayoutRow{{Offset: 2, Cells: "ss_v"}}, []LayoutRow{{Cells: "..SS_V"}}, ""},
+        {"spaces are empty cells and trailing ones trimmed", []LayoutRow{{Cells: "S S  "}}, []LayoutRow{{Cells: "S.S"}}, ""},
+        {"labels are trimmed", []LayoutRow{{Label: " A ", Seats: 1}}, []LayoutRow{{Label: "A", Cells: "S"}}, ""},
+        {"distinct labels", []LayoutRow{{Label: "A", Seats: 1}, {Label: "B", Seats: 1}}, []LayoutRow{{Label: "A", Cells: "S"}, {Label: "B", Cells: "S"}}, ""},
+        {"aisle rows are not numbered", []LayoutRow{{Seats: 1}, {Cells: "___"}, {Label: "3", Seats: 1}}, []LayoutRow{{Cells: "S"}, {Cells: "___"}, {Label: "3", Cells: "S"}}, ""},
+        {"aisle row labels are not checked", []LayoutRow{{Label: "A", Seats: 1}, {Label: "A", Cells: "_"}}, []LayoutRow{{Label: "A", Cells: "S"}, {Label: "A", Cells: "_"}}, ""},
+        {"duplicate explicit labels", []LayoutRow{{Label: "A", Seats: 1}, {Label: "A", Seats: 1}}, nil, `row label "A" is used twice`},
+        {"duplicate after trimming", []LayoutRow{{Label: "A", Seats: 1}, {Label: " A", Seats: 1}}, nil, `row label "A" is used twice`},
+        {"explicit label clashes with a later number", []LayoutRow{{Label: "2", Seats: 1}, {Seats: 1}}, nil, `row label "2" is used twice`},
+        {"explicit label clashes with an earlier number", []LayoutRow{{Seats: 1}, {Label: "1", Seats: 1}}, nil, `row label "1" is used twice`},
+        {"no rows", nil, nil, "at least one row"},
+        {"too many rows", tooMany, nil, "more than"},
+        {"negative offset", []LayoutRow{{Offset: -1, Seats: 1}}, nil, "cannot be negative"},
+        {"negative seats", []LayoutRow{{Seats: -1}}, nil, "cannot be negative"},
+        {"cells and seats", []LayoutRow{{Seats: 2, Cells: "SS"}}, nil, "either cells or seats"},
+        {"unknown cell", []LayoutRow{{Cells: "SQS"}}, nil, "unknown cell"},
+        {"too wide", []LayoutRow{wide}, nil, "wider than"},
+        {"offset makes it too wide", []LayoutRow{{Offset: maxLayoutCols, Seats: 1}}, nil, "wider than"},
+        {"no seats", []LayoutRow{{Cells: "__"}}, nil, "no seats"},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            got, err := HallLayout{Rows: tc.rows}.normalize()
+            if tc.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+                    t.Fatalf("err = %v, want it to contain %q", err, tc.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if !reflect.DeepEqual(got.Rows, tc.want) {
+                t.Errorf("rows = %+v, want %+v", got.Rows, tc.want)
+            }
+        })
+    }
+}
+
+func TestHallLayoutSeats(t *testing.T) {
+    layout, err := HallLayout{Rows: []LayoutRow{
+        {Cells: "S_X"},
+        {Cells: "___"},
+        {Label: "VIP", Offset: 1, Cells: "VW"},
+    }}.normalize()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []Seat{
+        {HallID: 9, Row: 1, Number: 1, RowLabel: "1", GridRow: 0, GridCol: 0, Category: SeatStandard},
+        {HallID: 9, Row: 1, Number: 2, RowLabel: "1", GridRow: 0, GridCol: 2, Category: SeatStandard, Disabled: true},
+        {HallID: 9, Row: 2, Number: 1, RowLabel: "VIP", GridRow: 2, GridCol: 1, Category: SeatVIP},
+        {HallID: 9, Row: 2, Number: 2, RowLabel: "VIP", GridRow: 2, GridCol: 2, Category: SeatWheelchair},
+    }
+    if got := layout.seats(9); !reflect.DeepEqual(got, want) {
+        t.Errorf("seats = %+v\nwant %+v", got, want)
+    }
+    if got := layout.SeatRows(); got != 2 {
+        t.Errorf("seat rows = %d, want 2", got)
+    }
+    if got := layout.Width(); got != 3 {
+        t.Errorf("width = %d, want 3", got)
+    }
+}
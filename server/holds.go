@@ -0,0 +1,252 @@
+
+package main
+
+import (
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+)
+
+// heldSeatIDs returns seats of the session covered by unexpired holds.
+func heldSeatIDs(tx *gorm.DB, sessionID uint) ([]uint, error) {
+    held := make([]uint, 0)
+    if err := tx.Table("session_seats").
+        Select("session_seats.seat_id").
+        Joins("JOIN seat_holds ON seat_holds.id = session_seats.hold_id").
+        Where("session_seats.session_id = ? AND seat_holds.expires_at > ?", sessionID, time.Now()).
+        Find(&held).Error; err != nil {
+        return nil, err
+    }
+    return held, nil
+}
+
+func createHold(db *gorm.DB, ttl time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.GetUint("user_id")
+        id := c.Param("id")
+        var req HoldRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        if len(req.SeatIDs) == 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "seat_ids are required"})
+            return
+        }
+
+        var session Session
+        if err := db.First(&session, id).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+            return
+        }
+        if !session.StartTime.After(time.Now()) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "session already started"})
+            return
+        }
+        if err := bookableSession(session); err != nil {
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+            return
+        }
+
+        var seats []Seat
+        if err := db.Where("hall_id = ? AND id IN ? AND removed_at IS NULL AND disabled = ?", session.HallID, req.SeatIDs, false).Find(&seats).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to validate seats"})
+            return
+        }
+        if len(seats) != len(req.SeatIDs) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "some seats are invalid for this hall"})
+            return
+        }
+
+        var hold SeatHold
+        err := db.Transaction(func(tx *gorm.DB) error {
+            if err := lockBookableSession(tx, session.ID); err != nil {
+                return err
+            }
+            // A customer keeps a single hold per session: picking seats again
+            // replaces the previous selection instead of stacking holds.
+            if err := deleteHolds(tx, tx.Model(&SeatHold{}).Select("id").Where("user_id = ? AND session_id = ?", userID, session.ID)); err != nil {
+                return err
+            }
+
+            hold = SeatHold{
+                UserID:    userID,
+                SessionID: session.ID,
+                ExpiresAt: time.Now().Add(ttl),
+            }
+            if err := tx.Create(&hold).Error; err != nil {
+                return err
+            }
+            holdSeats := make([]SeatHoldSeat, 0, len(req.SeatIDs))
+            for _, seatID := range req.SeatIDs {
+                holdSeats = append(holdSeats, SeatHoldSeat{SeatHoldID: hold.ID, SeatID: seatID})
+            }
+            if err := tx.Create(&holdSeats).Error; err != nil {
+                return err
+            }
+            return claimSeats(tx, session.ID, req.SeatIDs, nil, &hold.ID)
+        })
+        if err != nil {
+            respondBookingConflict(c, err)
+            return
+        }
+
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").First(&hold, hold.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load hold"})
+            return
+        }
+        c.JSON(http.StatusCreated, hold)
+    }
+}
+
+func getHold(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.GetUint("user_id")
+        var hold SeatHold
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").
+            Where("id = ? AND user_id = ? AND expires_at > ?", c.Param("id"), userID, time.Now()).
+            First(&hold).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "hold not found"})
+            return
+        }
+        c.JSON(http.StatusOK, hold)
+    }
+}
+
+func confirmHold(db *gorm.DB, payments PaymentProvider, currency string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.GetUint("user_id")
+        var req ConfirmHoldRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        if strings.TrimSpace(req.PaymentMethod) == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "payment_method is required"})
+            return
+        }
+
+        var hold SeatHold
+        if err := db.Preload("Session").Preload("Seats").
+            Where("id = ? AND user_id = ?", c.Param("id"), userID).
+            First(&hold).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "hold not found"})
+            return
+        }
+        if !hold.ExpiresAt.After(time.Now()) {
+            c.JSON(http.StatusGone, gin.H{"error": "hold expired"})
+            return
+        }
+        if !hold.Session.StartTime.After(time.Now()) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "session already started"})
+            return
+        }
+        if err := bookableSession(hold.Session); err != nil {
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+            return
+        }
+
+        seatIDs := make([]uint, 0, len(hold.Seats))
+        held := make(map[uint]bool, len(hold.Seats))
+        for _, seat := range hold.Seats {
+            seatIDs = append(seatIDs, seat.ID)
+            held[seat.ID] = true
+        }
+        for _, t := range req.Tickets {
+            if !held[t.SeatID] {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "tickets must refer to held seats"})
+                return
+            }
+        }
+        _, tickets, err := ticketSelections(seatIDs, req.Tickets)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+
+        var booking Booking
+        err = db.Transaction(func(tx *gorm.DB) error {
+            var err error
+            booking, err = insertBooking(tx, userID, hold.Session, tickets, req.PaymentMethod, hold.ID)
+            if err != nil {
+                return err
+            }
+            return deleteHolds(tx, []uint{hold.ID})
+        })
+        if err != nil {
+            respondBookingConflict(c, err)
+            return
+        }
+        if _, err := startPayment(db, payments, currency, booking); err != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "failed to start payment"})
+            return
+        }
+
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").Preload("Payment").First(&booking, booking.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load booking"})
+            return
+        }
+        c.JSON(http.StatusCreated, booking)
+    }
+}
+
+func releaseHold(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.GetUint("user_id")
+        var hold SeatHold
+        if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&hold).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "hold not found"})
+            return
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            return deleteHolds(tx, []uint{hold.ID})
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to release hold"})
+            return
+        }
+        c.Status(http.StatusNoContent)
+    }
+}
+
+// deleteHolds removes holds together with their seat rows and any seat
+// reservations they still own. ids is either a slice of hold IDs or a
+// subquery selecting them.
+func deleteHolds(tx *gorm.DB, ids interface{}) error {
+    if err := tx.Where("hold_id IN (?)", ids).Delete(&SessionSeat{}).Error; err != nil {
+        return err
+    }
+    if err := tx.Where("seat_hold_id IN (?)", ids).Delete(&SeatHoldSeat{}).Error; err != nil {
+        return err
+    }
+    return tx.Where("id IN (?)", ids).Delete(&SeatHold{}).Error
+}
+
+// runHoldSweeper periodically releases expired holds so abandoned selections
+// do not linger in the tables.
+func runHoldSweeper(db *gorm.DB, logger *zap.Logger, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        var expired []uint
+        if err := db.Model(&SeatHold{}).Where("expires_at <= ?", time.Now()).Pluck("id", &expired).Error; err != nil {
+            logger.Warn("failed to load expired holds", zap.Error(err))
+            continue
+        }
+        if len(expired) == 0 {
+            continue
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            return deleteHolds(tx, expired)
+        })
+        if err != nil {
+            logger.Warn("failed to release expired holds", zap.Error(err))
+            continue
+        }
+        logger.Info("released expired holds", zap.Int("count", len(expired)))
+    }
+}
@@ -0,0 +1,166 @@
+
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "mime"
+    "net"
+    "net/smtp"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+type Mail struct {
+    To      string
+    Subject string
+    Text    string
+}
+
+// Mailer delivers transactional email. SMTPMailer talks to a real relay (or a
+// MailHog-style catcher on localhost); MemoryMailer and FileMailer keep the
+// messages around for tests and local development.
+type Mailer interface {
+    Send(ctx context.Context, msg Mail) error
+}
+
+func newMailer(cfg Config) (Mailer, error) {
+    switch cfg.MailDriver {
+    case "smtp":
+        if cfg.SMTPHost == "" {
+            return nil, fmt.Errorf("SMTP_HOST is required for the smtp mail driver")
+        }
+        return &SMTPMailer{Host: cfg.SMTPHost, Port: cfg.SMTPPort, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword, From: cfg.MailFrom}, nil
+    case "memory":
+        return &MemoryMailer{}, nil
+    case "", "file":
+        return &FileMailer{Dir: cfg.MailDir, From: cfg.MailFrom}, nil
+    default:
+        return nil, fmt.Errorf("unknown mail driver %q", cfg.MailDriver)
+    }
+}
+
+func formatMail(from string, msg Mail) []byte {
+    var b strings.Builder
+    b.WriteString("From: " + from + "\r\n")
+    b.WriteString("To: " + msg.To + "\r\n")
+    b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+    b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+    b.WriteString(strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+    return []byte(b.String())
+}
+
+type SMTPMailer struct {
+    Host     string
+    Port     string
+    Username string
+    Password string
+    From     string
+}
+
+// smtpTimeout bounds a delivery when the caller's context has no deadline.
+const smtpTimeout = 30 * time.Second
+
+// Send does what smtp.SendMail does, but dials through ctx and gives up at
+// its deadline, so a stalled relay cannot hang the caller.
+func (m *SMTPMailer) Send(ctx context.Context, msg Mail) error {
+    port := m.Port
+    if port == "" {
+        port = "587"
+    }
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        deadline = time.Now().Add(smtpTimeout)
+    }
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.Host, port))
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    if err := conn.SetDeadline(deadline); err != nil {
+        return err
+    }
+    // Cancelling ctx aborts a conversation already in progress.
+    stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+    defer stop()
+
+    client, err := smtp.NewClient(conn, m.Host)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    if ok, _ := client.Extension("STARTTLS"); ok {
+        if err := client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+            return err
+        }
+    }
+    if m.Username != "" {
+        if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+            return err
+        }
+    }
+    if err := client.Mail(m.From); err != nil {
+        return err
+    }
+    if err := client.Rcpt(msg.To); err != nil {
+        return err
+    }
+    w, err := client.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(formatMail(m.From, msg)); err != nil {
+        return err
+    }
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return client.Quit()
+}
+
+type MemoryMailer struct {
+    mu       sync.Mutex
+    messages []Mail
+}
+
+func (m *MemoryMailer) Send(_ context.Context, msg Mail) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.messages = append(m.messages, msg)
+    return nil
+}
+
+// Messages returns a copy of everything sent so far.
+func (m *MemoryMailer) Messages() []Mail {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return append([]Mail(nil), m.messages...)
+}
+
+// FileMailer writes every message as an .eml file, which is handy in local
+// development where no SMTP server is running.
+type FileMailer struct {
+    Dir  string
+    From string
+}
+
+func (m *FileMailer) Send(_ context.Context, msg Mail) error {
+    // Deliberately outside ./uploads, which is served publicly.
+    dir := m.Dir
+    if dir == "" {
+        dir = "mail"
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(msg.To))
+    return os.WriteFile(filepath.Join(dir, name), formatMail(m.From, msg), 0644)
+}
@@ -2,7 +2,6 @@
 package main
 
 import (
-    "bytes"
     "errors"
     "fmt"
     "net/http"
@@ -11,11 +10,11 @@ import (
     "strconv"
     "strings"
     "time"
+    _ "time/tzdata"
 
     "github.com/gin-contrib/cors"
     "github.com/gin-gonic/gin"
     "github.com/golang-jwt/jwt/v5"
-    "github.com/jung-kurt/gofpdf"
     "github.com/joho/godotenv"
     "github.com/skip2/go-qrcode"
     "go.uber.org/zap"
@@ -23,6 +22,8 @@ import (
     "gorm.io/driver/postgres"
     "gorm.io/gorm"
     "gorm.io/gorm/clause"
+
+    "kinoform/scheduling"
 )
 
 type Config struct {
@@ -34,16 +35,63 @@ type Config struct {
     AdminEmail    string
     AdminPassword string
     AdminName     string
+    HoldTTL       time.Duration
+    PaymentProvider      string
+    PaymentWebhookSecret []byte
+    PaymentMockGateway   bool
+    PaymentWebhookURL    string
+    PaymentCurrency      string
+    PaymentTimeout       time.Duration
+    CancellationPolicy   CancellationPolicy
+    TicketKey            []byte
+    AccessTokenTTL       time.Duration
+    RefreshTokenTTL      time.Duration
+    AppURL               string
+    MailDriver           string
+    MailFrom             string
+    MailDir              string
+    SMTPHost             string
+    SMTPPort             string
+    SMTPUsername         string
+    SMTPPassword         string
+    PublicURL            string
+    VerificationKey      []byte
+    RequireEmailVerification bool
+    RateLimitBackend     string
+    LoginMaxAttempts     int
+    LoginLockout         time.Duration
+    TwoFactorKey         []byte
+    TOTPIssuer           string
+    TemplateHorizon      time.Duration
+    Location             *time.Location
+    GuestAccessKey       []byte
+    PosterHosts          []string
+    TrustedProxies       []string
 }
 
 type User struct {
-    ID           uint      `gorm:"primaryKey" json:"id"`
-    Name         string    `json:"name"`
-    Email        string    `gorm:"uniqueIndex" json:"email"`
-    PasswordHash string    `json:"-"`
-    IsAdmin      bool      `json:"is_admin"`
-    AvatarURL    string    `json:"avatar_url"`
-    CreatedAt    time.Time `json:"created_at"`
+    ID              uint       `gorm:"primaryKey" json:"id"`
+    Name            string     `json:"name"`
+    Email           string     `gorm:"uniqueIndex" json:"email"`
+    PasswordHash    string     `json:"-"`
+    IsAdmin         bool       `json:"is_admin"`
+    AvatarURL       string     `json:"avatar_url"`
+    TokenVersion    int        `gorm:"not null;default:0" json:"-"`
+    EmailVerifiedAt *time.Time `json:"email_verified_at"`
+    // EmailConfirmedAt is only set by following a verification link, unlike
+    // EmailVerifiedAt, which the backfill granted to older accounts.
+    EmailConfirmedAt   *time.Time `json:"email_confirmed_at"`
+    VerificationSentAt *time.Time `json:"-"`
+    DisabledAt         *time.Time `json:"disabled_at"`
+    FailedLogins       int        `gorm:"not null;default:0" json:"-"`
+    LastFailedLoginAt  *time.Time `json:"-"`
+    LockedUntil        *time.Time `json:"locked_until,omitempty"`
+    TwoFactorEnabled   bool       `gorm:"not null;default:false" json:"two_factor_enabled"`
+    TOTPSecret         string     `gorm:"column:totp_secret" json:"-"`
+    TOTPPendingSecret  string     `gorm:"column:totp_pending_secret" json:"-"`
+    TOTPLastStep       int64      `gorm:"column:totp_last_step;not null;default:0" json:"-"`
+    Permissions        []string   `gorm:"-" json:"permissions,omitempty"`
+    CreatedAt          time.Time  `json:"created_at"`
 }
 
 type Movie struct {
@@ -71,41 +119,94 @@ type Hall struct {
     Name      string    `json:"name"`
     Rows      int       `json:"rows"`
     Cols      int       `json:"cols"`
+    Layout    string    `gorm:"type:text" json:"-"`
+    CleaningMinutes int `gorm:"not null;default:20" json:"cleaning_minutes"`
+    Supports3D   bool   `gorm:"not null;default:false" json:"supports_3d"`
+    SupportsIMAX bool   `gorm:"not null;default:false" json:"supports_imax"`
+    Supports4DX  bool   `gorm:"not null;default:false" json:"supports_4dx"`
     CreatedAt time.Time `json:"created_at"`
 }
 
 type Seat struct {
-    ID     uint `gorm:"primaryKey" json:"id"`
-    HallID uint `json:"hall_id"`
-    Row    int  `json:"row"`
-    Number int  `json:"number"`
+    ID        uint       `gorm:"primaryKey" json:"id"`
+    HallID    uint       `json:"hall_id"`
+    Row       int        `json:"row"`
+    Number    int        `json:"number"`
+    Category  string     `gorm:"not null;default:standard" json:"category"`
+    RowLabel  string     `json:"row_label"`
+    GridRow   int        `gorm:"not null;default:-1" json:"grid_row"`
+    GridCol   int        `gorm:"not null;default:-1" json:"grid_col"`
+    Disabled  bool       `gorm:"not null;default:false" json:"disabled"`
+    RemovedAt *time.Time `gorm:"index" json:"removed_at,omitempty"`
 }
 
 type Session struct {
-    ID        uint      `gorm:"primaryKey" json:"id"`
-    MovieID   uint      `json:"movie_id"`
-    HallID    uint      `json:"hall_id"`
-    StartTime time.Time `json:"start_time"`
-    BasePrice int       `json:"base_price"`
-    Movie     Movie     `json:"movie"`
-    Hall      Hall      `json:"hall"`
+    ID               uint       `gorm:"primaryKey" json:"id"`
+    MovieID          uint       `json:"movie_id"`
+    HallID           uint       `json:"hall_id"`
+    StartTime        time.Time  `json:"start_time"`
+    BasePrice        int        `json:"base_price"`
+    TemplateID       *uint      `gorm:"index" json:"template_id,omitempty"`
+    SeatsTotal       *int       `gorm:"->;-:migration" json:"seats_total,omitempty"`
+    SeatsAvailable   *int       `gorm:"->;-:migration" json:"seats_available,omitempty"`
+    Status           string     `gorm:"size:20;not null;default:scheduled;index" json:"status"`
+    Format           string     `gorm:"size:10;not null;default:2D;index" json:"format"`
+    AudioLanguage    string     `gorm:"size:8" json:"audio_language"`
+    SubtitleLanguage string     `gorm:"size:8" json:"subtitle_language,omitempty"`
+    CancelledAt      *time.Time `json:"cancelled_at,omitempty"`
+    CancelReason     string     `json:"cancel_reason,omitempty"`
+    Movie            Movie      `json:"movie"`
+    Hall             Hall       `json:"hall"`
 }
 
 type Booking struct {
-    ID         uint      `gorm:"primaryKey" json:"id"`
-    UserID     uint      `json:"user_id"`
-    SessionID  uint      `json:"session_id"`
-    Status     string    `json:"status"`
-    TotalPrice int       `json:"total_price"`
-    PaymentMethod string `json:"payment_method"`
-    CreatedAt  time.Time `json:"created_at"`
-    Session    Session   `json:"session"`
-    Seats      []Seat    `gorm:"many2many:booking_seats" json:"seats"`
+    ID                uint           `gorm:"primaryKey" json:"id"`
+    UserID            uint           `json:"user_id"`
+    GuestID           *uint          `gorm:"index" json:"guest_id,omitempty"`
+    SoldBy            *uint          `gorm:"index" json:"sold_by,omitempty"`
+    SessionID         uint           `json:"session_id"`
+    Status            string         `json:"status"`
+    TotalPrice        int            `json:"total_price"`
+    PaymentMethod     string         `json:"payment_method"`
+    RefundAmount      int            `json:"refund_amount"`
+    RefundStatus      string         `gorm:"size:20;not null;default:'';index" json:"refund_status,omitempty"`
+    RefundError       string         `json:"-"`
+    RefundAttempts    int            `gorm:"not null;default:0" json:"-"`
+    RefundAttemptedAt *time.Time     `json:"-"`
+    CancelReason      string         `json:"cancel_reason,omitempty"`
+    CancelledAt       *time.Time     `json:"cancelled_at,omitempty"`
+    CreatedAt         time.Time      `json:"created_at"`
+    Session           Session        `json:"session"`
+    Seats             []Seat         `gorm:"many2many:booking_seats" json:"seats"`
+    Payment           *Payment       `gorm:"foreignKey:BookingID" json:"payment,omitempty"`
+    Guest             *GuestCustomer `json:"guest,omitempty"`
+    Items             []BookingSeat  `gorm:"foreignKey:BookingID" json:"items,omitempty"`
 }
 
+// BookingSeat is the join row between a booking and its seats; it also keeps
+// the ticket type and the price each seat was sold at.
 type BookingSeat struct {
-    BookingID uint `gorm:"primaryKey"`
-    SeatID    uint `gorm:"primaryKey"`
+    BookingID    uint        `gorm:"primaryKey" json:"booking_id"`
+    SeatID       uint        `gorm:"primaryKey" json:"seat_id"`
+    TicketTypeID *uint       `json:"ticket_type_id"`
+    TicketType   *TicketType `json:"ticket_type,omitempty"`
+    SeatCategory string      `json:"seat_category,omitempty"`
+    Price        int         `gorm:"not null;default:0" json:"price"`
+}
+
+type SeatHold struct {
+    ID        uint      `gorm:"primaryKey" json:"id"`
+    UserID    uint      `gorm:"index" json:"user_id"`
+    SessionID uint      `gorm:"index" json:"session_id"`
+    ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+    CreatedAt time.Time `json:"created_at"`
+    Session   Session   `json:"session"`
+    Seats     []Seat    `gorm:"many2many:seat_hold_seats" json:"seats"`
+}
+
+type SeatHoldSeat struct {
+    SeatHoldID uint `gorm:"primaryKey"`
+    SeatID     uint `gorm:"primaryKey"`
 }
 
 type RegisterRequest struct {
@@ -132,10 +233,23 @@ type BookingRequest struct {
     SessionID uint   `json:"session_id"`
     SeatIDs   []uint `json:"seat_ids"`
     PaymentMethod string `json:"payment_method"`
+    Tickets   []TicketSelection `json:"tickets"`
+}
+
+type HoldRequest struct {
+    SeatIDs []uint `json:"seat_ids"`
+}
+
+type ConfirmHoldRequest struct {
+    PaymentMethod string `json:"payment_method"`
+    Tickets       []TicketSelection `json:"tickets"`
 }
 
 type BookingStatusRequest struct {
-    Status string `json:"status"`
+    Status        string `json:"status"`
+    Reason        string `json:"reason"`
+    RefundAmount  *int   `json:"refund_amount"`
+    RefundPercent *int   `json:"refund_percent"`
 }
 
 type MovieRequest struct {
@@ -160,6 +274,11 @@ type HallRequest struct {
     Name string `json:"name"`
     Rows int    `json:"rows"`
     Cols int    `json:"cols"`
+    Layout *HallLayout `json:"layout"`
+    CleaningMinutes *int `json:"cleaning_minutes"`
+    Supports3D   *bool `json:"supports_3d"`
+    SupportsIMAX *bool `json:"supports_imax"`
+    Supports4DX  *bool `json:"supports_4dx"`
 }
 
 type SessionRequest struct {
@@ -167,10 +286,14 @@ type SessionRequest struct {
     HallID    uint   `json:"hall_id"`
     StartTime string `json:"start_time"`
     BasePrice int    `json:"base_price"`
+    Format           string  `json:"format"`
+    AudioLanguage    *string `json:"audio_language"`
+    SubtitleLanguage *string `json:"subtitle_language"`
 }
 
 type Claims struct {
-    UserID uint `json:"user_id"`
+    UserID       uint `json:"user_id"`
+    TokenVersion int  `json:"ver"`
     jwt.RegisteredClaims
 }
 
@@ -187,29 +310,106 @@ func main() {
     if cfg.JwtSecret == "" {
         logger.Fatal("JWT_SECRET is required")
     }
+    policy, err := parseCancellationPolicy(os.Getenv("CANCELLATION_POLICY"))
+    if err != nil {
+        logger.Fatal("invalid CANCELLATION_POLICY", zap.Error(err))
+    }
+    cfg.CancellationPolicy = policy
+    location, err := loadCinemaLocation(os.Getenv("CINEMA_TIMEZONE"))
+    if err != nil {
+        logger.Fatal("invalid CINEMA_TIMEZONE", zap.Error(err))
+    }
+    cfg.Location = location
 
     db, err := gorm.Open(postgres.Open(cfg.DatabaseURL), &gorm.Config{})
     if err != nil {
         logger.Fatal("failed to connect to database", zap.Error(err))
     }
 
-    if err := db.AutoMigrate(&User{}, &Movie{}, &Hall{}, &Seat{}, &Session{}, &Booking{}, &BookingSeat{}); err != nil {
+    if err := migrate(db); err != nil {
         logger.Fatal("failed to migrate database", zap.Error(err))
     }
+    if err := backfillSessionSeats(db); err != nil {
+        logger.Fatal("failed to backfill seat reservations", zap.Error(err))
+    }
+    if err := backfillSeatGrid(db); err != nil {
+        logger.Fatal("failed to backfill seat grid", zap.Error(err))
+    }
+    if err := backfillEmailVerified(db); err != nil {
+        logger.Fatal("failed to backfill email verification", zap.Error(err))
+    }
+
+    if err := seedRoles(db); err != nil {
+        logger.Fatal("failed to seed roles", zap.Error(err))
+    }
+    if err := backfillAdminRoles(db); err != nil {
+        logger.Fatal("failed to migrate admin flags to roles", zap.Error(err))
+    }
+    if err := revokeUnenrolledStaffTokens(db); err != nil {
+        logger.Fatal("failed to revoke sessions of staff without 2FA", zap.Error(err))
+    }
+    if err := seedTicketTypes(db); err != nil {
+        logger.Fatal("failed to seed ticket types", zap.Error(err))
+    }
+    if err := backfillBookingSeatTypes(db); err != nil {
+        logger.Fatal("failed to backfill booking ticket types", zap.Error(err))
+    }
+    if err := backfillBoxOfficeSellers(db); err != nil {
+        logger.Fatal("failed to backfill box-office sellers", zap.Error(err))
+    }
+    if err := seedSeatCategories(db); err != nil {
+        logger.Fatal("failed to seed seat categories", zap.Error(err))
+    }
+    if err := seedSessionFormats(db); err != nil {
+        logger.Fatal("failed to seed session formats", zap.Error(err))
+    }
 
     if err := seedAdmin(db, cfg); err != nil {
         logger.Fatal("failed to seed admin", zap.Error(err))
     }
 
     if cfg.Seed {
-        if err := seedData(db); err != nil {
+        if err := seedData(db, cfg.Location); err != nil {
             logger.Fatal("failed to seed data", zap.Error(err))
         }
     }
 
+    payments, err := newPaymentProvider(cfg)
+    if err != nil {
+        logger.Fatal("failed to configure payments", zap.Error(err))
+    }
+
+    mailer, err := newMailer(cfg)
+    if err != nil {
+        logger.Fatal("failed to configure mail", zap.Error(err))
+    }
+
+    limiter, err := newRateLimiter(cfg.RateLimitBackend, db)
+    if err != nil {
+        logger.Fatal("failed to configure rate limiting", zap.Error(err))
+    }
+
+    posters := newPosterCache(cfg.PosterHosts)
+
+    go runHoldSweeper(db, logger, time.Minute)
+    go runPaymentSweeper(db, payments, logger, cfg.PaymentTimeout, time.Minute)
+    go runRefundSweeper(db, payments, logger, time.Minute)
+    cancellations := newSessionCancelWorker(db, payments, mailer, cfg.AppURL, cfg.Location, logger)
+    go cancellations.run(time.Minute)
+    go runTokenSweeper(db, logger, time.Hour)
+    go runTemplateMaterializer(db, logger, cfg.Location, cfg.TemplateHorizon, time.Hour)
+    if cfg.RateLimitBackend == "postgres" {
+        go runRateLimitSweeper(db, logger, time.Hour)
+    }
+
     gin.SetMode(gin.ReleaseMode)
     router := gin.New()
     router.MaxMultipartMemory = 20 << 20
+    // ClientIP keys the per-IP rate limits, so X-Forwarded-For is only
+    // honoured from the proxies listed in TRUSTED_PROXIES.
+    if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+        logger.Fatal("invalid TRUSTED_PROXIES", zap.Error(err))
+    }
     router.Use(gin.Recovery())
     router.Use(ginLogger(logger))
     allowOrigins := parseOrigins(cfg.CorsOrigin)
@@ -228,46 +428,130 @@ func main() {
 
     api := router.Group("/api")
     {
-        api.POST("/auth/register", registerHandler(db, cfg.JwtSecret))
-        api.POST("/auth/login", loginHandler(db, cfg.JwtSecret))
-        api.GET("/me", authMiddleware(cfg.JwtSecret), meHandler(db))
-        api.PATCH("/me", authMiddleware(cfg.JwtSecret), updateMeHandler(db))
-        api.PATCH("/me/password", authMiddleware(cfg.JwtSecret), changePasswordHandler(db))
-        api.POST("/me/avatar", authMiddleware(cfg.JwtSecret), uploadAvatarHandler(db))
+        api.POST("/auth/register", rateLimitByIP(limiter, logger, "register", 10, time.Hour), registerHandler(db, cfg, mailer, limiter, logger))
+        api.POST("/auth/login", rateLimitByIP(limiter, logger, "login", 30, 15*time.Minute), loginHandler(db, cfg, limiter, logger))
+        api.POST("/auth/2fa/verify", twoFactorVerifyHandler(db, cfg, limiter, logger))
+        api.POST("/auth/2fa/setup", twoFactorSetupHandler(db, cfg))
+        api.POST("/auth/2fa/setup/confirm", twoFactorSetupConfirmHandler(db, cfg))
+        api.POST("/auth/refresh", refreshHandler(db, cfg))
+        api.POST("/auth/logout", authMiddleware(db, cfg.JwtSecret), logoutHandler(db))
+        api.POST("/auth/forgot-password", rateLimitByIP(limiter, logger, "forgot-password", 10, time.Hour), forgotPasswordHandler(db, mailer, cfg.AppURL, limiter, logger))
+        api.POST("/auth/reset-password", resetPasswordHandler(db))
+        api.GET("/auth/verify", verifyEmailHandler(db, cfg))
+        api.POST("/auth/verify/resend", authMiddleware(db, cfg.JwtSecret), resendVerificationHandler(db, mailer, cfg, logger))
+        api.GET("/me", authMiddleware(db, cfg.JwtSecret), meHandler(db))
+        api.PATCH("/me", authMiddleware(db, cfg.JwtSecret), updateMeHandler(db))
+        api.PATCH("/me/password", authMiddleware(db, cfg.JwtSecret), changePasswordHandler(db, cfg))
+        api.POST("/me/avatar", authMiddleware(db, cfg.JwtSecret), uploadAvatarHandler(db))
+        api.POST("/me/2fa/enroll", authMiddleware(db, cfg.JwtSecret), enrollTwoFactorHandler(db, cfg))
+        api.POST("/me/2fa/confirm", authMiddleware(db, cfg.JwtSecret), confirmTwoFactorHandler(db))
+        api.POST("/me/2fa/disable", authMiddleware(db, cfg.JwtSecret), disableTwoFactorHandler(db))
+        api.POST("/me/2fa/recovery-codes", authMiddleware(db, cfg.JwtSecret), regenerateRecoveryCodesHandler(db))
 
         api.GET("/movies", listMovies(db))
         api.GET("/movies/:id", getMovie(db))
 
-        api.GET("/sessions", listSessions(db))
+        api.GET("/sessions", listSessions(db, cfg.Location))
+        api.GET("/showtimes", listShowtimes(db, cfg.Location))
         api.GET("/sessions/:id", getSession(db))
         api.GET("/sessions/:id/availability", sessionAvailability(db))
+        api.POST("/sessions/:id/holds", authMiddleware(db, cfg.JwtSecret), requireVerifiedEmail(db, cfg.RequireEmailVerification), createHold(db, cfg.HoldTTL))
+
+        api.GET("/ticket-types", listTicketTypes(db))
+        api.GET("/seat-categories", listSeatCategories(db))
+        api.GET("/session-formats", listSessionFormats(db))
 
         api.GET("/halls", listHalls(db))
         api.GET("/halls/:id/seats", listSeats(db))
+        api.GET("/halls/:id/layout", getHallLayout(db))
 
-        api.POST("/bookings", authMiddleware(cfg.JwtSecret), createBooking(db))
-        api.GET("/bookings/mine", authMiddleware(cfg.JwtSecret), listMyBookings(db))
-        api.PATCH("/bookings/:id/cancel", authMiddleware(cfg.JwtSecret), cancelBooking(db))
-        api.GET("/bookings/:id/qr", authMiddleware(cfg.JwtSecret), bookingQR(db))
-        api.GET("/bookings/:id/ticket", authMiddleware(cfg.JwtSecret), bookingTicket(db))
-    }
+        api.POST("/bookings", authMiddleware(db, cfg.JwtSecret), requireVerifiedEmail(db, cfg.RequireEmailVerification), createBooking(db, payments, cfg.PaymentCurrency))
+        api.GET("/bookings/mine", authMiddleware(db, cfg.JwtSecret), listMyBookings(db))
+        api.PATCH("/bookings/:id/cancel", authMiddleware(db, cfg.JwtSecret), cancelBooking(db, payments, cfg.CancellationPolicy))
+        api.GET("/bookings/:id/qr", authMiddleware(db, cfg.JwtSecret), bookingQR(db, cfg.TicketKey, loadBookingForUser))
+        api.GET("/bookings/:id/ticket", authMiddleware(db, cfg.JwtSecret), bookingTicket(db, cfg.TicketKey, cfg.PaymentCurrency, cfg.Location, posters, loadBookingForUser))
+        api.POST("/guest/bookings", rateLimitByIP(limiter, logger, "guest-booking", 20, time.Hour), createGuestBooking(db, payments, mailer, cfg, logger))
+        api.GET("/guest/bookings/:id", getGuestBooking(db, cfg.GuestAccessKey))
+        api.GET("/guest/bookings/:id/qr", bookingQR(db, cfg.TicketKey, guestBookingLoader(cfg.GuestAccessKey)))
+        api.GET("/guest/bookings/:id/ticket", bookingTicket(db, cfg.TicketKey, cfg.PaymentCurrency, cfg.Location, posters, guestBookingLoader(cfg.GuestAccessKey)))
+        api.PATCH("/guest/bookings/:id/cancel", guestCancelBooking(db, payments, cfg.GuestAccessKey, cfg.CancellationPolicy))
+        api.POST("/me/guest-bookings/claim", authMiddleware(db, cfg.JwtSecret), claimGuestBookingsHandler(db))
+        api.GET("/me/transfer-offers", authMiddleware(db, cfg.JwtSecret), listMyTransferOffers(db))
+        api.POST("/me/transfer-offers/:id/accept", authMiddleware(db, cfg.JwtSecret), requireVerifiedEmail(db, cfg.RequireEmailVerification), acceptTransferOffer(db, payments, cfg.PaymentCurrency))
+        api.POST("/checkin", authMiddleware(db, cfg.JwtSecret), requirePermission(db, PermCheckin), checkinHandler(db, cfg.TicketKey, cfg.Location))
 
-    admin := router.Group("/api/admin")
-    admin.Use(authMiddleware(cfg.JwtSecret), adminMiddleware(db))
-    {
-        admin.POST("/movies", createMovie(db))
-        admin.PUT("/movies/:id", updateMovie(db))
-        admin.DELETE("/movies/:id", deleteMovie(db))
+        api.GET("/holds/:id", authMiddleware(db, cfg.JwtSecret), getHold(db))
+        api.POST("/holds/:id/confirm", authMiddleware(db, cfg.JwtSecret), requireVerifiedEmail(db, cfg.RequireEmailVerification), confirmHold(db, payments, cfg.PaymentCurrency))
+        api.DELETE("/holds/:id", authMiddleware(db, cfg.JwtSecret), releaseHold(db))
 
-        admin.POST("/halls", createHall(db))
-        admin.PUT("/halls/:id", updateHall(db))
-        admin.DELETE("/halls/:id", deleteHall(db))
+        api.POST("/payments/webhook", paymentWebhook(db, payments, logger))
+    }
 
-        admin.POST("/sessions", createSession(db))
-        admin.PUT("/sessions/:id", updateSession(db))
-        admin.DELETE("/sessions/:id", deleteSession(db))
+    // The stand-in checkout lets anyone settle any intent, so it is only
+    // mounted for local development.
+    if mock, ok := payments.(*MockPaymentProvider); ok && cfg.PaymentMockGateway {
+        router.GET("/mock-gateway/intents/:id", mockGatewayIntent(mock))
+        router.POST("/mock-gateway/intents/:id/:outcome", mockGatewaySettle(mock))
+    }
 
-        admin.PATCH("/bookings/:id/status", updateBookingStatus(db))
+    admin := router.Group("/api/admin")
+    admin.Use(authMiddleware(db, cfg.JwtSecret))
+    {
+        movies := requirePermission(db, PermMoviesManage)
+        admin.POST("/movies", movies, createMovie(db))
+        admin.PUT("/movies/:id", movies, updateMovie(db))
+        admin.DELETE("/movies/:id", movies, deleteMovie(db))
+
+        halls := requirePermission(db, PermHallsManage)
+        admin.POST("/halls", halls, createHall(db))
+        admin.PUT("/halls/:id", halls, updateHall(db, payments))
+        admin.DELETE("/halls/:id", halls, deleteHall(db))
+        admin.POST("/halls/:id/seat-categories", halls, assignSeatCategory(db))
+        admin.PUT("/halls/:id/layout", halls, updateHallLayout(db, payments))
+
+        sessions := requirePermission(db, PermSessionsManage)
+        admin.POST("/sessions", sessions, createSession(db))
+        admin.PUT("/sessions/:id", sessions, updateSession(db, cfg.Location))
+        admin.DELETE("/sessions/:id", sessions, deleteSession(db, cfg.Location))
+        admin.POST("/sessions/:id/cancel", sessions, cancelSession(db, cancellations))
+        admin.GET("/sessions/:id/cancellation", sessions, getSessionCancellation(db))
+        admin.POST("/schedule/generate", sessions, generateSchedule(db, cfg.Location))
+        admin.GET("/session-templates", sessions, listSessionTemplates(db))
+        admin.POST("/session-templates", sessions, createSessionTemplate(db, cfg.Location, cfg.TemplateHorizon))
+        admin.POST("/session-templates/materialize", sessions, materializeTemplatesHandler(db, cfg.Location, cfg.TemplateHorizon))
+        admin.PUT("/session-templates/:id", sessions, updateSessionTemplate(db, cfg.Location, cfg.TemplateHorizon))
+        admin.DELETE("/session-templates/:id", sessions, cancelSessionTemplate(db))
+        admin.POST("/session-templates/:id/exceptions", sessions, addTemplateException(db, cfg.Location))
+        admin.DELETE("/session-templates/:id/exceptions/:date", sessions, removeTemplateException(db, cfg.Location, cfg.TemplateHorizon))
+
+        pricing := requirePermission(db, PermPricingManage)
+        admin.GET("/ticket-types", pricing, listTicketTypes(db))
+        admin.POST("/ticket-types", pricing, createTicketType(db))
+        admin.PUT("/ticket-types/:id", pricing, updateTicketType(db))
+        admin.PUT("/seat-categories/:code", pricing, updateSeatCategory(db))
+        admin.PUT("/session-formats/:code", pricing, updateSessionFormat(db))
+
+        admin.PATCH("/bookings/:id/status", requirePermission(db, PermBookingsManage), updateBookingStatus(db, payments, cfg.CancellationPolicy))
+        admin.POST("/box-office/bookings", requirePermission(db, PermBookingsSell), sellAtBoxOffice(db, cfg.PaymentCurrency))
+
+        roles := requirePermission(db, PermRolesManage)
+        admin.GET("/permissions", roles, listPermissions())
+        admin.GET("/roles", roles, listRoles(db))
+        admin.POST("/roles", roles, createRole(db))
+        admin.PUT("/roles/:id", roles, updateRole(db))
+        admin.GET("/users/:id/roles", roles, listUserRoles(db))
+        admin.POST("/users/:id/roles", roles, assignUserRole(db))
+        admin.DELETE("/users/:id/roles/:role_id", roles, revokeUserRole(db))
+
+        users := requirePermission(db, PermUsersManage)
+        admin.GET("/users", users, listUsers(db))
+        admin.GET("/users/:id", users, getUserDetail(db))
+        admin.POST("/users/:id/disable", users, setUserDisabled(db, true))
+        admin.POST("/users/:id/enable", users, setUserDisabled(db, false))
+        admin.POST("/users/:id/reset-password", users, adminResetPassword(db, mailer, cfg.AppURL, logger))
+        admin.PUT("/users/:id/admin", users, setUserAdmin(db))
+        admin.POST("/users/:id/2fa/reset", users, adminResetTwoFactor(db))
+        admin.GET("/audit", users, listAuditLogs(db))
     }
 
     port := cfg.Port
@@ -283,8 +567,104 @@ func main() {
     }
 }
 
+// migrate brings the schema up to date. It is shared by main and the
+// Postgres-backed tests.
+func migrate(db *gorm.DB) error {
+    if err := db.SetupJoinTable(&Booking{}, "Seats", &BookingSeat{}); err != nil {
+        return err
+    }
+    if err := db.AutoMigrate(&User{}, &Movie{}, &Hall{}, &Seat{}, &Session{}, &Booking{}, &BookingSeat{}, &SeatHold{}, &SeatHoldSeat{}, &SessionSeat{}, &Payment{}, &AuditLog{}, &Admission{}, &RefreshToken{}, &RevokedToken{}, &PasswordResetToken{}, &Role{}, &RolePermission{}, &UserRole{}, &RateLimitBucket{}, &RecoveryCode{}, &GuestCustomer{}, &TicketType{}, &SeatCategory{}, &SessionTemplate{}, &SessionTemplateException{}, &SessionTransferOffer{}, &SessionFormat{}, &Backfill{}, &SessionCancellation{}, &SessionCancellationNotice{}); err != nil {
+        return err
+    }
+    // Exceptions used to be unique per date; they are now unique per slot.
+    if db.Migrator().HasIndex(&SessionTemplateException{}, "idx_template_exception_date") {
+        return db.Migrator().DropIndex(&SessionTemplateException{}, "idx_template_exception_date")
+    }
+    return nil
+}
+
 func loadConfig() Config {
     seed := strings.ToLower(os.Getenv("SEED"))
+    port := os.Getenv("PORT")
+    if port == "" {
+        port = "8080"
+    }
+    webhookSecret := []byte(os.Getenv("PAYMENT_WEBHOOK_SECRET"))
+    if len(webhookSecret) == 0 {
+        webhookSecret = deriveKey(os.Getenv("JWT_SECRET"), "payment-webhook")
+    }
+    mockGateway := strings.ToLower(os.Getenv("PAYMENT_MOCK_GATEWAY"))
+    webhookURL := os.Getenv("PAYMENT_WEBHOOK_URL")
+    if webhookURL == "" {
+        webhookURL = "http://127.0.0.1:" + port + "/api/payments/webhook"
+    }
+    currency := strings.ToUpper(strings.TrimSpace(os.Getenv("PAYMENT_CURRENCY")))
+    if currency == "" {
+        currency = "KZT"
+    }
+    paymentTimeout := 15 * time.Minute
+    if raw := strings.TrimSpace(os.Getenv("PAYMENT_TIMEOUT_MINUTES")); raw != "" {
+        if mins, err := strconv.Atoi(raw); err == nil && mins > 0 {
+            paymentTimeout = time.Duration(mins) * time.Minute
+        }
+    }
+    ticketKey := []byte(os.Getenv("TICKET_SIGNING_KEY"))
+    if len(ticketKey) == 0 {
+        ticketKey = deriveKey(os.Getenv("JWT_SECRET"), "ticket-qr")
+    }
+    accessTTL := 15 * time.Minute
+    if raw := strings.TrimSpace(os.Getenv("ACCESS_TOKEN_TTL_MINUTES")); raw != "" {
+        if mins, err := strconv.Atoi(raw); err == nil && mins > 0 {
+            accessTTL = time.Duration(mins) * time.Minute
+        }
+    }
+    refreshTTL := 30 * 24 * time.Hour
+    if raw := strings.TrimSpace(os.Getenv("REFRESH_TOKEN_TTL_DAYS")); raw != "" {
+        if days, err := strconv.Atoi(raw); err == nil && days > 0 {
+            refreshTTL = time.Duration(days) * 24 * time.Hour
+        }
+    }
+    appURL := strings.TrimSpace(os.Getenv("APP_URL"))
+    if appURL == "" {
+        appURL = "http://localhost:5173"
+    }
+    mailFrom := strings.TrimSpace(os.Getenv("MAIL_FROM"))
+    if mailFrom == "" {
+        mailFrom = "Kinoform <no-reply@kinoform.local>"
+    }
+    publicURL := strings.TrimSpace(os.Getenv("PUBLIC_URL"))
+    if publicURL == "" {
+        publicURL = "http://localhost:" + port
+    }
+    requireVerification := strings.ToLower(os.Getenv("REQUIRE_EMAIL_VERIFICATION"))
+    totpIssuer := strings.TrimSpace(os.Getenv("TOTP_ISSUER"))
+    if totpIssuer == "" {
+        totpIssuer = "kino-form"
+    }
+    loginMaxAttempts := 5
+    if raw := strings.TrimSpace(os.Getenv("LOGIN_MAX_ATTEMPTS")); raw != "" {
+        if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+            loginMaxAttempts = n
+        }
+    }
+    loginLockout := 15 * time.Minute
+    if raw := strings.TrimSpace(os.Getenv("LOGIN_LOCKOUT_MINUTES")); raw != "" {
+        if mins, err := strconv.Atoi(raw); err == nil && mins > 0 {
+            loginLockout = time.Duration(mins) * time.Minute
+        }
+    }
+    templateHorizon := 14 * 24 * time.Hour
+    if raw := strings.TrimSpace(os.Getenv("SESSION_TEMPLATE_HORIZON_DAYS")); raw != "" {
+        if days, err := strconv.Atoi(raw); err == nil && days > 0 {
+            templateHorizon = time.Duration(days) * 24 * time.Hour
+        }
+    }
+    holdTTL := 10 * time.Minute
+    if raw := strings.TrimSpace(os.Getenv("HOLD_TTL_MINUTES")); raw != "" {
+        if mins, err := strconv.Atoi(raw); err == nil && mins > 0 {
+            holdTTL = time.Duration(mins) * time.Minute
+        }
+    }
     return Config{
         DatabaseURL:   os.Getenv("DATABASE_URL"),
         JwtSecret:     os.Getenv("JWT_SECRET"),
@@ -294,6 +674,36 @@ func loadConfig() Config {
         AdminEmail:    os.Getenv("ADMIN_EMAIL"),
         AdminPassword: os.Getenv("ADMIN_PASSWORD"),
         AdminName:     os.Getenv("ADMIN_NAME"),
+        HoldTTL:       holdTTL,
+        PaymentProvider:      strings.ToLower(strings.TrimSpace(os.Getenv("PAYMENT_PROVIDER"))),
+        PaymentWebhookSecret: webhookSecret,
+        PaymentMockGateway:   mockGateway == "true" || mockGateway == "1" || mockGateway == "yes",
+        PaymentWebhookURL:    webhookURL,
+        PaymentCurrency:      currency,
+        PaymentTimeout:       paymentTimeout,
+        TicketKey:            ticketKey,
+        AccessTokenTTL:       accessTTL,
+        RefreshTokenTTL:      refreshTTL,
+        AppURL:               appURL,
+        MailDriver:           strings.ToLower(strings.TrimSpace(os.Getenv("MAIL_DRIVER"))),
+        MailFrom:             mailFrom,
+        MailDir:              os.Getenv("MAIL_DIR"),
+        SMTPHost:             os.Getenv("SMTP_HOST"),
+        SMTPPort:             os.Getenv("SMTP_PORT"),
+        SMTPUsername:         os.Getenv("SMTP_USERNAME"),
+        SMTPPassword:         os.Getenv("SMTP_PASSWORD"),
+        PublicURL:            publicURL,
+        VerificationKey:      deriveKey(os.Getenv("JWT_SECRET"), "email-verification"),
+        RequireEmailVerification: requireVerification == "true" || requireVerification == "1" || requireVerification == "yes",
+        RateLimitBackend:     strings.ToLower(strings.TrimSpace(os.Getenv("RATE_LIMIT_BACKEND"))),
+        LoginMaxAttempts:     loginMaxAttempts,
+        LoginLockout:         loginLockout,
+        TwoFactorKey:         deriveKey(os.Getenv("JWT_SECRET"), "two-factor-challenge"),
+        TOTPIssuer:           totpIssuer,
+        TemplateHorizon:      templateHorizon,
+        GuestAccessKey:       deriveKey(os.Getenv("JWT_SECRET"), "guest-booking-access"),
+        PosterHosts:          strings.Split(os.Getenv("POSTER_HOSTS"), ","),
+        TrustedProxies:       parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")),
     }
 }
 
@@ -315,6 +725,31 @@ func parseOrigins(raw string) []string {
     return origins
 }
 
+// parseTrustedProxies reads a comma-separated list of proxy IPs or CIDRs.
+// An empty value trusts no proxy at all.
+func parseTrustedProxies(raw string) []string {
+    var proxies []string
+    for _, part := range strings.Split(raw, ",") {
+        if trimmed := strings.TrimSpace(part); trimmed != "" {
+            proxies = append(proxies, trimmed)
+        }
+    }
+    return proxies
+}
+
+// loadCinemaLocation resolves the IANA zone the cinema's days and showtimes
+// are counted in; it defaults to Asia/Almaty.
+func loadCinemaLocation(name string) (*time.Location, error) {
+    name = strings.TrimSpace(name)
+    if name == "" {
+        name = "Asia/Almaty"
+    }
+    if name == "Local" {
+        return nil, fmt.Errorf("CINEMA_TIMEZONE must name a zone, e.g. Asia/Almaty")
+    }
+    return time.LoadLocation(name)
+}
+
 func ginLogger(logger *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         start := time.Now()
@@ -329,7 +764,7 @@ func ginLogger(logger *zap.Logger) gin.HandlerFunc {
         )
     }
 }
-func registerHandler(db *gorm.DB, secret string) gin.HandlerFunc {
+func registerHandler(db *gorm.DB, cfg Config, mailer Mailer, limiter RateLimiter, logger *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         var req RegisterRequest
         if err := c.ShouldBindJSON(&req); err != nil {
@@ -346,6 +781,9 @@ func registerHandler(db *gorm.DB, secret string) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error": "password must be at least 6 characters"})
             return
         }
+        if !checkRateLimit(c, limiter, logger, "register:email:"+req.Email, 3, time.Hour) {
+            return
+        }
 
         hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
         if err != nil {
@@ -358,18 +796,25 @@ func registerHandler(db *gorm.DB, secret string) gin.HandlerFunc {
             c.JSON(http.StatusConflict, gin.H{"error": "email already registered"})
             return
         }
+        // A slow mail relay must not hold up the sign-up; the user can ask
+        // for another link if this one never arrives.
+        go func(user User) {
+            if err := sendVerificationEmail(db, mailer, cfg, user); err != nil {
+                logger.Warn("failed to send verification email", zap.Uint("user_id", user.ID), zap.Error(err))
+            }
+        }(user)
 
-        token, err := createToken(user.ID, secret)
+        pair, _, err := issueTokens(db, c, user, cfg, "")
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
             return
         }
 
-        c.JSON(http.StatusCreated, gin.H{"token": token, "user": user})
+        c.JSON(http.StatusCreated, gin.H{"token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "user": user})
     }
 }
 
-func loginHandler(db *gorm.DB, secret string) gin.HandlerFunc {
+func loginHandler(db *gorm.DB, cfg Config, limiter RateLimiter, logger *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         var req LoginRequest
         if err := c.ShouldBindJSON(&req); err != nil {
@@ -382,31 +827,64 @@ func loginHandler(db *gorm.DB, secret string) gin.HandlerFunc {
             return
         }
 
+        // Per-email limit also covers addresses that have no account.
+        if !checkRateLimit(c, limiter, logger, "login:email:"+req.Email, 10, 15*time.Minute) {
+            return
+        }
+
         var user User
         if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
             c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
             return
         }
+        now := time.Now()
+        if user.LockedUntil != nil && user.LockedUntil.After(now) {
+            respondTooManyRequests(c, user.LockedUntil.Sub(now), "account temporarily locked")
+            return
+        }
+        if delay := loginDelay(user.FailedLogins); delay > 0 && user.LastFailedLoginAt != nil {
+            if wait := user.LastFailedLoginAt.Add(delay).Sub(now); wait > 0 {
+                respondTooManyRequests(c, wait, "too many failed attempts")
+                return
+            }
+        }
         if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+            if err := recordLoginFailure(db, user, cfg.LoginMaxAttempts, cfg.LoginLockout); err != nil {
+                logger.Warn("failed to record login failure", zap.Uint("user_id", user.ID), zap.Error(err))
+            }
             c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
             return
         }
+        if user.FailedLogins > 0 || user.LockedUntil != nil {
+            if err := db.Model(&user).Updates(map[string]interface{}{"failed_logins": 0, "locked_until": nil}).Error; err != nil {
+                logger.Warn("failed to reset login failures", zap.Uint("user_id", user.ID), zap.Error(err))
+            }
+        }
+        if user.DisabledAt != nil {
+            c.JSON(http.StatusForbidden, gin.H{"error": "account disabled"})
+            return
+        }
+        if respondTwoFactorChallenge(c, db, cfg, user) {
+            return
+        }
 
-        token, err := createToken(user.ID, secret)
+        pair, _, err := issueTokens(db, c, user, cfg, "")
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
             return
         }
 
-        c.JSON(http.StatusOK, gin.H{"token": token, "user": user})
+        c.JSON(http.StatusOK, gin.H{"token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "user": user})
     }
 }
 
-func createToken(userID uint, secret string) (string, error) {
+func createToken(user User, secret string, ttl time.Duration) (string, error) {
     claims := Claims{
-        UserID: userID,
+        UserID:       user.ID,
+        TokenVersion: user.TokenVersion,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
+            ID:        randomHex(16),
+            ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
             IssuedAt:  jwt.NewNumericDate(time.Now()),
         },
     }
@@ -414,7 +892,7 @@ func createToken(userID uint, secret string) (string, error) {
     return token.SignedString([]byte(secret))
 }
 
-func authMiddleware(secret string) gin.HandlerFunc {
+func authMiddleware(db *gorm.DB, secret string) gin.HandlerFunc {
     return func(c *gin.Context) {
         authHeader := c.GetHeader("Authorization")
         if !strings.HasPrefix(authHeader, "Bearer ") {
@@ -422,38 +900,30 @@ func authMiddleware(secret string) gin.HandlerFunc {
             return
         }
         tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-        token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-            if token.Method != jwt.SigningMethodHS256 {
-                return nil, errors.New("unexpected signing method")
-            }
-            return []byte(secret), nil
-        })
-        if err != nil || !token.Valid {
+        claims, err := parseAccessToken(tokenStr, secret)
+        if err != nil {
             c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
             return
         }
-        claims, ok := token.Claims.(*Claims)
-        if !ok {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+        var user User
+        if err := db.Select("id", "token_version", "disabled_at").First(&user, claims.UserID).Error; err != nil || user.TokenVersion != claims.TokenVersion {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token revoked"})
             return
         }
-        c.Set("user_id", claims.UserID)
-        c.Next()
-    }
-}
-
-func adminMiddleware(db *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        userID := c.GetUint("user_id")
-        var user User
-        if err := db.First(&user, userID).Error; err != nil {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+        if user.DisabledAt != nil {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account disabled"})
             return
         }
-        if !user.IsAdmin {
-            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+        var revoked int64
+        if err := db.Model(&RevokedToken{}).Where("jti = ?", claims.ID).Count(&revoked).Error; err != nil || revoked > 0 {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token revoked"})
             return
         }
+        c.Set("user_id", claims.UserID)
+        c.Set("token_id", claims.ID)
+        if claims.ExpiresAt != nil {
+            c.Set("token_expires", claims.ExpiresAt.Time)
+        }
         c.Next()
     }
 }
@@ -466,6 +936,12 @@ func meHandler(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
             return
         }
+        perms, err := userPermissions(db, userID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load permissions"})
+            return
+        }
+        user.Permissions = permissionList(perms)
         c.JSON(http.StatusOK, user)
     }
 }
@@ -498,7 +974,7 @@ func updateMeHandler(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
-func changePasswordHandler(db *gorm.DB) gin.HandlerFunc {
+func changePasswordHandler(db *gorm.DB, cfg Config) gin.HandlerFunc {
     return func(c *gin.Context) {
         var req ChangePasswordRequest
         if err := c.ShouldBindJSON(&req); err != nil {
@@ -532,12 +1008,28 @@ func changePasswordHandler(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update password"})
             return
         }
-        if err := db.Model(&User{}).Where("id = ?", userID).Update("password_hash", string(hash)).Error; err != nil {
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Model(&User{}).Where("id = ?", userID).Update("password_hash", string(hash)).Error; err != nil {
+                return err
+            }
+            return revokeAllTokens(tx, userID)
+        })
+        if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update password"})
             return
         }
 
-        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+        // Every other device is signed out; this one gets a fresh pair.
+        if err := db.First(&user, userID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+            return
+        }
+        pair, _, err := issueTokens(db, c, user, cfg, "")
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok", "token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn})
     }
 }
 
@@ -754,22 +1246,51 @@ func createHall(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
             return
         }
-        if strings.TrimSpace(req.Name) == "" || req.Rows <= 0 || req.Cols <= 0 {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "name, rows, cols are required"})
+        if strings.TrimSpace(req.Name) == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+            return
+        }
+        if req.Layout == nil {
+            if req.Rows <= 0 || req.Cols <= 0 {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "name, rows, cols are required"})
+                return
+            }
+            rect := rectangleLayout(req.Rows, req.Cols)
+            req.Layout = &rect
+        }
+        layout, err := req.Layout.normalize()
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        encoded, err := encodeLayout(layout)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create hall"})
             return
         }
 
-        hall := Hall{Name: strings.TrimSpace(req.Name), Rows: req.Rows, Cols: req.Cols}
-        err := db.Transaction(func(tx *gorm.DB) error {
+        hall := Hall{Name: strings.TrimSpace(req.Name), Rows: layout.SeatRows(), Cols: layout.Width(), Layout: encoded, CleaningMinutes: defaultCleaningMins}
+        if req.CleaningMinutes != nil {
+            if *req.CleaningMinutes < 0 {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "cleaning_minutes cannot be negative"})
+                return
+            }
+            hall.CleaningMinutes = *req.CleaningMinutes
+        }
+        if req.Supports3D != nil {
+            hall.Supports3D = *req.Supports3D
+        }
+        if req.SupportsIMAX != nil {
+            hall.SupportsIMAX = *req.SupportsIMAX
+        }
+        if req.Supports4DX != nil {
+            hall.Supports4DX = *req.Supports4DX
+        }
+        err = db.Transaction(func(tx *gorm.DB) error {
             if err := tx.Create(&hall).Error; err != nil {
                 return err
             }
-            seats := make([]Seat, 0, hall.Rows*hall.Cols)
-            for r := 1; r <= hall.Rows; r++ {
-                for n := 1; n <= hall.Cols; n++ {
-                    seats = append(seats, Seat{HallID: hall.ID, Row: r, Number: n})
-                }
-            }
+            seats := layout.seats(hall.ID)
             if err := tx.Create(&seats).Error; err != nil {
                 return err
             }
@@ -784,7 +1305,7 @@ func createHall(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
-func updateHall(db *gorm.DB) gin.HandlerFunc {
+func updateHall(db *gorm.DB, payments PaymentProvider) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
         var req HallRequest
@@ -796,8 +1317,8 @@ func updateHall(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
             return
         }
-        if err := db.Model(&Hall{}).Where("id = ?", id).Update("name", strings.TrimSpace(req.Name)).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update hall"})
+        if req.CleaningMinutes != nil && *req.CleaningMinutes < 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "cleaning_minutes cannot be negative"})
             return
         }
         var hall Hall
@@ -805,6 +1326,73 @@ func updateHall(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusNotFound, gin.H{"error": "hall not found"})
             return
         }
+        // Rows and cols, or a full layout, reshape the hall; booked seats are
+        // protected the same way as in PUT /halls/:id/layout without force.
+        if req.Layout == nil && req.Rows > 0 && req.Cols > 0 && (req.Rows != hall.Rows || req.Cols != hall.Cols) {
+            rect := rectangleLayout(req.Rows, req.Cols)
+            req.Layout = &rect
+        }
+        var layout *HallLayout
+        if req.Layout != nil {
+            normalized, err := req.Layout.normalize()
+            if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+            }
+            layout = &normalized
+        }
+        updates := map[string]interface{}{"name": strings.TrimSpace(req.Name)}
+        if req.CleaningMinutes != nil {
+            updates["cleaning_minutes"] = *req.CleaningMinutes
+        }
+        // Equipment can only be taken away once no upcoming session needs it.
+        capable := hall
+        if req.Supports3D != nil {
+            capable.Supports3D = *req.Supports3D
+            updates["supports_3d"] = *req.Supports3D
+        }
+        if req.SupportsIMAX != nil {
+            capable.SupportsIMAX = *req.SupportsIMAX
+            updates["supports_imax"] = *req.SupportsIMAX
+        }
+        if req.Supports4DX != nil {
+            capable.Supports4DX = *req.Supports4DX
+            updates["supports_4dx"] = *req.Supports4DX
+        }
+        // Nothing is written unless every part of the edit is accepted.
+        var blocked []string
+        var diff LayoutDiff
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var err error
+            if blocked, err = formatsInUse(tx, capable); err != nil {
+                return err
+            }
+            if len(blocked) > 0 {
+                return errHallFormatsInUse
+            }
+            if layout != nil {
+                if diff, err = changeHallLayoutTx(tx, c.GetUint("user_id"), hall, *layout, false, false); err != nil {
+                    return err
+                }
+            }
+            return tx.Model(&hall).Updates(updates).Error
+        })
+        switch {
+        case errors.Is(err, errHallFormatsInUse):
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "formats": blocked})
+            return
+        case errors.Is(err, errLayoutConflict):
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "diff": diff})
+            return
+        case err != nil:
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update hall"})
+            return
+        }
+        refundLayoutCancellations(db, payments, diff)
+        if err := db.First(&hall, hall.ID).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "hall not found"})
+            return
+        }
         c.JSON(http.StatusOK, hall)
     }
 }
@@ -837,23 +1425,6 @@ func deleteHall(db *gorm.DB) gin.HandlerFunc {
         c.Status(http.StatusNoContent)
     }
 }
-func listSessions(db *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        var sessions []Session
-        query := db.Preload("Movie").Preload("Hall").Order("start_time asc")
-        if movieID := c.Query("movie_id"); movieID != "" {
-            if _, err := strconv.Atoi(movieID); err == nil {
-                query = query.Where("movie_id = ?", movieID)
-            }
-        }
-        if err := query.Find(&sessions).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load sessions"})
-            return
-        }
-        c.JSON(http.StatusOK, sessions)
-    }
-}
-
 func getSession(db *gorm.DB) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
@@ -882,9 +1453,35 @@ func createSession(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error": "movie_id, hall_id, base_price are required"})
             return
         }
-        session := Session{MovieID: req.MovieID, HallID: req.HallID, StartTime: startTime, BasePrice: req.BasePrice}
-        if err := db.Create(&session).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+        format, err := normalizeFormat(req.Format)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        session := Session{MovieID: req.MovieID, HallID: req.HallID, StartTime: startTime, BasePrice: req.BasePrice, Format: format}
+        if req.AudioLanguage != nil {
+            if session.AudioLanguage, err = normalizeLanguage(*req.AudioLanguage); err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+            }
+        }
+        if req.SubtitleLanguage != nil {
+            if session.SubtitleLanguage, err = normalizeLanguage(*req.SubtitleLanguage); err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+            }
+        }
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if err := checkHallFormat(tx, session.HallID, session.Format); err != nil {
+                return err
+            }
+            if err := checkSessionSlot(tx, session.HallID, session.MovieID, session.StartTime, 0); err != nil {
+                return err
+            }
+            return tx.Create(&session).Error
+        })
+        if err != nil {
+            respondSessionError(c, err, "failed to create session")
             return
         }
         if err := db.Preload("Movie").Preload("Hall").First(&session, session.ID).Error; err != nil {
@@ -895,7 +1492,7 @@ func createSession(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
-func updateSession(db *gorm.DB) gin.HandlerFunc {
+func updateSession(db *gorm.DB, loc *time.Location) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
         var req SessionRequest
@@ -921,12 +1518,80 @@ func updateSession(db *gorm.DB) gin.HandlerFunc {
             }
             updates["start_time"] = startTime
         }
+        if req.Format != "" {
+            format, err := normalizeFormat(req.Format)
+            if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+            }
+            updates["format"] = format
+        }
+        if req.AudioLanguage != nil {
+            audio, err := normalizeLanguage(*req.AudioLanguage)
+            if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+            }
+            updates["audio_language"] = audio
+        }
+        if req.SubtitleLanguage != nil {
+            subtitles, err := normalizeLanguage(*req.SubtitleLanguage)
+            if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+            }
+            updates["subtitle_language"] = subtitles
+        }
         if len(updates) == 0 {
             c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
             return
         }
-        if err := db.Model(&Session{}).Where("id = ?", id).Updates(updates).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update session"})
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var current Session
+            if err := tx.First(&current, id).Error; err != nil {
+                return err
+            }
+            original := current
+            if req.MovieID > 0 {
+                current.MovieID = req.MovieID
+            }
+            if req.HallID > 0 {
+                current.HallID = req.HallID
+            }
+            start, moved := updates["start_time"].(time.Time)
+            if moved {
+                current.StartTime = start
+            }
+            if format, ok := updates["format"].(string); ok {
+                current.Format = format
+            }
+            if req.HallID > 0 || req.Format != "" {
+                if err := checkHallFormat(tx, current.HallID, current.Format); err != nil {
+                    return err
+                }
+            }
+            // A price-only edit must not trip over overlaps that predate the check.
+            if moved || req.MovieID > 0 || req.HallID > 0 {
+                if err := checkSessionSlot(tx, current.HallID, current.MovieID, current.StartTime, current.ID); err != nil {
+                    return err
+                }
+            }
+            // A templated session moved off its slot no longer belongs to the
+            // template; the slot itself stays free.
+            if original.TemplateID != nil && (!current.StartTime.Equal(original.StartTime) || current.HallID != original.HallID) {
+                if err := detachFromTemplate(tx, original, loc, "session moved"); err != nil {
+                    return err
+                }
+                updates["template_id"] = nil
+            }
+            return tx.Model(&Session{}).Where("id = ?", current.ID).Updates(updates).Error
+        })
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+            return
+        }
+        if err != nil {
+            respondSessionError(c, err, "failed to update session")
             return
         }
         var session Session
@@ -938,19 +1603,49 @@ func updateSession(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
-func deleteSession(db *gorm.DB) gin.HandlerFunc {
+// deleteSession removes a session nobody has bought or held seats for. Any
+// booking, even a cancelled one, keeps the session for its history; such
+// sessions are called off through POST /admin/sessions/:id/cancel.
+func deleteSession(db *gorm.DB, loc *time.Location) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
-        var count int64
-        if err := db.Model(&Booking{}).Where("session_id = ? AND status = ?", id, "confirmed").Count(&count).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check bookings"})
+        err := db.Transaction(func(tx *gorm.DB) error {
+            // Same lock as insertBooking, so no sale slips in meanwhile.
+            var session Session
+            if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, id).Error; err != nil {
+                return err
+            }
+            var count int64
+            if err := tx.Model(&Booking{}).Where("session_id = ?", session.ID).Count(&count).Error; err != nil {
+                return err
+            }
+            if count > 0 {
+                return errSessionHasBookings
+            }
+            held, err := heldSeatIDs(tx, session.ID)
+            if err != nil {
+                return err
+            }
+            if len(held) > 0 {
+                return errSessionHasHolds
+            }
+            if err := deleteHolds(tx, tx.Model(&SeatHold{}).Select("id").Where("session_id = ?", session.ID)); err != nil {
+                return err
+            }
+            if err := detachFromTemplate(tx, session, loc, "session deleted"); err != nil {
+                return err
+            }
+            return tx.Delete(&Session{}, session.ID).Error
+        })
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
             return
         }
-        if count > 0 {
-            c.JSON(http.StatusConflict, gin.H{"error": "session has bookings"})
+        if errors.Is(err, errSessionHasBookings) || errors.Is(err, errSessionHasHolds) {
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
             return
         }
-        if err := db.Delete(&Session{}, id).Error; err != nil {
+        if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete session"})
             return
         }
@@ -962,7 +1657,7 @@ func listSeats(db *gorm.DB) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
         var seats []Seat
-        if err := db.Where("hall_id = ?", id).Order("row asc, number asc").Find(&seats).Error; err != nil {
+        if err := db.Where("hall_id = ? AND removed_at IS NULL", id).Order("row asc, number asc").Find(&seats).Error; err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load seats"})
             return
         }
@@ -973,23 +1668,24 @@ func listSeats(db *gorm.DB) gin.HandlerFunc {
 func sessionAvailability(db *gorm.DB) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
-        var bookingSeats []BookingSeat
-        if err := db.Table("booking_seats").
-            Joins("JOIN bookings ON bookings.id = booking_seats.booking_id").
-            Where("bookings.session_id = ? AND bookings.status = ?", id, "confirmed").
-            Find(&bookingSeats).Error; err != nil {
+        seatIDs := make([]uint, 0)
+        if err := db.Model(&SessionSeat{}).
+            Where("session_id = ? AND booking_id IS NOT NULL", id).
+            Pluck("seat_id", &seatIDs).Error; err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load availability"})
             return
         }
-        seatIDs := make([]uint, 0, len(bookingSeats))
-        for _, bs := range bookingSeats {
-            seatIDs = append(seatIDs, bs.SeatID)
+        sessionID, _ := strconv.Atoi(id)
+        heldIDs, err := heldSeatIDs(db, uint(sessionID))
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load availability"})
+            return
         }
-        c.JSON(http.StatusOK, gin.H{"booked_seat_ids": seatIDs})
+        c.JSON(http.StatusOK, gin.H{"booked_seat_ids": seatIDs, "held_seat_ids": heldIDs})
     }
 }
 
-func createBooking(db *gorm.DB) gin.HandlerFunc {
+func createBooking(db *gorm.DB, payments PaymentProvider, currency string) gin.HandlerFunc {
     return func(c *gin.Context) {
         userID := c.GetUint("user_id")
         var req BookingRequest
@@ -997,67 +1693,31 @@ func createBooking(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
             return
         }
-        if req.SessionID == 0 || len(req.SeatIDs) == 0 || strings.TrimSpace(req.PaymentMethod) == "" {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "session_id, seat_ids, payment_method are required"})
-            return
-        }
-
-        var session Session
-        if err := db.Preload("Hall").First(&session, req.SessionID).Error; err != nil {
-            c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
-            return
-        }
-
-        var seats []Seat
-        if err := db.Where("hall_id = ? AND id IN ?", session.HallID, req.SeatIDs).Find(&seats).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to validate seats"})
-            return
-        }
-        if len(seats) != len(req.SeatIDs) {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "some seats are invalid for this hall"})
+        session, tickets, ok := loadBookingSession(c, db, req)
+        if !ok {
             return
         }
 
         var booking Booking
         err := db.Transaction(func(tx *gorm.DB) error {
-            var booked []uint
-            if err := tx.Table("booking_seats").
-                Select("booking_seats.seat_id").
-                Joins("JOIN bookings ON bookings.id = booking_seats.booking_id").
-                Where("bookings.session_id = ? AND bookings.status = ? AND booking_seats.seat_id IN ?", session.ID, "confirmed", req.SeatIDs).
-                Find(&booked).Error; err != nil {
+            // Buying directly supersedes the customer's own hold on this session.
+            if err := deleteHolds(tx, tx.Model(&SeatHold{}).Select("id").Where("user_id = ? AND session_id = ?", userID, session.ID)); err != nil {
                 return err
             }
-            if len(booked) > 0 {
-                return fmt.Errorf("seats already booked")
-            }
-
-            booking = Booking{
-                UserID:     userID,
-                SessionID:  session.ID,
-                Status:     "confirmed",
-                TotalPrice: session.BasePrice * len(req.SeatIDs),
-                PaymentMethod: strings.TrimSpace(req.PaymentMethod),
-            }
-            if err := tx.Create(&booking).Error; err != nil {
-                return err
-            }
-
-            bookingSeats := make([]BookingSeat, 0, len(req.SeatIDs))
-            for _, seatID := range req.SeatIDs {
-                bookingSeats = append(bookingSeats, BookingSeat{BookingID: booking.ID, SeatID: seatID})
-            }
-            if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&bookingSeats).Error; err != nil {
-                return err
-            }
-            return nil
+            var err error
+            booking, err = insertBooking(tx, userID, session, tickets, req.PaymentMethod, 0)
+            return err
         })
         if err != nil {
-            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+            respondBookingConflict(c, err)
+            return
+        }
+        if _, err := startPayment(db, payments, currency, booking); err != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "failed to start payment"})
             return
         }
 
-        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").First(&booking, booking.ID).Error; err != nil {
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").Preload("Payment").First(&booking, booking.ID).Error; err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load booking"})
             return
         }
@@ -1065,11 +1725,104 @@ func createBooking(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
+// loadBookingSession validates a purchase request and loads its session,
+// answering the client itself when the request is unusable. It returns the
+// ticket type chosen for every requested seat.
+func loadBookingSession(c *gin.Context, db *gorm.DB, req BookingRequest) (Session, []TicketSelection, bool) {
+    seatIDs, tickets, err := ticketSelections(req.SeatIDs, req.Tickets)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return Session{}, nil, false
+    }
+    req.SeatIDs = seatIDs
+    if req.SessionID == 0 || len(req.SeatIDs) == 0 || strings.TrimSpace(req.PaymentMethod) == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "session_id, seat_ids, payment_method are required"})
+        return Session{}, nil, false
+    }
+
+    var session Session
+    if err := db.Preload("Hall").First(&session, req.SessionID).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+        return Session{}, nil, false
+    }
+    if err := bookableSession(session); err != nil {
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+        return Session{}, nil, false
+    }
+
+    var seats []Seat
+    if err := db.Where("hall_id = ? AND id IN ? AND removed_at IS NULL AND disabled = ?", session.HallID, req.SeatIDs, false).Find(&seats).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to validate seats"})
+        return Session{}, nil, false
+    }
+    if len(seats) != len(req.SeatIDs) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "some seats are invalid for this hall"})
+        return Session{}, nil, false
+    }
+    return session, tickets, true
+}
+
+// insertBooking stores a booking awaiting payment for the given seats. The seats are
+// reserved in session_seats, either freshly or by taking over holdID's
+// reservations, so a concurrent purchase of the same seat fails here. The
+// session row stays locked until commit so it cannot be cancelled meanwhile.
+func insertBooking(tx *gorm.DB, userID uint, session Session, tickets []TicketSelection, paymentMethod string, holdID uint) (Booking, error) {
+    if err := lockBookableSession(tx, session.ID); err != nil {
+        return Booking{}, err
+    }
+    bookingSeats, total, err := priceTickets(tx, session, tickets)
+    if err != nil {
+        return Booking{}, err
+    }
+    booking := Booking{
+        UserID:        userID,
+        SessionID:     session.ID,
+        Status:        "pending_payment",
+        TotalPrice:    total,
+        PaymentMethod: strings.TrimSpace(paymentMethod),
+    }
+    if err := tx.Create(&booking).Error; err != nil {
+        return Booking{}, err
+    }
+
+    seatIDs := make([]uint, 0, len(bookingSeats))
+    for i := range bookingSeats {
+        bookingSeats[i].BookingID = booking.ID
+        seatIDs = append(seatIDs, bookingSeats[i].SeatID)
+    }
+    if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&bookingSeats).Error; err != nil {
+        return Booking{}, err
+    }
+    if holdID != 0 {
+        if err := transferHoldSeats(tx, holdID, booking.ID, len(seatIDs)); err != nil {
+            return Booking{}, err
+        }
+    } else if err := claimSeats(tx, session.ID, seatIDs, &booking.ID, nil); err != nil {
+        return Booking{}, err
+    }
+    return booking, nil
+}
+
+// respondBookingConflict answers 409, naming the contested seats when known.
+// An unknown ticket type is the client's mistake and gets 400 instead.
+func respondBookingConflict(c *gin.Context, err error) {
+    if errors.Is(err, errUnknownTicketType) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    var conflict *SeatConflictError
+    if errors.As(err, &conflict) {
+        c.JSON(http.StatusConflict, gin.H{"error": conflict.Error(), "seat_ids": conflict.SeatIDs})
+        return
+    }
+    c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+}
+
 func listMyBookings(db *gorm.DB) gin.HandlerFunc {
     return func(c *gin.Context) {
         userID := c.GetUint("user_id")
         var bookings []Booking
-        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").
             Where("user_id = ?", userID).Order("created_at desc").Find(&bookings).Error; err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load bookings"})
             return
@@ -1078,33 +1831,56 @@ func listMyBookings(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
-func cancelBooking(db *gorm.DB) gin.HandlerFunc {
+func cancelBooking(db *gorm.DB, payments PaymentProvider, policy CancellationPolicy) gin.HandlerFunc {
     return func(c *gin.Context) {
         userID := c.GetUint("user_id")
         id := c.Param("id")
         var booking Booking
-        if err := db.Where("id = ? AND user_id = ?", id, userID).First(&booking).Error; err != nil {
+        if err := db.Preload("Session").Where("id = ? AND user_id = ?", id, userID).First(&booking).Error; err != nil {
             c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
             return
         }
-        if booking.Status == "cancelled" {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "booking already cancelled"})
-            return
-        }
-        if err := db.Model(&booking).Update("status", "cancelled").Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel booking"})
-            return
-        }
-        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").First(&booking, booking.ID).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load booking"})
-            return
-        }
-        c.JSON(http.StatusOK, booking)
+        customerCancel(c, db, payments, policy, booking)
     }
 }
 
-func updateBookingStatus(db *gorm.DB) gin.HandlerFunc {
+// customerCancel applies the cancellation policy to a booking the caller is
+// entitled to cancel, whether they are its owner or a guest with a link.
+func customerCancel(c *gin.Context, db *gorm.DB, payments PaymentProvider, policy CancellationPolicy, booking Booking) {
+    if booking.Status == "cancelled" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "booking already cancelled"})
+        return
+    }
+    percent, err := policy.RefundPercent(booking.Session.StartTime, time.Now())
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    refund := booking.TotalPrice * percent / 100
+    if err := cancelWithRefund(db, payments, booking.ID, refund, "cancelled by customer", nil); err != nil {
+        respondCancelError(c, err)
+        return
+    }
+    if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").First(&booking, booking.ID).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load booking"})
+        return
+    }
+    c.JSON(http.StatusOK, booking)
+}
+
+// respondCancelError maps cancelWithRefund failures onto HTTP statuses.
+func respondCancelError(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, errBookingNotActive):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel booking"})
+    }
+}
+
+func updateBookingStatus(db *gorm.DB, payments PaymentProvider, policy CancellationPolicy) gin.HandlerFunc {
     return func(c *gin.Context) {
+        actorID := c.GetUint("user_id")
         id := c.Param("id")
         var req BookingStatusRequest
         if err := c.ShouldBindJSON(&req); err != nil {
@@ -1116,10 +1892,65 @@ func updateBookingStatus(db *gorm.DB) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error": "status must be confirmed or cancelled"})
             return
         }
-        if err := db.Model(&Booking{}).Where("id = ?", id).Update("status", status).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update booking"})
+        reason := strings.TrimSpace(req.Reason)
+        var current Booking
+        if err := db.Preload("Session").First(&current, id).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
             return
         }
+
+        if status == "cancelled" {
+            override := req.RefundAmount != nil || req.RefundPercent != nil
+            if override && reason == "" {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "reason is required to override the cancellation policy"})
+                return
+            }
+            // Admins may cancel after the start; the policy then refunds nothing.
+            percent, _ := policy.RefundPercent(current.Session.StartTime, time.Now())
+            refund := current.TotalPrice * percent / 100
+            switch {
+            case req.RefundAmount != nil:
+                refund = *req.RefundAmount
+            case req.RefundPercent != nil:
+                refund = current.TotalPrice * *req.RefundPercent / 100
+            }
+            if refund < 0 || refund > current.TotalPrice {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "refund must be between 0 and the booking total"})
+                return
+            }
+            if reason == "" {
+                reason = "cancelled by administrator"
+            }
+            err := cancelWithRefund(db, payments, current.ID, refund, reason, func(tx *gorm.DB) error {
+                return recordAudit(tx, actorID, "booking.cancel", "booking", current.ID, reason, gin.H{
+                    "refund_amount":  refund,
+                    "policy_percent": percent,
+                    "override":       override,
+                })
+            })
+            if err != nil {
+                respondCancelError(c, err)
+                return
+            }
+        } else {
+            err := db.Transaction(func(tx *gorm.DB) error {
+                if err := tx.Model(&current).Update("status", status).Error; err != nil {
+                    return err
+                }
+                var seatIDs []uint
+                if err := tx.Model(&BookingSeat{}).Where("booking_id = ?", current.ID).Pluck("seat_id", &seatIDs).Error; err != nil {
+                    return err
+                }
+                if err := claimSeats(tx, current.SessionID, seatIDs, &current.ID, nil); err != nil {
+                    return err
+                }
+                return recordAudit(tx, actorID, "booking.confirm", "booking", current.ID, reason, gin.H{"previous_status": current.Status})
+            })
+            if err != nil {
+                respondBookingConflict(c, err)
+                return
+            }
+        }
         var booking Booking
         if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").First(&booking, id).Error; err != nil {
             c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
@@ -1129,14 +1960,17 @@ func updateBookingStatus(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
-func bookingQR(db *gorm.DB) gin.HandlerFunc {
+// bookingLoader fetches the booking named in the route and checks the caller
+// may see it, writing the error response itself when not.
+type bookingLoader func(db *gorm.DB, c *gin.Context) (Booking, error)
+
+func bookingQR(db *gorm.DB, ticketKey []byte, load bookingLoader) gin.HandlerFunc {
     return func(c *gin.Context) {
-        booking, err := loadBookingForUser(db, c)
+        booking, err := load(db, c)
         if err != nil {
             return
         }
-        payload := fmt.Sprintf("booking:%d|session:%d|status:%s", booking.ID, booking.SessionID, booking.Status)
-        png, err := qrcode.Encode(payload, qrcode.Medium, 256)
+        png, err := qrcode.Encode(signTicket(ticketKey, booking), qrcode.Medium, 256)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate qr"})
             return
@@ -1146,102 +1980,44 @@ func bookingQR(db *gorm.DB) gin.HandlerFunc {
     }
 }
 
-func bookingTicket(db *gorm.DB) gin.HandlerFunc {
+func bookingTicket(db *gorm.DB, ticketKey []byte, currency string, loc *time.Location, posters *posterCache, load bookingLoader) gin.HandlerFunc {
     return func(c *gin.Context) {
-        booking, err := loadBookingForUser(db, c)
+        booking, err := load(db, c)
         if err != nil {
             return
         }
-        pdf := gofpdf.New("P", "mm", "A4", "")
-        pdf.SetMargins(20, 20, 20)
-        pdf.AddPage()
-        pdf.SetFont("Helvetica", "B", 20)
-        pdf.Cell(0, 12, "Kinoform Ticket")
-        pdf.Ln(14)
-        pdf.SetFont("Helvetica", "", 12)
-
-        movieTitle := sanitizeASCII(booking.Session.Movie.Title)
-        hallName := sanitizeASCII(booking.Session.Hall.Name)
-        start := booking.Session.StartTime.Format("2006-01-02 15:04")
-        seats := formatSeatList(booking.Seats)
-
-        pdf.Cell(0, 8, fmt.Sprintf("Booking: #%d", booking.ID))
-        pdf.Ln(8)
-        pdf.Cell(0, 8, fmt.Sprintf("Movie: %s", movieTitle))
-        pdf.Ln(8)
-        pdf.Cell(0, 8, fmt.Sprintf("Hall: %s", hallName))
-        pdf.Ln(8)
-        pdf.Cell(0, 8, fmt.Sprintf("Start: %s", start))
-        pdf.Ln(8)
-        pdf.Cell(0, 8, fmt.Sprintf("Seats: %s", seats))
-        pdf.Ln(8)
-        pdf.Cell(0, 8, fmt.Sprintf("Status: %s", booking.Status))
-        pdf.Ln(12)
-
-        qrPayload := fmt.Sprintf("booking:%d|session:%d|status:%s", booking.ID, booking.SessionID, booking.Status)
-        qr, err := qrcode.Encode(qrPayload, qrcode.Medium, 200)
-        if err == nil {
-            opts := gofpdf.ImageOptions{ImageType: "PNG", ReadDpi: true}
-            pdf.RegisterImageOptionsReader("qr", opts, bytes.NewReader(qr))
-            pdf.ImageOptions("qr", 20, pdf.GetY(), 40, 40, false, opts, 0, "")
-        }
-
-        var buf bytes.Buffer
-        if err := pdf.Output(&buf); err != nil {
+        lang := ticketLang(c.Query("lang"))
+        pdf, err := renderTicketPDF(booking, lang, currency, signTicket(ticketKey, booking), loc, posters)
+        if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to render pdf"})
             return
         }
         c.Header("Content-Type", "application/pdf")
         c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=booking-%d.pdf", booking.ID))
-        c.Writer.Write(buf.Bytes())
+        c.Writer.Write(pdf)
     }
 }
+
 func loadBookingForUser(db *gorm.DB, c *gin.Context) (Booking, error) {
     userID := c.GetUint("user_id")
     id := c.Param("id")
     var booking Booking
-    if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").First(&booking, id).Error; err != nil {
+    if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").First(&booking, id).Error; err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
         return booking, err
     }
-    var user User
-    if err := db.First(&user, userID).Error; err != nil {
+    perms, err := userPermissions(db, userID)
+    if err != nil {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
         return booking, err
     }
-    if booking.UserID != userID && !user.IsAdmin {
+    if booking.UserID != userID && !hasPermission(perms, PermBookingsManage) && !hasPermission(perms, PermBookingsSell) {
         c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
         return booking, fmt.Errorf("access denied")
     }
     return booking, nil
 }
 
-func formatSeatList(seats []Seat) string {
-    if len(seats) == 0 {
-        return "-"
-    }
-    labels := make([]string, 0, len(seats))
-    for _, seat := range seats {
-        labels = append(labels, fmt.Sprintf("R%d-S%d", seat.Row, seat.Number))
-    }
-    return strings.Join(labels, ", ")
-}
-
-func sanitizeASCII(input string) string {
-    b := make([]rune, 0, len(input))
-    for _, r := range input {
-        if r >= 32 && r <= 126 {
-            b = append(b, r)
-        } else {
-            b = append(b, '?')
-        }
-    }
-    if len(b) == 0 {
-        return "-"
-    }
-    return string(b)
-}
-
 func seedAdmin(db *gorm.DB, cfg Config) error {
     email := strings.TrimSpace(strings.ToLower(cfg.AdminEmail))
     password := strings.TrimSpace(cfg.AdminPassword)
@@ -1251,9 +2027,16 @@ func seedAdmin(db *gorm.DB, cfg Config) error {
     var existing User
     if err := db.Where("email = ?", email).First(&existing).Error; err == nil {
         if !existing.IsAdmin {
-            return db.Model(&existing).Update("is_admin", true).Error
+            if err := db.Model(&existing).Update("is_admin", true).Error; err != nil {
+                return err
+            }
         }
-        return nil
+        if existing.EmailVerifiedAt == nil {
+            if err := db.Model(&existing).Update("email_verified_at", time.Now()).Error; err != nil {
+                return err
+            }
+        }
+        return grantRole(db, existing.ID, RoleSuperAdmin)
     }
     name := strings.TrimSpace(cfg.AdminName)
     if name == "" {
@@ -1263,11 +2046,15 @@ func seedAdmin(db *gorm.DB, cfg Config) error {
     if err != nil {
         return err
     }
-    admin := User{Name: name, Email: email, PasswordHash: string(hash), IsAdmin: true}
-    return db.Create(&admin).Error
+    now := time.Now()
+    admin := User{Name: name, Email: email, PasswordHash: string(hash), IsAdmin: true, EmailVerifiedAt: &now}
+    if err := db.Create(&admin).Error; err != nil {
+        return err
+    }
+    return grantRole(db, admin.ID, RoleSuperAdmin)
 }
 
-func seedData(db *gorm.DB) error {
+func seedData(db *gorm.DB, location *time.Location) error {
     var count int64
     if err := db.Model(&Movie{}).Count(&count).Error; err != nil {
         return err
@@ -1277,10 +2064,10 @@ func seedData(db *gorm.DB) error {
     }
 
     halls := []Hall{
-        {Name: "Зал А", Rows: 8, Cols: 12},
-        {Name: "Зал B", Rows: 10, Cols: 14},
-        {Name: "Зал C", Rows: 7, Cols: 10},
-        {Name: "Зал D", Rows: 9, Cols: 12},
+        {Name: "Зал А", Rows: 8, Cols: 12, CleaningMinutes: defaultCleaningMins},
+        {Name: "Зал B", Rows: 10, Cols: 14, CleaningMinutes: defaultCleaningMins},
+        {Name: "Зал C", Rows: 7, Cols: 10, CleaningMinutes: defaultCleaningMins},
+        {Name: "Зал D", Rows: 9, Cols: 12, CleaningMinutes: defaultCleaningMins},
     }
     if err := db.Create(&halls).Error; err != nil {
         return err
@@ -1290,7 +2077,7 @@ func seedData(db *gorm.DB) error {
     for _, hall := range halls {
         for r := 1; r <= hall.Rows; r++ {
             for n := 1; n <= hall.Cols; n++ {
-                seats = append(seats, Seat{HallID: hall.ID, Row: r, Number: n})
+                seats = append(seats, Seat{HallID: hall.ID, Row: r, Number: n, RowLabel: strconv.Itoa(r), GridRow: r - 1, GridCol: n - 1})
             }
         }
     }
@@ -1355,32 +2142,24 @@ func seedData(db *gorm.DB) error {
         return err
     }
 
-    now := time.Now()
-    location := now.Location()
-    startTimes := []time.Duration{
-        6 * time.Hour,
-        9 * time.Hour,
-        12 * time.Hour,
-        15 * time.Hour,
-        18 * time.Hour,
-        21 * time.Hour,
-        23 * time.Hour,
+    // The generator keeps each hall's sessions apart by runtime plus the
+    // cleaning buffer, as checkSessionSlot requires.
+    planHalls := make([]scheduling.Hall, 0, len(halls))
+    for _, hall := range halls {
+        planHalls = append(planHalls, scheduling.Hall{ID: hall.ID, Cleaning: time.Duration(hall.CleaningMinutes) * time.Minute})
+    }
+    planMovies := make([]scheduling.Movie, 0, len(movies))
+    for _, movie := range movies {
+        planMovies = append(planMovies, scheduling.Movie{ID: movie.ID, DurationMins: movie.DurationMins})
     }
     sessions := make([]Session, 0)
-    for day := 0; day < 7; day++ {
-        baseDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location).AddDate(0, 0, day)
-        for hallIndex, hall := range halls {
-            for timeIndex, offset := range startTimes {
-                movieIndex := (day + hallIndex + timeIndex) % len(movies)
-                basePrice := 400 + (timeIndex * 30) + (hallIndex * 20)
-                sessions = append(sessions, Session{
-                    MovieID:   movies[movieIndex].ID,
-                    HallID:    hall.ID,
-                    StartTime: baseDate.Add(offset),
-                    BasePrice: basePrice,
-                })
-            }
-        }
+    for _, slot := range scheduling.Generate(planHalls, planMovies, nil, scheduling.DefaultOptions(time.Now().In(location))) {
+        sessions = append(sessions, Session{
+            MovieID:   slot.MovieID,
+            HallID:    slot.HallID,
+            StartTime: slot.Start,
+            BasePrice: slot.BasePrice,
+        })
     }
     if err := db.Create(&sessions).Error; err != nil {
         return err
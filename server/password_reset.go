@@ -0,0 +1,160 @@
+
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "golang.org/x/crypto/bcrypt"
+    "gorm.io/gorm"
+)
+
+const passwordResetTTL = time.Hour
+
+// PasswordResetToken is a single-use credential mailed to the user; only its
+// hash is stored.
+type PasswordResetToken struct {
+    ID        uint       `gorm:"primaryKey" json:"id"`
+    UserID    uint       `gorm:"index" json:"user_id"`
+    TokenHash string     `gorm:"uniqueIndex" json:"-"`
+    ExpiresAt time.Time  `json:"expires_at"`
+    UsedAt    *time.Time `json:"used_at"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+type ForgotPasswordRequest struct {
+    Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+    Token    string `json:"token"`
+    Password string `json:"password"`
+}
+
+var errInvalidResetToken = errors.New("invalid or expired reset token")
+
+// sendPasswordReset issues a fresh reset token for user, voiding older ones,
+// and mails the link.
+func sendPasswordReset(db *gorm.DB, mailer Mailer, appURL string, user User) error {
+    raw := randomHex(32)
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&PasswordResetToken{}).
+            Where("user_id = ? AND used_at IS NULL", user.ID).
+            Update("used_at", time.Now()).Error; err != nil {
+            return err
+        }
+        return tx.Create(&PasswordResetToken{
+            UserID:    user.ID,
+            TokenHash: hashToken(raw),
+            ExpiresAt: time.Now().Add(passwordResetTTL),
+        }).Error
+    })
+    if err != nil {
+        return err
+    }
+
+    link := strings.TrimRight(appURL, "/") + "/reset-password?token=" + raw
+    ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+    defer cancel()
+    return mailer.Send(ctx, Mail{
+        To:      user.Email,
+        Subject: "Kinoform: восстановление пароля",
+        Text: fmt.Sprintf("Здравствуйте, %s!\n\nЧтобы задать новый пароль, перейдите по ссылке:\n%s\n\n"+
+            "Ссылка действует %d минут и может быть использована один раз. "+
+            "Если вы не запрашивали восстановление, просто проигнорируйте это письмо.\n",
+            user.Name, link, int(passwordResetTTL.Minutes())),
+    })
+}
+
+func forgotPasswordHandler(db *gorm.DB, mailer Mailer, appURL string, limiter RateLimiter, logger *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req ForgotPasswordRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        email := strings.TrimSpace(strings.ToLower(req.Email))
+        if email == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "email is required"})
+            return
+        }
+        if !checkRateLimit(c, limiter, logger, "forgot-password:email:"+email, 3, time.Hour) {
+            return
+        }
+
+        // The answer is identical whether or not the account exists so the
+        // endpoint cannot be used to enumerate registered emails; the lookup
+        // and the mail happen in the background so timing gives nothing away
+        // either.
+        go func() {
+            var user User
+            if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+                return
+            }
+            if err := sendPasswordReset(db, mailer, appURL, user); err != nil {
+                logger.Warn("failed to send password reset", zap.Uint("user_id", user.ID), zap.Error(err))
+            }
+        }()
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
+
+func resetPasswordHandler(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req ResetPasswordRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        token := strings.TrimSpace(req.Token)
+        password := strings.TrimSpace(req.Password)
+        if token == "" || password == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "token and password are required"})
+            return
+        }
+        if len(password) < 6 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "password must be at least 6 characters"})
+            return
+        }
+
+        hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update password"})
+            return
+        }
+
+        err = db.Transaction(func(tx *gorm.DB) error {
+            var reset PasswordResetToken
+            if err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), time.Now()).
+                First(&reset).Error; err != nil {
+                return errInvalidResetToken
+            }
+            res := tx.Model(&PasswordResetToken{}).Where("id = ? AND used_at IS NULL", reset.ID).Update("used_at", time.Now())
+            if res.Error != nil {
+                return res.Error
+            }
+            if res.RowsAffected == 0 {
+                return errInvalidResetToken
+            }
+            if err := tx.Model(&User{}).Where("id = ?", reset.UserID).Update("password_hash", string(hash)).Error; err != nil {
+                return err
+            }
+            return revokeAllTokens(tx, reset.UserID)
+        })
+        if errors.Is(err, errInvalidResetToken) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update password"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
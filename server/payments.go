@@ -0,0 +1,289 @@
+
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+)
+
+const (
+    PaymentEventAuthorized = "payment.authorized"
+    PaymentEventSucceeded  = "payment.succeeded"
+    PaymentEventFailed     = "payment.failed"
+)
+
+// PaymentProvider is implemented by every payment gateway integration.
+// Money is only considered received when VerifyWebhook yields a
+// PaymentEventSucceeded event for the intent.
+type PaymentProvider interface {
+    Name() string
+    CreateIntent(ctx context.Context, amount int, currency, reference string) (PaymentIntent, error)
+    Capture(ctx context.Context, intentID string) error
+    // Void releases an authorization that was never captured. It succeeds
+    // when there is nothing left to release: the intent was never paid, is
+    // already voided, or was captured, in which case the succeeded webhook
+    // settles it.
+    Void(ctx context.Context, intentID string) error
+    // Refund must be idempotent per key: repeating a call with the same key
+    // returns the first result without moving money again.
+    Refund(ctx context.Context, intentID string, amount int, key string) (string, error)
+    VerifyWebhook(payload []byte, signature string) (PaymentEvent, error)
+}
+
+type PaymentIntent struct {
+    ID           string
+    ClientSecret string
+    CheckoutURL  string
+}
+
+type PaymentEvent struct {
+    Type     string `json:"type"`
+    IntentID string `json:"intent_id"`
+    Amount   int    `json:"amount"`
+}
+
+type Payment struct {
+    ID             uint      `gorm:"primaryKey" json:"id"`
+    BookingID      uint      `gorm:"index" json:"booking_id"`
+    Provider       string    `json:"provider"`
+    IntentID       string    `gorm:"uniqueIndex" json:"intent_id"`
+    ClientSecret   string    `json:"client_secret,omitempty"`
+    CheckoutURL    string    `json:"checkout_url,omitempty"`
+    Amount         int       `json:"amount"`
+    Currency       string    `json:"currency"`
+    Status         string    `json:"status"`
+    RefundedAmount int       `json:"refunded_amount"`
+    VoidPending    bool      `gorm:"not null;default:false" json:"-"`
+    CreatedAt      time.Time `json:"created_at"`
+    UpdatedAt      time.Time `json:"updated_at"`
+}
+
+var (
+    errPaymentAmountMismatch   = errors.New("event amount does not match the payment")
+    errUnknownPaymentProvider  = errors.New("unknown payment provider")
+    errPaymentProviderRequired = errors.New("PAYMENT_PROVIDER is required, e.g. PAYMENT_PROVIDER=mock for development")
+)
+
+func newPaymentProvider(cfg Config) (PaymentProvider, error) {
+    switch cfg.PaymentProvider {
+    case "":
+        return nil, errPaymentProviderRequired
+    case "mock":
+        return NewMockPaymentProvider(cfg.PaymentWebhookSecret, cfg.PaymentWebhookURL), nil
+    default:
+        return nil, fmt.Errorf("%w: %s", errUnknownPaymentProvider, cfg.PaymentProvider)
+    }
+}
+
+// startPayment opens a payment intent for a freshly created booking. When
+// the provider refuses, the booking is cancelled so its seats are released.
+func startPayment(db *gorm.DB, provider PaymentProvider, currency string, booking Booking) (Payment, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+    defer cancel()
+    intent, err := provider.CreateIntent(ctx, booking.TotalPrice, currency, fmt.Sprintf("booking-%d", booking.ID))
+    if err != nil {
+        _ = db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Model(&booking).Update("status", "cancelled").Error; err != nil {
+                return err
+            }
+            return releaseBookingSeats(tx, booking.ID)
+        })
+        return Payment{}, err
+    }
+    payment := Payment{
+        BookingID:    booking.ID,
+        Provider:     provider.Name(),
+        IntentID:     intent.ID,
+        ClientSecret: intent.ClientSecret,
+        CheckoutURL:  intent.CheckoutURL,
+        Amount:       booking.TotalPrice,
+        Currency:     currency,
+        Status:       "pending",
+    }
+    if err := db.Create(&payment).Error; err != nil {
+        return Payment{}, err
+    }
+    return payment, nil
+}
+
+func paymentWebhook(db *gorm.DB, provider PaymentProvider, logger *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        payload, err := io.ReadAll(c.Request.Body)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        event, err := provider.VerifyWebhook(payload, c.GetHeader("X-Payment-Signature"))
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid signature"})
+            return
+        }
+
+        var payment Payment
+        if err := db.Where("provider = ? AND intent_id = ?", provider.Name(), event.IntentID).First(&payment).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "payment not found"})
+            return
+        }
+
+        if event.Amount != payment.Amount {
+            logger.Warn("payment event amount mismatch", zap.String("intent_id", payment.IntentID),
+                zap.Int("event_amount", event.Amount), zap.Int("amount", payment.Amount))
+            c.JSON(http.StatusBadRequest, gin.H{"error": errPaymentAmountMismatch.Error()})
+            return
+        }
+
+        switch event.Type {
+        case PaymentEventAuthorized:
+            if payment.Status != "pending" {
+                break
+            }
+            // The payment stays pending until the capture goes through, so a
+            // redelivered event retries a failed capture.
+            if err := provider.Capture(c.Request.Context(), payment.IntentID); err != nil {
+                logger.Warn("failed to capture payment", zap.String("intent_id", payment.IntentID), zap.Error(err))
+                c.JSON(http.StatusBadGateway, gin.H{"error": "failed to capture payment"})
+                return
+            }
+            // The succeeded event may already have been applied meanwhile.
+            if err := db.Model(&Payment{}).Where("id = ? AND status = ?", payment.ID, "pending").
+                Update("status", "authorized").Error; err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update payment"})
+                return
+            }
+        case PaymentEventSucceeded:
+            if err := applyPaymentSucceeded(db, provider, payment, logger); err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update payment"})
+                return
+            }
+        case PaymentEventFailed:
+            if payment.Status == "succeeded" || payment.Status == "refunded" {
+                break
+            }
+            err := db.Transaction(func(tx *gorm.DB) error {
+                if err := tx.Model(&payment).Update("status", "failed").Error; err != nil {
+                    return err
+                }
+                res := tx.Model(&Booking{}).
+                    Where("id = ? AND status = ?", payment.BookingID, "pending_payment").
+                    Update("status", "cancelled")
+                if res.Error != nil {
+                    return res.Error
+                }
+                if res.RowsAffected == 0 {
+                    return nil
+                }
+                return releaseBookingSeats(tx, payment.BookingID)
+            })
+            if err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update payment"})
+                return
+            }
+        default:
+            c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported event"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
+
+// applyPaymentSucceeded confirms the booking behind a captured payment. A
+// payment that arrives after its booking was already cancelled (e.g. it
+// timed out) is refunded straight away instead of reviving the booking.
+func applyPaymentSucceeded(db *gorm.DB, provider PaymentProvider, payment Payment, logger *zap.Logger) error {
+    if payment.Status == "succeeded" || payment.Status == "refunded" {
+        return nil
+    }
+    var confirmed bool
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&payment).Update("status", "succeeded").Error; err != nil {
+            return err
+        }
+        res := tx.Model(&Booking{}).
+            Where("id = ? AND status = ?", payment.BookingID, "pending_payment").
+            Update("status", "confirmed")
+        confirmed = res.RowsAffected > 0
+        return res.Error
+    })
+    if err != nil || confirmed {
+        return err
+    }
+
+    if err := db.Model(&Booking{}).Where("id = ? AND refund_status = ?", payment.BookingID, "").
+        Updates(map[string]interface{}{"refund_amount": payment.Amount, "refund_status": RefundPending}).Error; err != nil {
+        return err
+    }
+    if err := processRefund(db, provider, payment.BookingID); err != nil {
+        logger.Warn("failed to refund late payment", zap.String("intent_id", payment.IntentID), zap.Error(err))
+    }
+    return nil
+}
+
+// runPaymentSweeper cancels bookings whose payment never completed so their
+// seats return to sale, and voids their authorizations at the provider so
+// the customer's funds are released.
+func runPaymentSweeper(db *gorm.DB, provider PaymentProvider, logger *zap.Logger, timeout, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        var stale []uint
+        if err := db.Model(&Booking{}).
+            Where("status = ? AND created_at <= ?", "pending_payment", time.Now().Add(-timeout)).
+            Pluck("id", &stale).Error; err != nil {
+            logger.Warn("failed to load unpaid bookings", zap.Error(err))
+            continue
+        }
+        for _, bookingID := range stale {
+            err := db.Transaction(func(tx *gorm.DB) error {
+                res := tx.Model(&Booking{}).
+                    Where("id = ? AND status = ?", bookingID, "pending_payment").
+                    Update("status", "cancelled")
+                if res.Error != nil || res.RowsAffected == 0 {
+                    return res.Error
+                }
+                if err := tx.Model(&Payment{}).
+                    Where("booking_id = ? AND status IN ?", bookingID, []string{"pending", "authorized"}).
+                    Updates(map[string]interface{}{"status": "expired", "void_pending": true}).Error; err != nil {
+                    return err
+                }
+                return releaseBookingSeats(tx, bookingID)
+            })
+            if err != nil {
+                logger.Warn("failed to expire unpaid booking", zap.Uint("booking_id", bookingID), zap.Error(err))
+            }
+        }
+        if len(stale) > 0 {
+            logger.Info("expired unpaid bookings", zap.Int("count", len(stale)))
+        }
+        voidPayments(db, provider, logger)
+    }
+}
+
+// voidPayments releases the authorizations of payments that were expired or
+// cancelled before capture. A failed void stays flagged for the next sweep.
+func voidPayments(db *gorm.DB, provider PaymentProvider, logger *zap.Logger) {
+    var payments []Payment
+    if err := db.Where("void_pending = ? AND provider = ?", true, provider.Name()).Find(&payments).Error; err != nil {
+        logger.Warn("failed to load payments to void", zap.Error(err))
+        return
+    }
+    for _, payment := range payments {
+        ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+        err := provider.Void(ctx, payment.IntentID)
+        cancel()
+        if err != nil {
+            logger.Warn("failed to void payment", zap.String("intent_id", payment.IntentID), zap.Error(err))
+            continue
+        }
+        if err := db.Model(&payment).Update("void_pending", false).Error; err != nil {
+            logger.Warn("failed to update voided payment", zap.String("intent_id", payment.IntentID), zap.Error(err))
+        }
+    }
+}
@@ -0,0 +1,247 @@
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// MockPaymentProvider is an in-memory gateway for local development and
+// tests. Intents are settled either programmatically via Simulate or through
+// the stand-in HTTP endpoints under /mock-gateway; in both cases a signed
+// webhook is produced exactly like a real gateway would send it.
+type MockPaymentProvider struct {
+    secret     []byte
+    webhookURL string
+    client     *http.Client
+
+    mu      sync.Mutex
+    intents map[string]*MockIntent
+    refunds map[string]string
+}
+
+type MockIntent struct {
+    ID       string `json:"id"`
+    Amount   int    `json:"amount"`
+    Currency string `json:"currency"`
+    Status   string `json:"status"`
+    Refunded int    `json:"refunded"`
+}
+
+func NewMockPaymentProvider(secret []byte, webhookURL string) *MockPaymentProvider {
+    return &MockPaymentProvider{
+        secret:     secret,
+        webhookURL: webhookURL,
+        client:     &http.Client{Timeout: 10 * time.Second},
+        intents:    map[string]*MockIntent{},
+        refunds:    map[string]string{},
+    }
+}
+
+func (m *MockPaymentProvider) Name() string {
+    return "mock"
+}
+
+func (m *MockPaymentProvider) CreateIntent(_ context.Context, amount int, currency, reference string) (PaymentIntent, error) {
+    if amount <= 0 {
+        return PaymentIntent{}, errors.New("amount must be positive")
+    }
+    id := "mock_pi_" + randomHex(12)
+    m.mu.Lock()
+    m.intents[id] = &MockIntent{ID: id, Amount: amount, Currency: currency, Status: "requires_payment"}
+    m.mu.Unlock()
+    return PaymentIntent{
+        ID:           id,
+        ClientSecret: id + "_secret_" + randomHex(8),
+        CheckoutURL:  "/mock-gateway/intents/" + id,
+    }, nil
+}
+
+func (m *MockPaymentProvider) Capture(_ context.Context, intentID string) error {
+    m.mu.Lock()
+    intent, ok := m.intents[intentID]
+    if !ok {
+        m.mu.Unlock()
+        return errors.New("intent not found")
+    }
+    if intent.Status != "authorized" {
+        m.mu.Unlock()
+        return fmt.Errorf("cannot capture intent in status %s", intent.Status)
+    }
+    intent.Status = "succeeded"
+    event := PaymentEvent{Type: PaymentEventSucceeded, IntentID: intent.ID, Amount: intent.Amount}
+    m.mu.Unlock()
+
+    // Like real gateways, capture confirmation arrives asynchronously.
+    go m.deliver(event)
+    return nil
+}
+
+func (m *MockPaymentProvider) Void(_ context.Context, intentID string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    intent, ok := m.intents[intentID]
+    if !ok {
+        // Intents do not survive a restart and hold no funds afterwards.
+        return nil
+    }
+    if intent.Status == "requires_payment" || intent.Status == "authorized" {
+        intent.Status = "voided"
+    }
+    return nil
+}
+
+func (m *MockPaymentProvider) Refund(_ context.Context, intentID string, amount int, key string) (string, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if id, ok := m.refunds[key]; ok {
+        return id, nil
+    }
+    intent, ok := m.intents[intentID]
+    if !ok {
+        return "", errors.New("intent not found")
+    }
+    if intent.Status != "succeeded" {
+        return "", fmt.Errorf("cannot refund intent in status %s", intent.Status)
+    }
+    if amount <= 0 || intent.Refunded+amount > intent.Amount {
+        return "", errors.New("invalid refund amount")
+    }
+    intent.Refunded += amount
+    id := "mock_re_" + randomHex(12)
+    m.refunds[key] = id
+    return id, nil
+}
+
+func (m *MockPaymentProvider) VerifyWebhook(payload []byte, signature string) (PaymentEvent, error) {
+    expected := m.sign(payload)
+    if !hmac.Equal([]byte(expected), []byte(signature)) {
+        return PaymentEvent{}, errors.New("invalid signature")
+    }
+    var event PaymentEvent
+    if err := json.Unmarshal(payload, &event); err != nil {
+        return PaymentEvent{}, err
+    }
+    return event, nil
+}
+
+// Simulate settles an intent as the customer would on the gateway page.
+// outcome is "authorize", "succeed" or "fail". The returned payload and
+// signature are what gets delivered to the webhook URL.
+func (m *MockPaymentProvider) Simulate(intentID, outcome string) ([]byte, string, error) {
+    m.mu.Lock()
+    intent, ok := m.intents[intentID]
+    if !ok {
+        m.mu.Unlock()
+        return nil, "", errors.New("intent not found")
+    }
+    if intent.Status != "requires_payment" {
+        m.mu.Unlock()
+        return nil, "", fmt.Errorf("intent already %s", intent.Status)
+    }
+    event := PaymentEvent{IntentID: intent.ID, Amount: intent.Amount}
+    switch outcome {
+    case "authorize":
+        intent.Status = "authorized"
+        event.Type = PaymentEventAuthorized
+    case "succeed":
+        intent.Status = "succeeded"
+        event.Type = PaymentEventSucceeded
+    case "fail":
+        intent.Status = "failed"
+        event.Type = PaymentEventFailed
+    default:
+        m.mu.Unlock()
+        return nil, "", errors.New("unknown outcome")
+    }
+    m.mu.Unlock()
+
+    payload, _ := json.Marshal(event)
+    return payload, m.sign(payload), nil
+}
+
+func (m *MockPaymentProvider) Intent(intentID string) (MockIntent, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    intent, ok := m.intents[intentID]
+    if !ok {
+        return MockIntent{}, false
+    }
+    return *intent, true
+}
+
+func (m *MockPaymentProvider) sign(payload []byte) string {
+    mac := hmac.New(sha256.New, m.secret)
+    mac.Write(payload)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *MockPaymentProvider) deliver(event PaymentEvent) error {
+    if m.webhookURL == "" {
+        return nil
+    }
+    payload, _ := json.Marshal(event)
+    req, err := http.NewRequest(http.MethodPost, m.webhookURL, bytes.NewReader(payload))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Payment-Signature", m.sign(payload))
+    resp, err := m.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+    }
+    return nil
+}
+
+func mockGatewayIntent(mock *MockPaymentProvider) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        intent, ok := mock.Intent(c.Param("id"))
+        if !ok {
+            c.JSON(http.StatusNotFound, gin.H{"error": "intent not found"})
+            return
+        }
+        c.JSON(http.StatusOK, intent)
+    }
+}
+
+func mockGatewaySettle(mock *MockPaymentProvider) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        payload, _, err := mock.Simulate(c.Param("id"), c.Param("outcome"))
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        var event PaymentEvent
+        _ = json.Unmarshal(payload, &event)
+        if err := mock.deliver(event); err != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "failed to deliver webhook"})
+            return
+        }
+        c.JSON(http.StatusOK, event)
+    }
+}
+
+func randomHex(n int) string {
+    buf := make([]byte, n)
+    if _, err := rand.Read(buf); err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(buf)
+}
@@ -0,0 +1,179 @@
+
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+)
+
+// RateLimiter counts hits per key in fixed windows. Allow records a hit and
+// reports whether the key is still within limit; when it is not, the returned
+// duration tells the client how long to back off.
+type RateLimiter interface {
+    Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error)
+}
+
+func newRateLimiter(backend string, db *gorm.DB) (RateLimiter, error) {
+    switch backend {
+    case "", "memory":
+        return NewMemoryRateLimiter(), nil
+    case "postgres":
+        return &PostgresRateLimiter{db: db}, nil
+    default:
+        return nil, fmt.Errorf("unknown rate limit backend %q", backend)
+    }
+}
+
+type rateWindow struct {
+    start time.Time
+    count int
+}
+
+// MemoryRateLimiter keeps counters in process; it is enough for a single
+// replica and for tests.
+type MemoryRateLimiter struct {
+    mu        sync.Mutex
+    windows   map[string]*rateWindow
+    lastPrune time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+    return &MemoryRateLimiter{windows: map[string]*rateWindow{}, lastPrune: time.Now()}
+}
+
+func (l *MemoryRateLimiter) Allow(_ context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+    now := time.Now()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if now.Sub(l.lastPrune) > time.Hour {
+        for k, w := range l.windows {
+            if now.Sub(w.start) > 24*time.Hour {
+                delete(l.windows, k)
+            }
+        }
+        l.lastPrune = now
+    }
+
+    w, ok := l.windows[key]
+    if !ok || now.Sub(w.start) >= window {
+        w = &rateWindow{start: now}
+        l.windows[key] = w
+    }
+    w.count++
+    if w.count > limit {
+        return false, w.start.Add(window).Sub(now), nil
+    }
+    return true, 0, nil
+}
+
+// RateLimitBucket backs PostgresRateLimiter so that every replica shares the
+// same counters.
+type RateLimitBucket struct {
+    Key         string    `gorm:"primaryKey"`
+    Count       int       `gorm:"not null"`
+    WindowStart time.Time `gorm:"not null;index"`
+}
+
+type PostgresRateLimiter struct {
+    db *gorm.DB
+}
+
+func (l *PostgresRateLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+    now := time.Now()
+    expired := now.Add(-window)
+    var bucket RateLimitBucket
+    // A single upsert keeps the increment atomic across replicas.
+    err := l.db.WithContext(ctx).Raw(`INSERT INTO rate_limit_buckets (key, count, window_start) VALUES (?, 1, ?)
+        ON CONFLICT (key) DO UPDATE SET
+            count = CASE WHEN rate_limit_buckets.window_start <= ? THEN 1 ELSE rate_limit_buckets.count + 1 END,
+            window_start = CASE WHEN rate_limit_buckets.window_start <= ? THEN EXCLUDED.window_start ELSE rate_limit_buckets.window_start END
+        RETURNING key, count, window_start`, key, now, expired, expired).Scan(&bucket).Error
+    if err != nil {
+        return false, 0, err
+    }
+    if bucket.Count > limit {
+        return false, bucket.WindowStart.Add(window).Sub(now), nil
+    }
+    return true, 0, nil
+}
+
+func runRateLimitSweeper(db *gorm.DB, logger *zap.Logger, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if err := db.Where("window_start <= ?", time.Now().Add(-24*time.Hour)).Delete(&RateLimitBucket{}).Error; err != nil {
+            logger.Warn("failed to purge rate limit buckets", zap.Error(err))
+        }
+    }
+}
+
+func respondTooManyRequests(c *gin.Context, retryAfter time.Duration, message string) {
+    seconds := int(math.Ceil(retryAfter.Seconds()))
+    if seconds < 1 {
+        seconds = 1
+    }
+    c.Header("Retry-After", strconv.Itoa(seconds))
+    c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": message, "retry_after": seconds})
+}
+
+// checkRateLimit applies limiter to key and answers 429 when exceeded. Limiter
+// failures are logged and let the request through rather than locking
+// everyone out.
+func checkRateLimit(c *gin.Context, limiter RateLimiter, logger *zap.Logger, key string, limit int, window time.Duration) bool {
+    ok, retryAfter, err := limiter.Allow(c.Request.Context(), key, limit, window)
+    if err != nil {
+        logger.Warn("rate limiter unavailable", zap.String("key", key), zap.Error(err))
+        return true
+    }
+    if !ok {
+        respondTooManyRequests(c, retryAfter, "too many requests")
+        return false
+    }
+    return true
+}
+
+// rateLimitByIP limits requests per client IP for one route.
+func rateLimitByIP(limiter RateLimiter, logger *zap.Logger, name string, limit int, window time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !checkRateLimit(c, limiter, logger, name+":ip:"+c.ClientIP(), limit, window) {
+            return
+        }
+        c.Next()
+    }
+}
+
+// loginDelay is the progressive pause enforced between failed attempts:
+// nothing for the first two, then 2s, 4s, 8s... capped at 256s so a high
+// LOGIN_MAX_ATTEMPTS cannot overflow the shift.
+func loginDelay(failures int) time.Duration {
+    if failures < 3 {
+        return 0
+    }
+    exp := failures - 2
+    if exp > 8 {
+        exp = 8
+    }
+    return time.Duration(1<<uint(exp)) * time.Second
+}
+
+// recordLoginFailure bumps the failure counter and locks the account once it
+// reaches the configured threshold. The increment happens in the UPDATE
+// itself so parallel guesses are all counted.
+func recordLoginFailure(db *gorm.DB, user User, maxAttempts int, lockout time.Duration) error {
+    now := time.Now()
+    return db.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+        "failed_logins":        gorm.Expr("CASE WHEN failed_logins + 1 >= ? THEN 0 ELSE failed_logins + 1 END", maxAttempts),
+        "locked_until":         gorm.Expr("CASE WHEN failed_logins + 1 >= ? THEN ? ELSE locked_until END", maxAttempts, now.Add(lockout)),
+        "last_failed_login_at": now,
+    }).Error
+}
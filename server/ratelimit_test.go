@@ -0,0 +1,135 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+    ctx := context.Background()
+
+    t.Run("allows up to the limit", func(t *testing.T) {
+        l := NewMemoryRateLimiter()
+        for i := 1; i <= 3; i++ {
+            ok, _, err := l.Allow(ctx, "k", 3, time.Minute)
+            if err != nil || !ok {
+                t.Fatalf("hit %d: ok = %v, err = %v", i, ok, err)
+            }
+        }
+        ok, retryAfter, err := l.Allow(ctx, "k", 3, time.Minute)
+        if err != nil || ok {
+            t.Fatalf("hit 4: ok = %v, err = %v", ok, err)
+        }
+        if retryAfter <= 0 || retryAfter > time.Minute {
+            t.Errorf("retry after = %v, want within the window", retryAfter)
+        }
+    })
+
+    t.Run("keys are independent", func(t *testing.T) {
+        l := NewMemoryRateLimiter()
+        if ok, _, _ := l.Allow(ctx, "a", 1, time.Minute); !ok {
+            t.Fatal("first hit on a was refused")
+        }
+        if ok, _, _ := l.Allow(ctx, "b", 1, time.Minute); !ok {
+            t.Error("b was limited by hits on a")
+        }
+        if ok, _, _ := l.Allow(ctx, "a", 1, time.Minute); ok {
+            t.Error("second hit on a was allowed")
+        }
+    })
+
+    t.Run("window resets", func(t *testing.T) {
+        l := NewMemoryRateLimiter()
+        window := 20 * time.Millisecond
+        l.Allow(ctx, "k", 1, window)
+        if ok, _, _ := l.Allow(ctx, "k", 1, window); ok {
+            t.Fatal("second hit in the window was allowed")
+        }
+        time.Sleep(window + 5*time.Millisecond)
+        if ok, _, _ := l.Allow(ctx, "k", 1, window); !ok {
+            t.Error("hit after the window was refused")
+        }
+    })
+
+    t.Run("stale windows are pruned", func(t *testing.T) {
+        l := NewMemoryRateLimiter()
+        l.windows["old"] = &rateWindow{start: time.Now().Add(-25 * time.Hour), count: 9}
+        l.lastPrune = time.Now().Add(-2 * time.Hour)
+        l.Allow(ctx, "new", 1, time.Minute)
+        if _, ok := l.windows["old"]; ok {
+            t.Error("window older than a day was kept")
+        }
+    })
+}
+
+func TestNewRateLimiter(t *testing.T) {
+    cases := []struct {
+        backend string
+        wantErr bool
+    }{
+        {"", false},
+        {"memory", false},
+        {"postgres", false},
+        {"redis", true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.backend, func(t *testing.T) {
+            _, err := newRateLimiter(tc.backend, nil)
+            if (err != nil) != tc.wantErr {
+                t.Errorf("err = %v, want error %v", err, tc.wantErr)
+            }
+        })
+    }
+}
+
+func TestLoginDelay(t *testing.T) {
+    cases := []struct {
+        failures int
+        want     time.Duration
+    }{
+        {0, 0},
+        {2, 0},
+        {3, 2 * time.Second},
+        {4, 4 * time.Second},
+        {10, 256 * time.Second},
+        {11, 256 * time.Second},
+        {1000, 256 * time.Second},
+    }
+    for _, tc := range cases {
+        if got := loginDelay(tc.failures); got != tc.want {
+            t.Errorf("loginDelay(%d) = %v, want %v", tc.failures, got, tc.want)
+        }
+    }
+}
+
+func TestRespondTooManyRequests(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    cases := []struct {
+        name       string
+        retryAfter time.Duration
+        want       string
+    }{
+        {"rounds up", 1500 * time.Millisecond, "2"},
+        {"whole seconds", 30 * time.Second, "30"},
+        {"at least one second", 0, "1"},
+        {"negative", -time.Second, "1"},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            w := httptest.NewRecorder()
+            c, _ := gin.CreateTestContext(w)
+            respondTooManyRequests(c, tc.retryAfter, "slow down")
+            if w.Code != http.StatusTooManyRequests {
+                t.Errorf("status = %d, want 429", w.Code)
+            }
+            if got := w.Header().Get("Retry-After"); got != tc.want {
+                t.Errorf("Retry-After = %s, want %s", got, tc.want)
+            }
+        })
+    }
+}
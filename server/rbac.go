@@ -0,0 +1,414 @@
+
+package main
+
+import (
+    "errors"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    PermAll            = "*"
+    PermMoviesManage   = "movies.manage"
+    PermHallsManage    = "halls.manage"
+    PermSessionsManage = "sessions.manage"
+    PermBookingsManage = "bookings.manage"
+    PermBookingsSell   = "bookings.sell"
+    PermCheckin        = "checkin"
+    PermUsersManage    = "users.manage"
+    PermRolesManage    = "roles.manage"
+    PermPricingManage  = "pricing.manage"
+)
+
+var allPermissions = []string{
+    PermMoviesManage,
+    PermHallsManage,
+    PermSessionsManage,
+    PermBookingsManage,
+    PermBookingsSell,
+    PermCheckin,
+    PermUsersManage,
+    PermRolesManage,
+    PermPricingManage,
+}
+
+const RoleSuperAdmin = "super_admin"
+
+// builtinRoles are created on startup when missing. Admins may change their
+// permissions afterwards; only super_admin is pinned to the wildcard.
+var builtinRoles = map[string]struct {
+    Description string
+    Permissions []string
+}{
+    RoleSuperAdmin:    {"Full access", []string{PermAll}},
+    "cashier":         {"Box office sales and door check-in", []string{PermBookingsSell, PermCheckin}},
+    "content_manager": {"Movie catalogue", []string{PermMoviesManage}},
+    "scheduler":       {"Session programming and pricing", []string{PermSessionsManage, PermPricingManage}},
+}
+
+type Role struct {
+    ID          uint             `gorm:"primaryKey" json:"id"`
+    Name        string           `gorm:"uniqueIndex" json:"name"`
+    Description string           `json:"description"`
+    Permissions []RolePermission `json:"permissions"`
+    CreatedAt   time.Time        `json:"created_at"`
+}
+
+type RolePermission struct {
+    RoleID     uint   `gorm:"primaryKey" json:"-"`
+    Permission string `gorm:"primaryKey" json:"permission"`
+}
+
+type UserRole struct {
+    UserID    uint      `gorm:"primaryKey" json:"user_id"`
+    RoleID    uint      `gorm:"primaryKey" json:"role_id"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+type RoleRequest struct {
+    Name        string   `json:"name"`
+    Description string   `json:"description"`
+    Permissions []string `json:"permissions"`
+}
+
+type AssignRoleRequest struct {
+    Role string `json:"role"`
+}
+
+var errUnknownPermission = errors.New("unknown permission")
+
+func seedRoles(db *gorm.DB) error {
+    for name, def := range builtinRoles {
+        var role Role
+        err := db.Where("name = ?", name).First(&role).Error
+        if err == nil {
+            if name == RoleSuperAdmin {
+                if err := db.Where("role_id = ?", role.ID).Delete(&RolePermission{}).Error; err != nil {
+                    return err
+                }
+                if err := db.Create(&RolePermission{RoleID: role.ID, Permission: PermAll}).Error; err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+        if !errors.Is(err, gorm.ErrRecordNotFound) {
+            return err
+        }
+        role = Role{Name: name, Description: def.Description}
+        for _, perm := range def.Permissions {
+            role.Permissions = append(role.Permissions, RolePermission{Permission: perm})
+        }
+        if err := db.Create(&role).Error; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func grantRole(db *gorm.DB, userID uint, roleName string) error {
+    var role Role
+    if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+        return err
+    }
+    return db.Where(UserRole{UserID: userID, RoleID: role.ID}).FirstOrCreate(&UserRole{}).Error
+}
+
+// backfillAdminRoles turns the legacy IsAdmin flag into a super_admin grant.
+// From then on roles alone decide access and is_admin merely mirrors the
+// super_admin role for display.
+func backfillAdminRoles(db *gorm.DB) error {
+    return runBackfill(db, "users-is-admin-role", func(tx *gorm.DB) error {
+        return tx.Exec(`INSERT INTO user_roles (user_id, role_id, created_at)
+            SELECT users.id, roles.id, NOW() FROM users, roles
+            WHERE users.is_admin AND roles.name = ?
+            ON CONFLICT DO NOTHING`, RoleSuperAdmin).Error
+    })
+}
+
+// userPermissions resolves the effective permission set of a user from the
+// roles granted to them.
+func userPermissions(db *gorm.DB, userID uint) (map[string]bool, error) {
+    var user User
+    if err := db.Select("id").First(&user, userID).Error; err != nil {
+        return nil, err
+    }
+    perms := map[string]bool{}
+    var names []string
+    if err := db.Model(&RolePermission{}).
+        Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+        Where("user_roles.user_id = ?", userID).
+        Pluck("role_permissions.permission", &names).Error; err != nil {
+        return nil, err
+    }
+    for _, name := range names {
+        perms[name] = true
+    }
+    return perms, nil
+}
+
+func hasPermission(perms map[string]bool, perm string) bool {
+    return perms[PermAll] || perms[perm]
+}
+
+func permissionList(perms map[string]bool) []string {
+    if perms[PermAll] {
+        return append([]string{PermAll}, allPermissions...)
+    }
+    list := make([]string, 0, len(perms))
+    for perm := range perms {
+        list = append(list, perm)
+    }
+    sort.Strings(list)
+    return list
+}
+
+// requirePermission lets the request through only when the authenticated
+// user holds every listed permission.
+func requirePermission(db *gorm.DB, required ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        perms, err := userPermissions(db, c.GetUint("user_id"))
+        if err != nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+            return
+        }
+        for _, perm := range required {
+            if !hasPermission(perms, perm) {
+                c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "permission required: " + perm})
+                return
+            }
+        }
+        c.Set("permissions", perms)
+        c.Next()
+    }
+}
+
+func validatePermissions(perms []string) ([]string, error) {
+    // The wildcard is reserved for the built-in super_admin role.
+    known := map[string]bool{}
+    for _, perm := range allPermissions {
+        known[perm] = true
+    }
+    seen := map[string]bool{}
+    out := make([]string, 0, len(perms))
+    for _, perm := range perms {
+        perm = strings.TrimSpace(perm)
+        if !known[perm] {
+            return nil, errUnknownPermission
+        }
+        if !seen[perm] {
+            seen[perm] = true
+            out = append(out, perm)
+        }
+    }
+    return out, nil
+}
+
+func listPermissions() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.JSON(http.StatusOK, allPermissions)
+    }
+}
+
+func listRoles(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var roles []Role
+        if err := db.Preload("Permissions").Order("name asc").Find(&roles).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load roles"})
+            return
+        }
+        c.JSON(http.StatusOK, roles)
+    }
+}
+
+func createRole(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req RoleRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        name := strings.ToLower(strings.TrimSpace(req.Name))
+        if name == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+            return
+        }
+        perms, err := validatePermissions(req.Permissions)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        role := Role{Name: name, Description: strings.TrimSpace(req.Description)}
+        for _, perm := range perms {
+            role.Permissions = append(role.Permissions, RolePermission{Permission: perm})
+        }
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Create(&role).Error; err != nil {
+                return err
+            }
+            return recordAudit(tx, c.GetUint("user_id"), "role.create", "role", role.ID, "", gin.H{"name": name, "permissions": perms})
+        })
+        if err != nil {
+            c.JSON(http.StatusConflict, gin.H{"error": "role already exists"})
+            return
+        }
+        c.JSON(http.StatusCreated, role)
+    }
+}
+
+func updateRole(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req RoleRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        var role Role
+        if err := db.First(&role, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+            return
+        }
+        if role.Name == RoleSuperAdmin {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "super_admin cannot be changed"})
+            return
+        }
+        perms, err := validatePermissions(req.Permissions)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if desc := strings.TrimSpace(req.Description); desc != "" {
+                if err := tx.Model(&role).Update("description", desc).Error; err != nil {
+                    return err
+                }
+            }
+            if err := tx.Where("role_id = ?", role.ID).Delete(&RolePermission{}).Error; err != nil {
+                return err
+            }
+            for _, perm := range perms {
+                if err := tx.Create(&RolePermission{RoleID: role.ID, Permission: perm}).Error; err != nil {
+                    return err
+                }
+            }
+            return recordAudit(tx, c.GetUint("user_id"), "role.update", "role", role.ID, "", gin.H{"permissions": perms})
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update role"})
+            return
+        }
+        if err := db.Preload("Permissions").First(&role, role.ID).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+            return
+        }
+        c.JSON(http.StatusOK, role)
+    }
+}
+
+func listUserRoles(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        roles := make([]Role, 0)
+        if err := db.Preload("Permissions").
+            Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+            Where("user_roles.user_id = ?", c.Param("id")).
+            Order("roles.name asc").Find(&roles).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load roles"})
+            return
+        }
+        c.JSON(http.StatusOK, roles)
+    }
+}
+
+func assignUserRole(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req AssignRoleRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        var user User
+        if err := db.First(&user, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        var role Role
+        if err := db.Where("name = ?", strings.ToLower(strings.TrimSpace(req.Role))).First(&role).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+            return
+        }
+        if role.Name == RoleSuperAdmin && !hasPermission(c.MustGet("permissions").(map[string]bool), PermAll) {
+            c.JSON(http.StatusForbidden, gin.H{"error": "only super admins can grant super_admin"})
+            return
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Where(UserRole{UserID: user.ID, RoleID: role.ID}).FirstOrCreate(&UserRole{}).Error; err != nil {
+                return err
+            }
+            if role.Name == RoleSuperAdmin {
+                if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("is_admin", true).Error; err != nil {
+                    return err
+                }
+            }
+            if !user.TwoFactorEnabled {
+                // New staff must enroll in 2FA before using their sessions again.
+                if err := revokeAllTokens(tx, user.ID); err != nil {
+                    return err
+                }
+            }
+            return recordAudit(tx, c.GetUint("user_id"), "user.role.assign", "user", user.ID, "", gin.H{"role": role.Name})
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to assign role"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
+
+func revokeUserRole(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var role Role
+        if err := db.First(&role, c.Param("role_id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+            return
+        }
+        if role.Name == RoleSuperAdmin && !hasPermission(c.MustGet("permissions").(map[string]bool), PermAll) {
+            c.JSON(http.StatusForbidden, gin.H{"error": "only super admins can revoke super_admin"})
+            return
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            res := tx.Where("user_id = ? AND role_id = ?", c.Param("id"), role.ID).Delete(&UserRole{})
+            if res.Error != nil {
+                return res.Error
+            }
+            if res.RowsAffected == 0 {
+                return gorm.ErrRecordNotFound
+            }
+            userID := c.GetUint("user_id")
+            var target User
+            if err := tx.Select("id").First(&target, c.Param("id")).Error; err != nil {
+                return err
+            }
+            if role.Name == RoleSuperAdmin {
+                if err := tx.Model(&User{}).Where("id = ?", target.ID).Update("is_admin", false).Error; err != nil {
+                    return err
+                }
+            }
+            return recordAudit(tx, userID, "user.role.revoke", "user", target.ID, "", gin.H{"role": role.Name})
+        })
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user does not have this role"})
+            return
+        }
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke role"})
+            return
+        }
+        c.Status(http.StatusNoContent)
+    }
+}
@@ -0,0 +1,305 @@
+
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// RefundRule grants Percent of the ticket price back when a booking is
+// cancelled at least Before ahead of the session start.
+type RefundRule struct {
+    Before  time.Duration `json:"before"`
+    Percent int           `json:"percent"`
+}
+
+// CancellationPolicy holds refund rules ordered from the most generous
+// (longest notice) to the least. Cancelling with less notice than the last
+// rule is still allowed but refunds nothing; cancelling after the session
+// has started is refused.
+type CancellationPolicy struct {
+    Rules []RefundRule
+}
+
+const defaultCancellationPolicy = "24h:100,2h:50"
+
+var (
+    errSessionStarted   = errors.New("session already started")
+    errBookingNotActive = errors.New("booking already cancelled")
+    errRefundFailed     = errors.New("refund failed")
+)
+
+// parseCancellationPolicy reads rules in the "24h:100,2h:50" format used by
+// the CANCELLATION_POLICY variable.
+func parseCancellationPolicy(raw string) (CancellationPolicy, error) {
+    raw = strings.TrimSpace(raw)
+    if raw == "" {
+        raw = defaultCancellationPolicy
+    }
+    var policy CancellationPolicy
+    for _, part := range strings.Split(raw, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        pieces := strings.SplitN(part, ":", 2)
+        if len(pieces) != 2 {
+            return CancellationPolicy{}, fmt.Errorf("invalid policy rule %q", part)
+        }
+        before, err := time.ParseDuration(strings.TrimSpace(pieces[0]))
+        if err != nil || before < 0 {
+            return CancellationPolicy{}, fmt.Errorf("invalid policy notice %q", pieces[0])
+        }
+        percent, err := strconv.Atoi(strings.TrimSpace(pieces[1]))
+        if err != nil || percent < 0 || percent > 100 {
+            return CancellationPolicy{}, fmt.Errorf("invalid policy percent %q", pieces[1])
+        }
+        policy.Rules = append(policy.Rules, RefundRule{Before: before, Percent: percent})
+    }
+    sort.Slice(policy.Rules, func(i, j int) bool {
+        return policy.Rules[i].Before > policy.Rules[j].Before
+    })
+    return policy, nil
+}
+
+// RefundPercent returns the share of the price refunded when cancelling at
+// now for a session starting at start.
+func (p CancellationPolicy) RefundPercent(start, now time.Time) (int, error) {
+    if !now.Before(start) {
+        return 0, errSessionStarted
+    }
+    notice := start.Sub(now)
+    for _, rule := range p.Rules {
+        if notice >= rule.Before {
+            return rule.Percent, nil
+        }
+    }
+    return 0, nil
+}
+
+type AuditLog struct {
+    ID         uint      `gorm:"primaryKey" json:"id"`
+    ActorID    uint      `gorm:"index" json:"actor_id"`
+    Action     string    `gorm:"index" json:"action"`
+    EntityType string    `gorm:"index:idx_audit_entity" json:"entity_type"`
+    EntityID   uint      `gorm:"index:idx_audit_entity" json:"entity_id"`
+    Reason     string    `json:"reason"`
+    Details    string    `json:"details"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+func recordAudit(tx *gorm.DB, actorID uint, action, entityType string, entityID uint, reason string, details interface{}) error {
+    entry := AuditLog{
+        ActorID:    actorID,
+        Action:     action,
+        EntityType: entityType,
+        EntityID:   entityID,
+        Reason:     reason,
+    }
+    if details != nil {
+        raw, err := json.Marshal(details)
+        if err != nil {
+            return err
+        }
+        entry.Details = string(raw)
+    }
+    return tx.Create(&entry).Error
+}
+
+// refundableAmount is what the customer actually paid and has not got back
+// yet; bookings without a settled payment have nothing to refund.
+func refundableAmount(tx *gorm.DB, bookingID uint) (Payment, int, error) {
+    var payment Payment
+    err := tx.Where("booking_id = ? AND status IN ?", bookingID, []string{"succeeded", "partially_refunded"}).
+        Order("id desc").First(&payment).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return Payment{}, 0, nil
+    }
+    if err != nil {
+        return Payment{}, 0, err
+    }
+    return payment, payment.Amount - payment.RefundedAmount, nil
+}
+
+const (
+    RefundPending    = "pending"
+    RefundProcessing = "processing"
+    RefundRefunded   = "refunded"
+    RefundFailed     = "failed"
+
+    // refundLease is how long a refund may stay "processing" before another
+    // worker assumes the first one died and retries it.
+    refundLease       = 5 * time.Minute
+    maxRefundAttempts = 10
+)
+
+// refundKey is the idempotency key for a booking's refund. A booking is
+// refunded at most once, so retries after a crash or a lost response can
+// never pay out twice.
+func refundKey(bookingID uint) string {
+    return fmt.Sprintf("booking-%d-refund", bookingID)
+}
+
+// cancelWithRefund cancels an active booking, releases its seats and then
+// pays back refund through the provider. The cancellation commits first with
+// refund_status "pending" and the provider is only called afterwards, so a
+// rollback can never leave money refunded for a booking that is still
+// active. A failed refund keeps the booking cancelled and is retried by
+// runRefundSweeper; the conditional status update keeps two concurrent
+// cancellations from refunding twice.
+func cancelWithRefund(db *gorm.DB, provider PaymentProvider, bookingID uint, refund int, reason string, extra func(tx *gorm.DB) error) error {
+    err := db.Transaction(func(tx *gorm.DB) error {
+        return cancelBookingTx(tx, bookingID, refund, reason, extra)
+    })
+    if err != nil {
+        return err
+    }
+    // The refund is owed from here on; failures are retried by the sweeper.
+    _ = processRefund(db, provider, bookingID)
+    return nil
+}
+
+// cancelBookingTx is the transactional half of cancelWithRefund. Callers
+// that cancel inside a larger transaction use it directly and leave the
+// refund to processRefund after commit.
+func cancelBookingTx(tx *gorm.DB, bookingID uint, refund int, reason string, extra func(tx *gorm.DB) error) error {
+    now := time.Now()
+    res := tx.Model(&Booking{}).
+        Where("id = ? AND status IN ?", bookingID, []string{"confirmed", "pending_payment"}).
+        Updates(map[string]interface{}{"status": "cancelled", "cancelled_at": now, "cancel_reason": reason})
+    if res.Error != nil {
+        return res.Error
+    }
+    if res.RowsAffected == 0 {
+        return errBookingNotActive
+    }
+    if err := releaseBookingSeats(tx, bookingID); err != nil {
+        return err
+    }
+    if err := tx.Model(&Payment{}).
+        Where("booking_id = ? AND status IN ?", bookingID, []string{"pending", "authorized"}).
+        Updates(map[string]interface{}{"status": "cancelled", "void_pending": true}).Error; err != nil {
+        return err
+    }
+
+    _, available, err := refundableAmount(tx, bookingID)
+    if err != nil {
+        return err
+    }
+    if refund > available {
+        refund = available
+    }
+    if refund < 0 {
+        refund = 0
+    }
+    status := ""
+    if refund > 0 {
+        status = RefundPending
+    }
+    if err := tx.Model(&Booking{}).Where("id = ?", bookingID).
+        Updates(map[string]interface{}{"refund_amount": refund, "refund_status": status}).Error; err != nil {
+        return err
+    }
+    if extra != nil {
+        return extra(tx)
+    }
+    return nil
+}
+
+// processRefund pays out a booking's pending refund. It claims the refund
+// with a conditional update so only one worker calls the provider at a time,
+// and records the result in a transaction keyed on the same claim.
+func processRefund(db *gorm.DB, provider PaymentProvider, bookingID uint) error {
+    now := time.Now()
+    res := db.Model(&Booking{}).
+        Where("id = ? AND (refund_status = ? OR (refund_status = ? AND refund_attempted_at < ?))",
+            bookingID, RefundPending, RefundProcessing, now.Add(-refundLease)).
+        Updates(map[string]interface{}{
+            "refund_status":       RefundProcessing,
+            "refund_attempted_at": now,
+            "refund_attempts":     gorm.Expr("refund_attempts + 1"),
+        })
+    if res.Error != nil {
+        return res.Error
+    }
+    if res.RowsAffected == 0 {
+        return nil
+    }
+    var booking Booking
+    if err := db.First(&booking, bookingID).Error; err != nil {
+        return err
+    }
+    payment, available, err := refundableAmount(db, bookingID)
+    if err != nil {
+        return err
+    }
+    amount := booking.RefundAmount
+    if amount > available {
+        amount = available
+    }
+
+    // Counter sales are paid back in cash by the cashier, not the provider.
+    if amount > 0 && payment.Provider != boxOfficeProvider {
+        ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+        defer cancel()
+        if _, err := provider.Refund(ctx, payment.IntentID, amount, refundKey(bookingID)); err != nil {
+            status := RefundPending
+            if booking.RefundAttempts >= maxRefundAttempts {
+                status = RefundFailed
+            }
+            db.Model(&Booking{}).Where("id = ? AND refund_status = ?", bookingID, RefundProcessing).
+                Updates(map[string]interface{}{"refund_status": status, "refund_error": err.Error()})
+            return fmt.Errorf("%w: %v", errRefundFailed, err)
+        }
+    }
+
+    return db.Transaction(func(tx *gorm.DB) error {
+        res := tx.Model(&Booking{}).Where("id = ? AND refund_status = ?", bookingID, RefundProcessing).
+            Updates(map[string]interface{}{"refund_status": RefundRefunded, "refund_amount": amount, "refund_error": ""})
+        if res.Error != nil || res.RowsAffected == 0 || amount == 0 {
+            return res.Error
+        }
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, payment.ID).Error; err != nil {
+            return err
+        }
+        status := "partially_refunded"
+        if payment.RefundedAmount+amount >= payment.Amount {
+            status = "refunded"
+        }
+        return tx.Model(&payment).Updates(map[string]interface{}{
+            "status":          status,
+            "refunded_amount": payment.RefundedAmount + amount,
+        }).Error
+    })
+}
+
+// runRefundSweeper retries refunds that failed or whose worker died
+// mid-flight.
+func runRefundSweeper(db *gorm.DB, provider PaymentProvider, logger *zap.Logger, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        var due []uint
+        if err := db.Model(&Booking{}).
+            Where("refund_status = ? OR (refund_status = ? AND refund_attempted_at < ?)", RefundPending, RefundProcessing, time.Now().Add(-refundLease)).
+            Pluck("id", &due).Error; err != nil {
+            logger.Warn("failed to load pending refunds", zap.Error(err))
+            continue
+        }
+        for _, bookingID := range due {
+            if err := processRefund(db, provider, bookingID); err != nil {
+                logger.Warn("failed to refund booking", zap.Uint("booking_id", bookingID), zap.Error(err))
+            }
+        }
+    }
+}
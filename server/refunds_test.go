@@ -0,0 +1,95 @@
+package main
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestParseCancellationPolicy(t *testing.T) {
+    cases := []struct {
+        name    string
+        raw     string
+        want    []RefundRule
+        wantErr bool
+    }{
+        {"empty uses the default", "", []RefundRule{{24 * time.Hour, 100}, {2 * time.Hour, 50}}, false},
+        {"blank uses the default", "   ", []RefundRule{{24 * time.Hour, 100}, {2 * time.Hour, 50}}, false},
+        {"rules are sorted by notice", "2h:50, 48h:100 ,24h:75", []RefundRule{{48 * time.Hour, 100}, {24 * time.Hour, 75}, {2 * time.Hour, 50}}, false},
+        {"empty parts are skipped", "24h:100,,", []RefundRule{{24 * time.Hour, 100}}, false},
+        {"zero notice and percent", "0s:0", []RefundRule{{0, 0}}, false},
+        {"full percent range", "1h:0,2h:100", []RefundRule{{2 * time.Hour, 100}, {time.Hour, 0}}, false},
+        {"missing percent", "24h", nil, true},
+        {"bad duration", "1d:100", nil, true},
+        {"negative notice", "-1h:100", nil, true},
+        {"percent above 100", "24h:101", nil, true},
+        {"negative percent", "24h:-5", nil, true},
+        {"non-numeric percent", "24h:all", nil, true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            policy, err := parseCancellationPolicy(tc.raw)
+            if tc.wantErr {
+                if err == nil {
+                    t.Fatalf("expected an error, got %+v", policy.Rules)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if !reflect.DeepEqual(policy.Rules, tc.want) {
+                t.Errorf("rules = %+v, want %+v", policy.Rules, tc.want)
+            }
+        })
+    }
+}
+
+func TestRefundPercent(t *testing.T) {
+    policy, err := parseCancellationPolicy("24h:100,2h:50")
+    if err != nil {
+        t.Fatal(err)
+    }
+    start := time.Date(2030, 3, 1, 19, 0, 0, 0, time.UTC)
+
+    cases := []struct {
+        name    string
+        notice  time.Duration
+        want    int
+        started bool
+    }{
+        {"well ahead", 72 * time.Hour, 100, false},
+        {"exactly the first rule", 24 * time.Hour, 100, false},
+        {"just under the first rule", 24*time.Hour - time.Second, 50, false},
+        {"exactly the last rule", 2 * time.Hour, 50, false},
+        {"less than the last rule", time.Hour, 0, false},
+        {"a moment before the start", time.Nanosecond, 0, false},
+        {"at the start", 0, 0, true},
+        {"after the start", -time.Minute, 0, true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            got, err := policy.RefundPercent(start, start.Add(-tc.notice))
+            if tc.started {
+                if !errors.Is(err, errSessionStarted) {
+                    t.Fatalf("expected errSessionStarted, got %d, %v", got, err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if got != tc.want {
+                t.Errorf("refund = %d%%, want %d%%", got, tc.want)
+            }
+        })
+    }
+
+    t.Run("no rules refund nothing", func(t *testing.T) {
+        got, err := CancellationPolicy{}.RefundPercent(start, start.Add(-72*time.Hour))
+        if err != nil || got != 0 {
+            t.Errorf("refund = %d%%, %v; want 0%%", got, err)
+        }
+    })
+}
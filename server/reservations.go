@@ -0,0 +1,103 @@
+
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// SessionSeat is the single source of truth for seat occupancy. The unique
+// (session_id, seat_id) index lets Postgres arbitrate concurrent purchases:
+// a row belongs either to a live hold or to an active booking.
+type SessionSeat struct {
+    ID        uint      `gorm:"primaryKey" json:"id"`
+    SessionID uint      `gorm:"not null;uniqueIndex:idx_session_seat" json:"session_id"`
+    SeatID    uint      `gorm:"not null;uniqueIndex:idx_session_seat" json:"seat_id"`
+    BookingID *uint     `gorm:"index" json:"booking_id"`
+    HoldID    *uint     `gorm:"index" json:"hold_id"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// SeatConflictError reports seats that are already taken for a session.
+type SeatConflictError struct {
+    SeatIDs []uint
+}
+
+func (e *SeatConflictError) Error() string {
+    return "seats already booked"
+}
+
+// claimSeats reserves seats of a session for either a booking or a hold.
+// Rows left behind by expired holds are purged first so they never block a
+// purchase while waiting for the sweeper.
+func claimSeats(tx *gorm.DB, sessionID uint, seatIDs []uint, bookingID, holdID *uint) error {
+    if err := tx.Where("session_id = ? AND seat_id IN ? AND hold_id IN (?)", sessionID, seatIDs,
+        tx.Model(&SeatHold{}).Select("id").Where("expires_at <= ?", time.Now())).
+        Delete(&SessionSeat{}).Error; err != nil {
+        return err
+    }
+
+    rows := make([]SessionSeat, 0, len(seatIDs))
+    for _, seatID := range seatIDs {
+        rows = append(rows, SessionSeat{SessionID: sessionID, SeatID: seatID, BookingID: bookingID, HoldID: holdID})
+    }
+    res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+    if res.Error != nil {
+        return res.Error
+    }
+    if res.RowsAffected == int64(len(seatIDs)) {
+        return nil
+    }
+
+    var existing []SessionSeat
+    if err := tx.Where("session_id = ? AND seat_id IN ?", sessionID, seatIDs).Find(&existing).Error; err != nil {
+        return err
+    }
+    conflict := &SeatConflictError{SeatIDs: make([]uint, 0)}
+    for _, row := range existing {
+        if bookingID != nil && row.BookingID != nil && *row.BookingID == *bookingID {
+            continue
+        }
+        if holdID != nil && row.HoldID != nil && *row.HoldID == *holdID {
+            continue
+        }
+        conflict.SeatIDs = append(conflict.SeatIDs, row.SeatID)
+    }
+    if len(conflict.SeatIDs) == 0 {
+        return nil
+    }
+    return conflict
+}
+
+// transferHoldSeats hands the reservations of a hold over to a booking. It
+// fails when some of the seats were lost, e.g. because the hold expired and
+// another customer claimed them in the meantime.
+func transferHoldSeats(tx *gorm.DB, holdID, bookingID uint, seatCount int) error {
+    res := tx.Model(&SessionSeat{}).Where("hold_id = ?", holdID).
+        Updates(map[string]interface{}{"booking_id": bookingID, "hold_id": nil})
+    if res.Error != nil {
+        return res.Error
+    }
+    if res.RowsAffected != int64(seatCount) {
+        return fmt.Errorf("hold no longer covers all seats")
+    }
+    return nil
+}
+
+func releaseBookingSeats(tx *gorm.DB, bookingID uint) error {
+    return tx.Where("booking_id = ?", bookingID).Delete(&SessionSeat{}).Error
+}
+
+// backfillSessionSeats reserves seats for confirmed bookings created before
+// the session_seats table existed. It is idempotent and runs on startup.
+func backfillSessionSeats(db *gorm.DB) error {
+    return db.Exec(`INSERT INTO session_seats (session_id, seat_id, booking_id, created_at)
+        SELECT bookings.session_id, booking_seats.seat_id, bookings.id, NOW()
+        FROM booking_seats
+        JOIN bookings ON bookings.id = booking_seats.booking_id
+        WHERE bookings.status = ?
+        ON CONFLICT DO NOTHING`, "confirmed").Error
+}
@@ -0,0 +1,93 @@
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+// TestConcurrentBookingsClaimSeatOnce fires parallel purchases of the same
+// seat; session_seats must let exactly one through and answer the rest with
+// a 409 naming the seat.
+func TestConcurrentBookingsClaimSeatOnce(t *testing.T) {
+    db := openTestDB(t)
+    gin.SetMode(gin.TestMode)
+    session, seats := testShowing(t, db, 1)
+    seatID := seats[0].ID
+
+    const buyers = 20
+    userIDs := make([]uint, 0, buyers)
+    for i := 0; i < buyers; i++ {
+        user := User{Name: fmt.Sprintf("Buyer %d", i), Email: fmt.Sprintf("buyer%d@example.com", i)}
+        if err := db.Create(&user).Error; err != nil {
+            t.Fatalf("create user: %v", err)
+        }
+        userIDs = append(userIDs, user.ID)
+    }
+
+    router := gin.New()
+    router.POST("/api/bookings", func(c *gin.Context) {
+        id, _ := strconv.Atoi(c.GetHeader("X-Test-User"))
+        c.Set("user_id", uint(id))
+    }, createBooking(db, NewMockPaymentProvider([]byte("test-secret"), ""), "KZT"))
+
+    body := fmt.Sprintf(`{"session_id":%d,"seat_ids":[%d],"payment_method":"card"}`, session.ID, seatID)
+    start := make(chan struct{})
+    results := make([]*httptest.ResponseRecorder, buyers)
+    var wg sync.WaitGroup
+    for i, userID := range userIDs {
+        wg.Add(1)
+        go func(i int, userID uint) {
+            defer wg.Done()
+            req := httptest.NewRequest(http.MethodPost, "/api/bookings", strings.NewReader(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("X-Test-User", strconv.Itoa(int(userID)))
+            rec := httptest.NewRecorder()
+            <-start
+            router.ServeHTTP(rec, req)
+            results[i] = rec
+        }(i, userID)
+    }
+    close(start)
+    wg.Wait()
+
+    created, conflicts := 0, 0
+    for _, rec := range results {
+        switch rec.Code {
+        case http.StatusCreated:
+            created++
+        case http.StatusConflict:
+            conflicts++
+            var resp struct {
+                SeatIDs []uint `json:"seat_ids"`
+            }
+            if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+                t.Fatalf("decode conflict: %v", err)
+            }
+            if len(resp.SeatIDs) != 1 || resp.SeatIDs[0] != seatID {
+                t.Errorf("conflict seat_ids = %v, want [%d] (body %s)", resp.SeatIDs, seatID, rec.Body.String())
+            }
+        default:
+            t.Errorf("unexpected status %d: %s", rec.Code, rec.Body.String())
+        }
+    }
+    if created != 1 || conflicts != buyers-1 {
+        t.Fatalf("got %d created and %d conflicts, want 1 and %d", created, conflicts, buyers-1)
+    }
+
+    var taken int64
+    if err := db.Model(&SessionSeat{}).Where("session_id = ? AND seat_id = ?", session.ID, seatID).Count(&taken).Error; err != nil {
+        t.Fatalf("count session seats: %v", err)
+    }
+    if taken != 1 {
+        t.Fatalf("session_seats rows = %d, want 1", taken)
+    }
+}
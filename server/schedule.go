@@ -0,0 +1,294 @@
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+
+    "kinoform/scheduling"
+)
+
+const maxScheduleDays = 31
+
+type ScheduleMovieRequest struct {
+    MovieID uint `json:"movie_id"`
+    Weight  int  `json:"weight"`
+}
+
+// ScheduleRequest drives the generator. Dates are calendar days and opening
+// and closing are "HH:MM" bounds for session starts; empty hall and movie
+// lists mean all of them. Every generated session gets the same format and
+// languages; without hall_ids only halls equipped for the format are used.
+type ScheduleRequest struct {
+    From             string                   `json:"from"`
+    To               string                   `json:"to"`
+    HallIDs          []uint                   `json:"hall_ids"`
+    Movies           []ScheduleMovieRequest   `json:"movies"`
+    Opening          string                   `json:"opening"`
+    Closing          string                   `json:"closing"`
+    BreakMinutes     int                      `json:"break_minutes"`
+    Pricing          *scheduling.PricingRules `json:"pricing"`
+    Format           string                   `json:"format"`
+    AudioLanguage    string                   `json:"audio_language"`
+    SubtitleLanguage string                   `json:"subtitle_language"`
+    DryRun           bool                     `json:"dry_run"`
+}
+
+type ScheduledSession struct {
+    MovieID          uint      `json:"movie_id"`
+    MovieTitle       string    `json:"movie_title"`
+    HallID           uint      `json:"hall_id"`
+    HallName         string    `json:"hall_name"`
+    StartTime        time.Time `json:"start_time"`
+    EndTime          time.Time `json:"end_time"`
+    BasePrice        int       `json:"base_price"`
+    Format           string    `json:"format"`
+    AudioLanguage    string    `json:"audio_language"`
+    SubtitleLanguage string    `json:"subtitle_language,omitempty"`
+}
+
+// normalizeSessionFormat validates a requested format and languages in
+// place, as createSession does for a single session.
+func normalizeSessionFormat(format, audio, subtitles *string) error {
+    var err error
+    if *format, err = normalizeFormat(*format); err != nil {
+        return err
+    }
+    if *audio, err = normalizeLanguage(*audio); err != nil {
+        return err
+    }
+    *subtitles, err = normalizeLanguage(*subtitles)
+    return err
+}
+
+// parseClock reads "HH:MM" as an offset from midnight.
+func parseClock(raw string, fallback time.Duration) (time.Duration, error) {
+    raw = strings.TrimSpace(raw)
+    if raw == "" {
+        return fallback, nil
+    }
+    t, err := time.Parse("15:04", raw)
+    if err != nil {
+        return 0, fmt.Errorf("invalid time %q, expected HH:MM", raw)
+    }
+    return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// scheduleOptions validates the request against the generator's defaults.
+func scheduleOptions(req ScheduleRequest, loc *time.Location, now time.Time) (scheduling.Options, error) {
+    opts := scheduling.DefaultOptions(now.In(loc))
+    opts.NotBefore = now
+    if req.From != "" {
+        from, err := time.ParseInLocation("2006-01-02", req.From, loc)
+        if err != nil {
+            return opts, errors.New("from must be YYYY-MM-DD")
+        }
+        opts.From = from
+        opts.To = from.AddDate(0, 0, 6)
+    }
+    if req.To != "" {
+        to, err := time.ParseInLocation("2006-01-02", req.To, loc)
+        if err != nil {
+            return opts, errors.New("to must be YYYY-MM-DD")
+        }
+        opts.To = to
+    }
+    if opts.To.Before(opts.From) {
+        return opts, errors.New("to must not be before from")
+    }
+    if opts.To.Sub(opts.From) >= maxScheduleDays*24*time.Hour {
+        return opts, fmt.Errorf("at most %d days can be generated at once", maxScheduleDays)
+    }
+    var err error
+    if opts.Open, err = parseClock(req.Opening, opts.Open); err != nil {
+        return opts, err
+    }
+    if opts.Close, err = parseClock(req.Closing, opts.Close); err != nil {
+        return opts, err
+    }
+    if opts.Close <= opts.Open {
+        return opts, errors.New("closing must be after opening")
+    }
+    if req.BreakMinutes < 0 {
+        return opts, errors.New("break_minutes cannot be negative")
+    }
+    if req.BreakMinutes > 0 {
+        opts.Break = time.Duration(req.BreakMinutes) * time.Minute
+    }
+    if req.Pricing != nil {
+        if req.Pricing.Base <= 0 {
+            return opts, errors.New("pricing.base must be positive")
+        }
+        if req.Pricing.Min < 0 {
+            return opts, errors.New("pricing.min cannot be negative")
+        }
+        opts.Pricing = *req.Pricing
+    }
+    opts.Location = loc
+    return opts, nil
+}
+
+// planSchedule loads the halls, movies and existing sessions the request
+// refers to and runs the generator over them.
+func planSchedule(db *gorm.DB, req ScheduleRequest, opts scheduling.Options) ([]ScheduledSession, error) {
+    var halls []Hall
+    hallQuery := db.Order("id asc")
+    if len(req.HallIDs) > 0 {
+        hallQuery = hallQuery.Where("id IN ?", req.HallIDs)
+    }
+    if err := hallQuery.Find(&halls).Error; err != nil {
+        return nil, err
+    }
+    if len(req.HallIDs) > 0 && len(halls) != len(req.HallIDs) {
+        return nil, errHallNotFound
+    }
+    capable := halls[:0]
+    for _, h := range halls {
+        switch {
+        case h.supportsFormat(req.Format):
+            capable = append(capable, h)
+        case len(req.HallIDs) > 0:
+            return nil, fmt.Errorf("%w: %s cannot show %s", errHallFormatUnsupported, h.Name, req.Format)
+        }
+    }
+    halls = capable
+
+    weights := map[uint]int{}
+    movieIDs := make([]uint, 0, len(req.Movies))
+    for _, m := range req.Movies {
+        weights[m.MovieID] = m.Weight
+        movieIDs = append(movieIDs, m.MovieID)
+    }
+    var movies []Movie
+    movieQuery := db.Order("id asc")
+    if len(movieIDs) > 0 {
+        movieQuery = movieQuery.Where("id IN ?", movieIDs)
+    }
+    if err := movieQuery.Find(&movies).Error; err != nil {
+        return nil, err
+    }
+    if len(movieIDs) > 0 && len(movies) != len(weights) {
+        return nil, errMovieNotFound
+    }
+    if len(halls) == 0 || len(movies) == 0 {
+        return []ScheduledSession{}, nil
+    }
+
+    planHalls := make([]scheduling.Hall, 0, len(halls))
+    hallsByID := make(map[uint]Hall, len(halls))
+    hallIDs := make([]uint, 0, len(halls))
+    for _, h := range halls {
+        planHalls = append(planHalls, scheduling.Hall{ID: h.ID, Cleaning: time.Duration(h.CleaningMinutes) * time.Minute})
+        hallsByID[h.ID] = h
+        hallIDs = append(hallIDs, h.ID)
+    }
+    planMovies := make([]scheduling.Movie, 0, len(movies))
+    moviesByID := make(map[uint]Movie, len(movies))
+    for _, m := range movies {
+        planMovies = append(planMovies, scheduling.Movie{ID: m.ID, DurationMins: m.DurationMins, Weight: weights[m.ID]})
+        moviesByID[m.ID] = m
+    }
+
+    // Sessions already in these halls block their time plus the hall's
+    // cleaning buffer, exactly as checkSessionSlot will see them.
+    var existing []Session
+    if err := db.Preload("Movie").
+        Where("hall_id IN ? AND status <> ? AND start_time >= ? AND start_time < ?", hallIDs, SessionCancelled, opts.From.Add(-24*time.Hour), opts.To.AddDate(0, 0, 2)).
+        Find(&existing).Error; err != nil {
+        return nil, err
+    }
+    busy := make([]scheduling.Busy, 0, len(existing))
+    for _, s := range existing {
+        cleaning := time.Duration(hallsByID[s.HallID].CleaningMinutes) * time.Minute
+        busy = append(busy, scheduling.Busy{HallID: s.HallID, Start: s.StartTime, End: s.StartTime.Add(movieRuntime(s.Movie.DurationMins) + cleaning)})
+    }
+
+    slots := scheduling.Generate(planHalls, planMovies, busy, opts)
+    plan := make([]ScheduledSession, 0, len(slots))
+    for _, slot := range slots {
+        plan = append(plan, ScheduledSession{
+            MovieID:          slot.MovieID,
+            MovieTitle:       moviesByID[slot.MovieID].Title,
+            HallID:           slot.HallID,
+            HallName:         hallsByID[slot.HallID].Name,
+            StartTime:        slot.Start,
+            EndTime:          slot.End,
+            BasePrice:        slot.BasePrice,
+            Format:           req.Format,
+            AudioLanguage:    req.AudioLanguage,
+            SubtitleLanguage: req.SubtitleLanguage,
+        })
+    }
+    return plan, nil
+}
+
+// generateSchedule previews (dry_run) or creates a generated schedule. The
+// apply step re-validates every slot and creates all of them in a single
+// transaction, so a concurrent edit rolls the whole batch back.
+func generateSchedule(db *gorm.DB, loc *time.Location) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        // A partial pricing object only overrides the rules it names.
+        pricing := scheduling.DefaultPricing()
+        req := ScheduleRequest{Pricing: &pricing}
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        opts, err := scheduleOptions(req, loc, time.Now())
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if err := normalizeSessionFormat(&req.Format, &req.AudioLanguage, &req.SubtitleLanguage); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        plan, err := planSchedule(db, req, opts)
+        if errors.Is(err, errHallNotFound) || errors.Is(err, errMovieNotFound) || errors.Is(err, errHallFormatUnsupported) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to plan schedule"})
+            return
+        }
+        if req.DryRun || len(plan) == 0 {
+            c.JSON(http.StatusOK, gin.H{"dry_run": req.DryRun, "count": len(plan), "sessions": plan})
+            return
+        }
+
+        created := make([]Session, 0, len(plan))
+        err = db.Transaction(func(tx *gorm.DB) error {
+            for _, item := range plan {
+                if err := checkHallFormat(tx, item.HallID, item.Format); err != nil {
+                    return err
+                }
+                if err := checkSessionSlot(tx, item.HallID, item.MovieID, item.StartTime, 0); err != nil {
+                    return err
+                }
+                session := Session{MovieID: item.MovieID, HallID: item.HallID, StartTime: item.StartTime, BasePrice: item.BasePrice,
+                    Format: item.Format, AudioLanguage: item.AudioLanguage, SubtitleLanguage: item.SubtitleLanguage}
+                if err := tx.Create(&session).Error; err != nil {
+                    return err
+                }
+                created = append(created, session)
+            }
+            return recordAudit(tx, c.GetUint("user_id"), "schedule.generate", "hall", 0, "", gin.H{
+                "from":     opts.From.Format("2006-01-02"),
+                "to":       opts.To.Format("2006-01-02"),
+                "sessions": len(created),
+            })
+        })
+        if err != nil {
+            respondSessionError(c, err, "failed to create sessions")
+            return
+        }
+        c.JSON(http.StatusCreated, gin.H{"dry_run": false, "count": len(created), "sessions": created})
+    }
+}
@@ -0,0 +1,287 @@
+// Package scheduling fills cinema halls with sessions. It is the greedy
+// planner that used to live in cmd/seed_extra: every hall keeps a cursor,
+// the hall that frees up first gets the next film, and each day starts by
+// giving every movie at least one slot before the rest of the day is filled
+// by weight.
+package scheduling
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultDurationMins stands in for movies without a runtime.
+	DefaultDurationMins = 100
+	// DefaultBreak is the pause between two sessions in the same hall.
+	DefaultBreak = 20 * time.Minute
+	// DefaultStagger offsets hall opening times so that not every hall
+	// starts on the same minute.
+	DefaultStagger = 10 * time.Minute
+)
+
+type Hall struct {
+	ID uint
+	// Cleaning is the hall's own turnaround; the larger of it and
+	// Options.Break is used.
+	Cleaning time.Duration
+}
+
+type Movie struct {
+	ID           uint
+	DurationMins int
+	// Weight controls how often the movie is picked when filling a day.
+	// Zero or negative counts as 1.
+	Weight int
+}
+
+// Busy is a time range already taken in a hall, e.g. an existing session
+// including its cleaning time.
+type Busy struct {
+	HallID uint
+	Start  time.Time
+	End    time.Time
+}
+
+// PricingRules reproduces the seed pricing: a base price with a step per
+// hall, surcharges from the afternoon and evening hours, a morning discount
+// and a floor.
+type PricingRules struct {
+	Base               int `json:"base"`
+	HallStep           int `json:"hall_step"`
+	AfternoonHour      int `json:"afternoon_hour"`
+	AfternoonSurcharge int `json:"afternoon_surcharge"`
+	EveningHour        int `json:"evening_hour"`
+	EveningSurcharge   int `json:"evening_surcharge"`
+	MorningBeforeHour  int `json:"morning_before_hour"`
+	MorningDiscount    int `json:"morning_discount"`
+	Min                int `json:"min"`
+}
+
+func DefaultPricing() PricingRules {
+	return PricingRules{
+		Base:               420,
+		HallStep:           20,
+		AfternoonHour:      12,
+		AfternoonSurcharge: 60,
+		EveningHour:        18,
+		EveningSurcharge:   120,
+		MorningBeforeHour:  9,
+		MorningDiscount:    40,
+		Min:                300,
+	}
+}
+
+type Options struct {
+	// From and To are calendar days, both inclusive, in Location.
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+	// Open is the first and Close the last allowed start time, as offsets
+	// from midnight.
+	Open    time.Duration
+	Close   time.Duration
+	Break   time.Duration
+	Stagger time.Duration
+	Pricing PricingRules
+	// NotBefore drops slots starting earlier, typically "now".
+	NotBefore time.Time
+}
+
+// DefaultOptions covers the seed tool's week: 06:00 to 23:00 with 20 minute
+// breaks, starting today.
+func DefaultOptions(now time.Time) Options {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return Options{
+		From:     day,
+		To:       day.AddDate(0, 0, 6),
+		Location: now.Location(),
+		Open:     6 * time.Hour,
+		Close:    23 * time.Hour,
+		Break:    DefaultBreak,
+		Stagger:  DefaultStagger,
+		Pricing:  DefaultPricing(),
+	}
+}
+
+type Slot struct {
+	MovieID   uint
+	HallID    uint
+	Start     time.Time
+	End       time.Time
+	BasePrice int
+}
+
+// Generate plans sessions for halls over the option's days. Busy ranges are
+// never overlapped. The result is ordered by start time, then hall.
+func Generate(halls []Hall, movies []Movie, busy []Busy, opts Options) []Slot {
+	if len(halls) == 0 || len(movies) == 0 {
+		return nil
+	}
+	loc := opts.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	if opts.Break <= 0 {
+		opts.Break = DefaultBreak
+	}
+	if opts.Pricing == (PricingRules{}) {
+		opts.Pricing = DefaultPricing()
+	}
+
+	busyByHall := make(map[uint][]Busy, len(halls))
+	for _, b := range busy {
+		busyByHall[b.HallID] = append(busyByHall[b.HallID], b)
+	}
+	for id := range busyByHall {
+		sort.Slice(busyByHall[id], func(i, j int) bool { return busyByHall[id][i].Start.Before(busyByHall[id][j].Start) })
+	}
+
+	picker := newWeightedPicker(movies)
+	slots := make([]Slot, 0)
+	first := time.Date(opts.From.Year(), opts.From.Month(), opts.From.Day(), 0, 0, 0, 0, loc)
+	last := time.Date(opts.To.Year(), opts.To.Month(), opts.To.Day(), 0, 0, 0, 0, loc)
+	for baseDate := first; !baseDate.After(last); baseDate = baseDate.AddDate(0, 0, 1) {
+		dayStart := baseDate.Add(opts.Open)
+		dayEnd := baseDate.Add(opts.Close)
+		hallCursor := make([]time.Time, len(halls))
+		for i := range halls {
+			hallCursor[i] = dayStart.Add(time.Duration(i) * opts.Stagger)
+		}
+
+		place := func(movie Movie) bool {
+			for {
+				hallIndex := EarliestAvailableHall(hallCursor)
+				startTime := hallCursor[hallIndex]
+				if startTime.After(dayEnd) {
+					return false
+				}
+				hall := halls[hallIndex]
+				gap := opts.Break
+				if hall.Cleaning > gap {
+					gap = hall.Cleaning
+				}
+				end := startTime.Add(SafeDuration(movie.DurationMins))
+				if blocked, until := overlapsBusy(busyByHall[hall.ID], startTime, end.Add(gap)); blocked {
+					hallCursor[hallIndex] = until
+					continue
+				}
+				hallCursor[hallIndex] = end.Add(gap)
+				if startTime.Before(opts.NotBefore) {
+					return true
+				}
+				slots = append(slots, Slot{
+					MovieID:   movie.ID,
+					HallID:    hall.ID,
+					Start:     startTime,
+					End:       end,
+					BasePrice: CalcBasePrice(startTime, hallIndex, opts.Pricing),
+				})
+				return true
+			}
+		}
+
+		// Ensure each movie appears at least once per day across all halls.
+		for _, movie := range movies {
+			if !place(movie) {
+				break
+			}
+		}
+		// Fill the remaining daily slots by weight.
+		for place(picker.next()) {
+		}
+	}
+
+	sort.SliceStable(slots, func(i, j int) bool {
+		if !slots[i].Start.Equal(slots[j].Start) {
+			return slots[i].Start.Before(slots[j].Start)
+		}
+		return slots[i].HallID < slots[j].HallID
+	})
+	return slots
+}
+
+// overlapsBusy reports whether [start, end) hits a busy range and, if so,
+// the end of the latest range it hits.
+func overlapsBusy(busy []Busy, start, end time.Time) (bool, time.Time) {
+	blocked := false
+	var until time.Time
+	for _, b := range busy {
+		if b.Start.Before(end) && start.Before(b.End) {
+			blocked = true
+			if b.End.After(until) {
+				until = b.End
+			}
+		}
+	}
+	return blocked, until
+}
+
+func SafeDuration(minutes int) time.Duration {
+	if minutes <= 0 {
+		minutes = DefaultDurationMins
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func EarliestAvailableHall(cursor []time.Time) int {
+	minIndex := 0
+	for i := 1; i < len(cursor); i++ {
+		if cursor[i].Before(cursor[minIndex]) {
+			minIndex = i
+		}
+	}
+	return minIndex
+}
+
+func CalcBasePrice(start time.Time, hallIndex int, rules PricingRules) int {
+	price := rules.Base + hallIndex*rules.HallStep
+	hour := start.Hour()
+	if hour >= rules.EveningHour {
+		price += rules.EveningSurcharge
+	} else if hour >= rules.AfternoonHour {
+		price += rules.AfternoonSurcharge
+	}
+	if hour < rules.MorningBeforeHour {
+		price -= rules.MorningDiscount
+	}
+	if price < rules.Min {
+		price = rules.Min
+	}
+	return price
+}
+
+// weightedPicker is a smooth weighted round robin: a movie with weight 3
+// comes up three times as often as one with weight 1, spread out evenly.
+type weightedPicker struct {
+	movies  []Movie
+	current []int
+	total   int
+}
+
+func newWeightedPicker(movies []Movie) *weightedPicker {
+	p := &weightedPicker{movies: movies, current: make([]int, len(movies))}
+	for _, m := range movies {
+		p.total += weightOf(m)
+	}
+	return p
+}
+
+func (p *weightedPicker) next() Movie {
+	best := 0
+	for i, m := range p.movies {
+		p.current[i] += weightOf(m)
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.movies[best]
+}
+
+func weightOf(m Movie) int {
+	if m.Weight <= 0 {
+		return 1
+	}
+	return m.Weight
+}
@@ -0,0 +1,178 @@
+package scheduling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	loc := time.FixedZone("ALMT", 5*60*60)
+	day := time.Date(2030, 3, 1, 0, 0, 0, 0, loc)
+	at := func(hour, min int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+	oneDay := func(open, close time.Duration) Options {
+		return Options{From: day, To: day, Location: loc, Open: open, Close: close, Break: 20 * time.Minute}
+	}
+
+	cases := []struct {
+		name   string
+		halls  []Hall
+		movies []Movie
+		busy   []Busy
+		opts   Options
+		check  func(t *testing.T, slots []Slot)
+	}{
+		{
+			name:   "skips busy ranges",
+			halls:  []Hall{{ID: 1}},
+			movies: []Movie{{ID: 1, DurationMins: 90}},
+			busy:   []Busy{{HallID: 1, Start: at(11, 0), End: at(14, 0)}},
+			opts:   oneDay(9*time.Hour, 20*time.Hour),
+			check: func(t *testing.T, slots []Slot) {
+				if len(slots) == 0 {
+					t.Fatal("no slots generated")
+				}
+				resumed := false
+				for _, s := range slots {
+					if s.Start.Before(at(14, 0)) && s.End.Add(20*time.Minute).After(at(11, 0)) {
+						t.Errorf("slot %s-%s overlaps the busy range", s.Start.Format("15:04"), s.End.Format("15:04"))
+					}
+					if s.Start.Equal(at(14, 0)) {
+						resumed = true
+					}
+				}
+				if !resumed {
+					t.Error("expected the hall to be used again right after the busy range")
+				}
+			},
+		},
+		{
+			name:   "busy ranges only block their own hall",
+			halls:  []Hall{{ID: 1}, {ID: 2}},
+			movies: []Movie{{ID: 1, DurationMins: 90}},
+			busy:   []Busy{{HallID: 1, Start: at(9, 0), End: at(21, 0)}},
+			opts:   oneDay(9*time.Hour, 20*time.Hour),
+			check: func(t *testing.T, slots []Slot) {
+				if len(slots) == 0 {
+					t.Fatal("no slots generated")
+				}
+				for _, s := range slots {
+					if s.HallID != 2 {
+						t.Errorf("slot at %s placed in the fully booked hall", s.Start.Format("15:04"))
+					}
+				}
+			},
+		},
+		{
+			name:   "distributes by weight",
+			halls:  []Hall{{ID: 1}},
+			movies: []Movie{{ID: 1, DurationMins: 40, Weight: 3}, {ID: 2, DurationMins: 40, Weight: 1}},
+			// One start per hour from 08:00 to 19:00: each movie once, then
+			// ten picks at 3:1.
+			opts: oneDay(8*time.Hour, 19*time.Hour),
+			check: func(t *testing.T, slots []Slot) {
+				counts := map[uint]int{}
+				for _, s := range slots {
+					counts[s.MovieID]++
+				}
+				if len(slots) != 12 || counts[1] != 9 || counts[2] != 3 {
+					t.Errorf("got %d slots split %v, want 12 split 9:3", len(slots), counts)
+				}
+			},
+		},
+		{
+			name:   "zero weight counts as one",
+			halls:  []Hall{{ID: 1}},
+			movies: []Movie{{ID: 1, DurationMins: 40}, {ID: 2, DurationMins: 40, Weight: -5}},
+			opts:   oneDay(8*time.Hour, 19*time.Hour),
+			check: func(t *testing.T, slots []Slot) {
+				counts := map[uint]int{}
+				for _, s := range slots {
+					counts[s.MovieID]++
+				}
+				if counts[1] != 6 || counts[2] != 6 {
+					t.Errorf("got split %v, want 6:6", counts)
+				}
+			},
+		},
+		{
+			name:   "stays within opening hours",
+			halls:  []Hall{{ID: 1}, {ID: 2, Cleaning: 45 * time.Minute}},
+			movies: []Movie{{ID: 1, DurationMins: 125}, {ID: 2}},
+			opts: Options{
+				From: day, To: day.AddDate(0, 0, 2), Location: loc,
+				Open: 10*time.Hour + 30*time.Minute, Close: 22 * time.Hour,
+				Break: 20 * time.Minute, Stagger: 10 * time.Minute,
+			},
+			check: func(t *testing.T, slots []Slot) {
+				days := map[int]bool{}
+				for _, s := range slots {
+					start := s.Start.In(loc)
+					clock := time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+					if clock < 10*time.Hour+30*time.Minute || clock > 22*time.Hour {
+						t.Errorf("slot starts at %s, outside 10:30-22:00", start.Format("2006-01-02 15:04"))
+					}
+					days[start.Day()] = true
+				}
+				if len(days) != 3 {
+					t.Errorf("slots cover %d days, want 3", len(days))
+				}
+			},
+		},
+		{
+			name:   "drops slots before NotBefore",
+			halls:  []Hall{{ID: 1}},
+			movies: []Movie{{ID: 1, DurationMins: 90}},
+			opts: func() Options {
+				opts := oneDay(9*time.Hour, 20*time.Hour)
+				opts.NotBefore = at(15, 0)
+				return opts
+			}(),
+			check: func(t *testing.T, slots []Slot) {
+				if len(slots) == 0 {
+					t.Fatal("no slots generated")
+				}
+				for _, s := range slots {
+					if s.Start.Before(at(15, 0)) {
+						t.Errorf("slot at %s is before NotBefore", s.Start.Format("15:04"))
+					}
+				}
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			slots := Generate(tc.halls, tc.movies, tc.busy, tc.opts)
+			for i := 1; i < len(slots); i++ {
+				if slots[i].Start.Before(slots[i-1].Start) {
+					t.Fatalf("slots are not ordered by start time")
+				}
+			}
+			tc.check(t, slots)
+		})
+	}
+}
+
+func TestCalcBasePrice(t *testing.T) {
+	rules := DefaultPricing()
+	cases := []struct {
+		hour, hallIndex, want int
+	}{
+		{8, 0, 380},  // morning discount
+		{10, 0, 420}, // base
+		{10, 2, 460}, // hall step
+		{13, 0, 480}, // afternoon
+		{19, 1, 560}, // evening
+	}
+	for _, tc := range cases {
+		start := time.Date(2030, 3, 1, tc.hour, 0, 0, 0, time.UTC)
+		if got := CalcBasePrice(start, tc.hallIndex, rules); got != tc.want {
+			t.Errorf("hour %d hall %d: got %d, want %d", tc.hour, tc.hallIndex, got, tc.want)
+		}
+	}
+	rules.Base, rules.Min = 100, 300
+	if got := CalcBasePrice(time.Date(2030, 3, 1, 8, 0, 0, 0, time.UTC), 0, rules); got != 300 {
+		t.Errorf("floor: got %d, want 300", got)
+	}
+}
@@ -0,0 +1,218 @@
+
+package main
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    SeatStandard   = "standard"
+    SeatVIP        = "vip"
+    SeatCouple     = "couple"
+    SeatWheelchair = "wheelchair"
+    SeatCompanion  = "companion"
+)
+
+// SeatCategory prices a class of seats relative to the session's base price.
+// PriceMultiplier is a percentage: 150 makes a seat cost one and a half times
+// the base price.
+type SeatCategory struct {
+    ID              uint      `gorm:"primaryKey" json:"id"`
+    Code            string    `gorm:"uniqueIndex;not null" json:"code"`
+    Name            string    `json:"name"`
+    NameEN          string    `json:"name_en"`
+    NameKK          string    `json:"name_kk"`
+    PriceMultiplier int       `gorm:"not null;default:100" json:"price_multiplier"`
+    SortOrder       int       `gorm:"not null;default:0" json:"sort_order"`
+    CreatedAt       time.Time `json:"created_at"`
+}
+
+type SeatCategoryRequest struct {
+    Name            string `json:"name"`
+    NameEN          string `json:"name_en"`
+    NameKK          string `json:"name_kk"`
+    PriceMultiplier int    `json:"price_multiplier"`
+    SortOrder       int    `json:"sort_order"`
+}
+
+// SeatRange selects seats by row and number, both inclusive. Zero bounds
+// are open, so {"row_from": 8} means row 8 to the back of the hall.
+type SeatRange struct {
+    RowFrom    int `json:"row_from"`
+    RowTo      int `json:"row_to"`
+    NumberFrom int `json:"number_from"`
+    NumberTo   int `json:"number_to"`
+}
+
+type AssignSeatCategoryRequest struct {
+    Category string      `json:"category"`
+    SeatIDs  []uint      `json:"seat_ids"`
+    Ranges   []SeatRange `json:"ranges"`
+}
+
+var builtinSeatCategories = []SeatCategory{
+    {Code: SeatStandard, Name: "Стандарт", NameEN: "Standard", NameKK: "Стандарт", PriceMultiplier: 100, SortOrder: 1},
+    {Code: SeatVIP, Name: "VIP", NameEN: "VIP", NameKK: "VIP", PriceMultiplier: 150, SortOrder: 2},
+    {Code: SeatCouple, Name: "Диван для двоих", NameEN: "Love seat", NameKK: "Екі орындық диван", PriceMultiplier: 200, SortOrder: 3},
+    {Code: SeatWheelchair, Name: "Место для коляски", NameEN: "Wheelchair space", NameKK: "Арбаға арналған орын", PriceMultiplier: 100, SortOrder: 4},
+    {Code: SeatCompanion, Name: "Место сопровождающего", NameEN: "Companion seat", NameKK: "Алып жүрушінің орны", PriceMultiplier: 100, SortOrder: 5},
+}
+
+var errUnknownSeatCategory = errors.New("unknown seat category")
+
+func seedSeatCategories(db *gorm.DB) error {
+    for _, category := range builtinSeatCategories {
+        category := category
+        if err := db.Where(SeatCategory{Code: category.Code}).FirstOrCreate(&category).Error; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// seatMultipliers maps the given seats to the price multiplier of their
+// category. Seats of an unknown category are charged the base price.
+func seatMultipliers(tx *gorm.DB, seatIDs []uint) (map[uint]int, map[uint]string, error) {
+    var seats []Seat
+    if err := tx.Select("id", "category").Where("id IN ?", seatIDs).Find(&seats).Error; err != nil {
+        return nil, nil, err
+    }
+    var categories []SeatCategory
+    if err := tx.Find(&categories).Error; err != nil {
+        return nil, nil, err
+    }
+    byCode := make(map[string]int, len(categories))
+    for _, category := range categories {
+        byCode[category.Code] = category.PriceMultiplier
+    }
+    multipliers := make(map[uint]int, len(seats))
+    codes := make(map[uint]string, len(seats))
+    for _, seat := range seats {
+        multiplier, ok := byCode[seat.Category]
+        if !ok {
+            multiplier = 100
+        }
+        multipliers[seat.ID] = multiplier
+        codes[seat.ID] = seat.Category
+    }
+    return multipliers, codes, nil
+}
+
+func listSeatCategories(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var categories []SeatCategory
+        if err := db.Order("sort_order asc, id asc").Find(&categories).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load seat categories"})
+            return
+        }
+        c.JSON(http.StatusOK, categories)
+    }
+}
+
+func updateSeatCategory(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var category SeatCategory
+        if err := db.Where("code = ?", c.Param("code")).First(&category).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "seat category not found"})
+            return
+        }
+        var req SeatCategoryRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        if strings.TrimSpace(req.Name) == "" || req.PriceMultiplier <= 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "name and a positive price_multiplier are required"})
+            return
+        }
+        if err := db.Model(&category).Updates(map[string]interface{}{
+            "name":             strings.TrimSpace(req.Name),
+            "name_en":          strings.TrimSpace(req.NameEN),
+            "name_kk":          strings.TrimSpace(req.NameKK),
+            "price_multiplier": req.PriceMultiplier,
+            "sort_order":       req.SortOrder,
+        }).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update seat category"})
+            return
+        }
+        if err := db.First(&category, category.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load seat category"})
+            return
+        }
+        c.JSON(http.StatusOK, category)
+    }
+}
+
+// assignSeatCategory sets the category of a batch of seats in one hall,
+// picked by ID and/or by row and number ranges.
+func assignSeatCategory(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var hall Hall
+        if err := db.First(&hall, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "hall not found"})
+            return
+        }
+        var req AssignSeatCategoryRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        req.Category = strings.ToLower(strings.TrimSpace(req.Category))
+        if len(req.SeatIDs) == 0 && len(req.Ranges) == 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "seat_ids or ranges are required"})
+            return
+        }
+        var count int64
+        if err := db.Model(&SeatCategory{}).Where("code = ?", req.Category).Count(&count).Error; err != nil || count == 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownSeatCategory.Error()})
+            return
+        }
+
+        selector := db.Where("1 = 0")
+        if len(req.SeatIDs) > 0 {
+            selector = selector.Or("id IN ?", req.SeatIDs)
+        }
+        for _, r := range req.Ranges {
+            cond := db.Where("1 = 1")
+            if r.RowFrom > 0 {
+                cond = cond.Where("row >= ?", r.RowFrom)
+            }
+            if r.RowTo > 0 {
+                cond = cond.Where("row <= ?", r.RowTo)
+            }
+            if r.NumberFrom > 0 {
+                cond = cond.Where("number >= ?", r.NumberFrom)
+            }
+            if r.NumberTo > 0 {
+                cond = cond.Where("number <= ?", r.NumberTo)
+            }
+            selector = selector.Or(cond)
+        }
+
+        var updated int64
+        err := db.Transaction(func(tx *gorm.DB) error {
+            result := tx.Model(&Seat{}).Where("hall_id = ? AND removed_at IS NULL", hall.ID).Where(selector).Update("category", req.Category)
+            if result.Error != nil {
+                return result.Error
+            }
+            updated = result.RowsAffected
+            return recordAudit(tx, c.GetUint("user_id"), "hall.seats.category", "hall", hall.ID, "", gin.H{
+                "category": req.Category,
+                "seat_ids": req.SeatIDs,
+                "ranges":   req.Ranges,
+                "updated":  updated,
+            })
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update seats"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"updated": updated})
+    }
+}
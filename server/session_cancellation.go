@@ -0,0 +1,592 @@
+
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+const (
+    SessionScheduled = "scheduled"
+    SessionCancelled = "cancelled"
+)
+
+var (
+    errSessionCancelled   = errors.New("session is cancelled")
+    errSessionHasBookings = errors.New("session has bookings, cancel it instead")
+    errSessionHasHolds    = errors.New("session has seats on hold, try again once they expire")
+)
+
+type CancelSessionRequest struct {
+    Reason            string `json:"reason"`
+    TransferSessionID uint   `json:"transfer_session_id"`
+    Notify            *bool  `json:"notify"`
+}
+
+type AcceptTransferRequest struct {
+    SeatIDs       []uint `json:"seat_ids"`
+    PaymentMethod string `json:"payment_method"`
+}
+
+// SessionTransferOffer invites the owner of a booking on a cancelled session
+// to rebook on another screening of the same movie. The original booking is
+// refunded regardless; accepting the offer is a new purchase of up to Seats
+// seats with the original ticket types.
+type SessionTransferOffer struct {
+    ID            uint       `gorm:"primaryKey" json:"id"`
+    BookingID     uint       `gorm:"uniqueIndex;not null" json:"booking_id"`
+    UserID        uint       `gorm:"index;not null" json:"user_id"`
+    FromSessionID uint       `gorm:"not null" json:"from_session_id"`
+    ToSessionID   uint       `gorm:"index;not null" json:"to_session_id"`
+    Seats         int        `gorm:"not null" json:"seats"`
+    Status        string     `gorm:"size:20;not null;default:open" json:"status"`
+    NewBookingID  *uint      `json:"new_booking_id,omitempty"`
+    CreatedAt     time.Time  `json:"created_at"`
+    AcceptedAt    *time.Time `json:"accepted_at,omitempty"`
+    FromSession   Session    `gorm:"foreignKey:FromSessionID" json:"from_session"`
+    ToSession     Session    `gorm:"foreignKey:ToSessionID" json:"to_session"`
+}
+
+// bookableSession refuses sales for sessions that were called off.
+func bookableSession(session Session) error {
+    if session.Status == SessionCancelled {
+        return errSessionCancelled
+    }
+    return nil
+}
+
+// lockBookableSession re-checks the session inside a sale's transaction,
+// holding its row until commit. cancelSession takes the same lock, so a
+// booking either commits before the session is cancelled, and is then seen
+// by the cancellation worker, or is refused.
+func lockBookableSession(tx *gorm.DB, sessionID uint) error {
+    var session Session
+    if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, sessionID).Error; err != nil {
+        return err
+    }
+    return bookableSession(session)
+}
+
+// SessionCancellation is the background job that cancels the bookings of a
+// called-off session. Refunding and mailing a full hall takes far longer
+// than an HTTP request may, so the handler only queues the job; a worker
+// claims it with a lease and records its progress here.
+type SessionCancellation struct {
+    ID                uint       `gorm:"primaryKey" json:"id"`
+    SessionID         uint       `gorm:"uniqueIndex;not null" json:"session_id"`
+    ActorID           uint       `gorm:"not null" json:"actor_id"`
+    Reason            string     `json:"reason"`
+    TransferSessionID *uint      `json:"transfer_session_id,omitempty"`
+    Notify            bool       `gorm:"not null;default:true" json:"notify"`
+    Status            string     `gorm:"size:20;not null;default:pending;index" json:"status"`
+    LeaseUntil        *time.Time `json:"-"`
+    Cancelled         int        `gorm:"not null;default:0" json:"cancelled"`
+    Failed            int        `gorm:"not null;default:0" json:"failed"`
+    Offers            int        `gorm:"not null;default:0" json:"transfer_offers"`
+    Notified          int        `gorm:"not null;default:0" json:"notified"`
+    Unsent            int        `gorm:"not null;default:0" json:"unsent"`
+    Attempts          int        `gorm:"not null;default:0" json:"attempts"`
+    NextRunAt         *time.Time `json:"next_run_at,omitempty"`
+    LastError         string     `json:"last_error,omitempty"`
+    CreatedAt         time.Time  `json:"created_at"`
+    UpdatedAt         time.Time  `json:"updated_at"`
+    CompletedAt       *time.Time `json:"completed_at,omitempty"`
+}
+
+// SessionCancellationNotice records that the customer of a booking cancelled
+// by a SessionCancellation is owed an email. The row is written together
+// with the cancellation, so a failed mail is retried even though the booking
+// is no longer active.
+type SessionCancellationNotice struct {
+    ID         uint       `gorm:"primaryKey" json:"id"`
+    JobID      uint       `gorm:"index;not null" json:"job_id"`
+    BookingID  uint       `gorm:"uniqueIndex;not null" json:"booking_id"`
+    Attempts   int        `gorm:"not null;default:0" json:"attempts"`
+    LastError  string     `json:"last_error,omitempty"`
+    NotifiedAt *time.Time `json:"notified_at,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+}
+
+const (
+    CancellationPending = "pending"
+    CancellationRunning = "running"
+    CancellationDone    = "done"
+
+    // cancellationLease is how long a worker may hold a job without
+    // reporting progress before another worker takes it over.
+    cancellationLease = 5 * time.Minute
+    // maxNoticeAttempts stops mailing an address that keeps bouncing; the
+    // notice stays unsent with its last error for staff to follow up.
+    maxNoticeAttempts = 10
+)
+
+// cancelSession calls a session off: it is marked cancelled rather than
+// deleted, live holds are dropped and a job is queued that cancels every
+// active booking with a full refund. The request answers 202 straight away;
+// GET /admin/sessions/:id/cancellation reports progress. Calling it again
+// re-queues the job at once, without waiting for its retry delay.
+func cancelSession(db *gorm.DB, worker *sessionCancelWorker) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        actorID := c.GetUint("user_id")
+        var req CancelSessionRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        reason := strings.TrimSpace(req.Reason)
+        if reason == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "reason is required"})
+            return
+        }
+        var session Session
+        if err := db.Preload("Movie").Preload("Hall").First(&session, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+            return
+        }
+
+        if req.TransferSessionID != 0 {
+            var target Session
+            if err := db.First(&target, req.TransferSessionID).Error; err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "transfer session not found"})
+                return
+            }
+            if target.ID == session.ID || target.MovieID != session.MovieID || target.Status == SessionCancelled || !target.StartTime.After(time.Now()) {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "transfer session must be an upcoming screening of the same movie"})
+                return
+            }
+        }
+
+        job := SessionCancellation{
+            SessionID: session.ID,
+            ActorID:   actorID,
+            Reason:    reason,
+            Notify:    req.Notify == nil || *req.Notify,
+            Status:    CancellationPending,
+        }
+        if req.TransferSessionID != 0 {
+            job.TransferSessionID = &req.TransferSessionID
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            now := time.Now()
+            // Waits for sales already in flight; later ones see the new status.
+            var locked Session
+            if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, session.ID).Error; err != nil {
+                return err
+            }
+            res := tx.Model(&Session{}).Where("id = ? AND status <> ?", session.ID, SessionCancelled).
+                Updates(map[string]interface{}{"status": SessionCancelled, "cancelled_at": now, "cancel_reason": reason})
+            if res.Error != nil {
+                return res.Error
+            }
+            if res.RowsAffected > 0 {
+                if err := deleteHolds(tx, tx.Model(&SeatHold{}).Select("id").Where("session_id = ?", session.ID)); err != nil {
+                    return err
+                }
+                details := gin.H{"start_time": session.StartTime}
+                if job.TransferSessionID != nil {
+                    details["transfer_session_id"] = *job.TransferSessionID
+                }
+                if err := recordAudit(tx, actorID, "session.cancel", "session", session.ID, reason, details); err != nil {
+                    return err
+                }
+            }
+            // A repeated call re-queues the job unless a worker is on it.
+            return tx.Clauses(clause.OnConflict{
+                Columns: []clause.Column{{Name: "session_id"}},
+                DoUpdates: clause.Assignments(map[string]interface{}{
+                    "status":       CancellationPending,
+                    "lease_until":  nil,
+                    "next_run_at":  nil,
+                    "attempts":     0,
+                    "completed_at": nil,
+                    "updated_at":   now,
+                }),
+                Where: clause.Where{Exprs: []clause.Expression{
+                    clause.Neq{Column: clause.Column{Table: "session_cancellations", Name: "status"}, Value: CancellationRunning},
+                }},
+            }).Create(&job).Error
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel session"})
+            return
+        }
+        if err := db.Where("session_id = ?", session.ID).First(&job).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load cancellation"})
+            return
+        }
+        go worker.process(job.ID)
+
+        if err := db.Preload("Movie").Preload("Hall").First(&session, session.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load session"})
+            return
+        }
+        c.JSON(http.StatusAccepted, gin.H{"session": session, "cancellation": job})
+    }
+}
+
+func getSessionCancellation(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var job SessionCancellation
+        if err := db.Where("session_id = ?", c.Param("id")).First(&job).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "session is not cancelled"})
+            return
+        }
+        var remaining int64
+        if err := db.Model(&Booking{}).Where("session_id = ? AND status IN ?", job.SessionID, []string{"confirmed", "pending_payment"}).
+            Count(&remaining).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load bookings"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"cancellation": job, "remaining_bookings": remaining})
+    }
+}
+
+// sessionCancelWorker carries out queued SessionCancellation jobs.
+type sessionCancelWorker struct {
+    db       *gorm.DB
+    payments PaymentProvider
+    mailer   Mailer
+    appURL   string
+    loc      *time.Location
+    logger   *zap.Logger
+}
+
+func newSessionCancelWorker(db *gorm.DB, payments PaymentProvider, mailer Mailer, appURL string, loc *time.Location, logger *zap.Logger) *sessionCancelWorker {
+    return &sessionCancelWorker{db: db, payments: payments, mailer: mailer, appURL: appURL, loc: loc, logger: logger}
+}
+
+// run picks up jobs that are due for a retry or whose worker died, e.g.
+// across a restart.
+func (w *sessionCancelWorker) run(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        now := time.Now()
+        var due []uint
+        if err := w.db.Model(&SessionCancellation{}).
+            Where("(status = ? AND (next_run_at IS NULL OR next_run_at <= ?)) OR (status = ? AND lease_until < ?)", CancellationPending, now, CancellationRunning, now).
+            Pluck("id", &due).Error; err != nil {
+            w.logger.Warn("failed to load session cancellations", zap.Error(err))
+            continue
+        }
+        for _, id := range due {
+            w.process(id)
+        }
+    }
+}
+
+// claim takes the job for cancellationLease if it is due and nobody else
+// holds it.
+func (w *sessionCancelWorker) claim(jobID uint) (bool, error) {
+    now := time.Now()
+    res := w.db.Model(&SessionCancellation{}).
+        Where("id = ? AND ((status = ? AND (next_run_at IS NULL OR next_run_at <= ?)) OR (status = ? AND lease_until < ?))", jobID, CancellationPending, now, CancellationRunning, now).
+        Updates(map[string]interface{}{"status": CancellationRunning, "lease_until": now.Add(cancellationLease)})
+    return res.RowsAffected > 0, res.Error
+}
+
+// process cancels the session's remaining active bookings one by one and
+// then mails every customer not yet notified, extending the lease and saving
+// the counters after each step. While bookings or mails keep failing the job
+// goes back to pending with a growing delay instead of finishing.
+func (w *sessionCancelWorker) process(jobID uint) {
+    claimed, err := w.claim(jobID)
+    if err != nil {
+        w.logger.Warn("failed to claim session cancellation", zap.Uint("job_id", jobID), zap.Error(err))
+        return
+    }
+    if !claimed {
+        return
+    }
+    var job SessionCancellation
+    var session Session
+    var transfer *Session
+    err = w.db.First(&job, jobID).Error
+    if err == nil {
+        err = w.db.Preload("Movie").Preload("Hall").First(&session, job.SessionID).Error
+    }
+    if err == nil && job.TransferSessionID != nil {
+        var target Session
+        if err = w.db.Preload("Movie").Preload("Hall").First(&target, *job.TransferSessionID).Error; err == nil {
+            transfer = &target
+        }
+    }
+    if err != nil {
+        w.logger.Warn("failed to load session cancellation", zap.Uint("job_id", jobID), zap.Error(err))
+        job.ID = jobID
+        w.retryLater(job, err.Error())
+        return
+    }
+
+    var bookings []Booking
+    if err := w.db.Preload("Items").
+        Where("session_id = ? AND status IN ?", session.ID, []string{"confirmed", "pending_payment"}).
+        Order("id asc").Find(&bookings).Error; err != nil {
+        w.logger.Warn("failed to load bookings of cancelled session", zap.Uint("session_id", session.ID), zap.Error(err))
+        w.retryLater(job, err.Error())
+        return
+    }
+
+    failed := 0
+    lastError := ""
+    for _, booking := range bookings {
+        offered := false
+        bookingReason := "session cancelled: " + job.Reason
+        err := cancelWithRefund(w.db, w.payments, booking.ID, booking.TotalPrice, bookingReason, func(tx *gorm.DB) error {
+            if transfer != nil && booking.UserID != 0 {
+                if err := tx.Create(&SessionTransferOffer{
+                    BookingID:     booking.ID,
+                    UserID:        booking.UserID,
+                    FromSessionID: session.ID,
+                    ToSessionID:   transfer.ID,
+                    Seats:         len(booking.Items),
+                    Status:        "open",
+                }).Error; err != nil {
+                    return err
+                }
+                offered = true
+            }
+            if job.Notify {
+                if err := tx.Create(&SessionCancellationNotice{JobID: job.ID, BookingID: booking.ID}).Error; err != nil {
+                    return err
+                }
+            }
+            return recordAudit(tx, job.ActorID, "booking.cancel", "booking", booking.ID, bookingReason, gin.H{
+                "refund_amount":  booking.TotalPrice,
+                "session_cancel": true,
+            })
+        })
+        progress := map[string]interface{}{"lease_until": time.Now().Add(cancellationLease)}
+        switch {
+        case errors.Is(err, errBookingNotActive):
+            // Cancelled meanwhile by the customer or the payment sweeper.
+        case err != nil:
+            failed++
+            lastError = fmt.Sprintf("booking %d: %v", booking.ID, err)
+        default:
+            progress["cancelled"] = gorm.Expr("cancelled + 1")
+            if offered {
+                progress["offers"] = gorm.Expr("offers + 1")
+            }
+        }
+        w.db.Model(&SessionCancellation{}).Where("id = ?", jobID).Updates(progress)
+    }
+
+    var notices []SessionCancellationNotice
+    if err := w.db.Where("job_id = ? AND notified_at IS NULL AND attempts < ?", job.ID, maxNoticeAttempts).
+        Order("id asc").Find(&notices).Error; err != nil {
+        w.logger.Warn("failed to load session cancellation notices", zap.Uint("job_id", jobID), zap.Error(err))
+        w.retryLater(job, err.Error())
+        return
+    }
+    unsent := 0
+    for _, notice := range notices {
+        err := w.notify(session, transfer, notice.BookingID)
+        if err != nil {
+            w.logger.Warn("failed to send session cancellation email", zap.Uint("booking_id", notice.BookingID), zap.Error(err))
+            unsent++
+            lastError = fmt.Sprintf("mail for booking %d: %v", notice.BookingID, err)
+            w.db.Model(&notice).Updates(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "last_error": err.Error()})
+        } else {
+            w.db.Model(&notice).Updates(map[string]interface{}{"notified_at": time.Now(), "last_error": ""})
+            w.db.Model(&SessionCancellation{}).Where("id = ?", jobID).Updates(map[string]interface{}{"notified": gorm.Expr("notified + 1")})
+        }
+        w.db.Model(&SessionCancellation{}).Where("id = ?", jobID).Update("lease_until", time.Now().Add(cancellationLease))
+    }
+
+    w.db.Model(&SessionCancellation{}).Where("id = ?", jobID).Updates(map[string]interface{}{"failed": failed, "unsent": unsent})
+    if failed > 0 || unsent > 0 {
+        w.retryLater(job, lastError)
+        return
+    }
+    now := time.Now()
+    if err := w.db.Model(&SessionCancellation{}).Where("id = ?", jobID).Updates(map[string]interface{}{
+        "status":       CancellationDone,
+        "lease_until":  nil,
+        "next_run_at":  nil,
+        "attempts":     0,
+        "last_error":   "",
+        "completed_at": now,
+    }).Error; err != nil {
+        w.logger.Warn("failed to finish session cancellation", zap.Uint("job_id", jobID), zap.Error(err))
+    }
+}
+
+// retryLater hands the job back to the queue, doubling the delay with each
+// failed run up to an hour.
+func (w *sessionCancelWorker) retryLater(job SessionCancellation, lastError string) {
+    delay := time.Hour
+    if job.Attempts < 6 {
+        delay = time.Minute << job.Attempts
+    }
+    if err := w.db.Model(&SessionCancellation{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+        "status":      CancellationPending,
+        "lease_until": nil,
+        "attempts":    gorm.Expr("attempts + 1"),
+        "next_run_at": time.Now().Add(delay),
+        "last_error":  lastError,
+    }).Error; err != nil {
+        w.logger.Warn("failed to requeue session cancellation", zap.Uint("job_id", job.ID), zap.Error(err))
+    }
+}
+
+// notify mails the customer of one cancelled booking, mentioning the
+// transfer offer made for it, if any.
+func (w *sessionCancelWorker) notify(session Session, transfer *Session, bookingID uint) error {
+    var booking Booking
+    if err := w.db.Preload("Guest").First(&booking, bookingID).Error; err != nil {
+        return err
+    }
+    var offer *SessionTransferOffer
+    var found SessionTransferOffer
+    err := w.db.Where("booking_id = ?", bookingID).First(&found).Error
+    switch {
+    case err == nil:
+        offer = &found
+    case !errors.Is(err, gorm.ErrRecordNotFound):
+        return err
+    }
+    return notifySessionCancelled(w.db, w.mailer, w.appURL, w.loc, session, booking, transfer, offer)
+}
+
+// notifySessionCancelled tells the customer their booking was refunded and,
+// when a transfer was offered, where to rebook.
+func notifySessionCancelled(db *gorm.DB, mailer Mailer, appURL string, loc *time.Location, session Session, booking Booking, transfer *Session, offer *SessionTransferOffer) error {
+    to, name := "", ""
+    if booking.UserID != 0 {
+        var user User
+        if err := db.Select("id", "email", "name").First(&user, booking.UserID).Error; err != nil {
+            return err
+        }
+        to, name = user.Email, user.Name
+    } else if booking.Guest != nil {
+        to, name = booking.Guest.Email, booking.Guest.Name
+    }
+    if to == "" {
+        return nil
+    }
+    var b strings.Builder
+    fmt.Fprintf(&b, "Здравствуйте, %s!\n\nК сожалению, сеанс «%s» %s в зале «%s» отменён.\n",
+        name, session.Movie.Title, session.StartTime.In(loc).Format("02.01.2006 15:04"), session.Hall.Name)
+    fmt.Fprintf(&b, "Бронирование №%d аннулировано, оплаченная сумма будет возвращена полностью.\n", booking.ID)
+    if transfer != nil {
+        link := strings.TrimRight(appURL, "/") + fmt.Sprintf("/sessions/%d", transfer.ID)
+        fmt.Fprintf(&b, "\nВы можете выбрать места на другой сеанс этого фильма — %s:\n%s\n",
+            transfer.StartTime.In(loc).Format("02.01.2006 15:04"), link)
+        if offer != nil {
+            b.WriteString("Предложение о переносе также доступно в вашем профиле.\n")
+        }
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+    defer cancel()
+    return mailer.Send(ctx, Mail{
+        To:      to,
+        Subject: fmt.Sprintf("Kinoform: сеанс отменён, бронирование №%d", booking.ID),
+        Text:    b.String(),
+    })
+}
+
+func listMyTransferOffers(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var offers []SessionTransferOffer
+        if err := db.Preload("FromSession.Movie").Preload("ToSession.Movie").Preload("ToSession.Hall").
+            Where("user_id = ?", c.GetUint("user_id")).Order("id desc").Find(&offers).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load transfer offers"})
+            return
+        }
+        c.JSON(http.StatusOK, offers)
+    }
+}
+
+// acceptTransferOffer books seats on the offered session, keeping the ticket
+// types of the cancelled booking in order. Payment then proceeds as for any
+// new booking.
+func acceptTransferOffer(db *gorm.DB, payments PaymentProvider, currency string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.GetUint("user_id")
+        var req AcceptTransferRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        var offer SessionTransferOffer
+        if err := db.Preload("ToSession").Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&offer).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "transfer offer not found"})
+            return
+        }
+        if offer.Status != "open" {
+            c.JSON(http.StatusConflict, gin.H{"error": "transfer offer already used"})
+            return
+        }
+        if !offer.ToSession.StartTime.After(time.Now()) {
+            c.JSON(http.StatusGone, gin.H{"error": "session already started"})
+            return
+        }
+        if len(req.SeatIDs) == 0 || len(req.SeatIDs) > offer.Seats {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("choose between 1 and %d seats", offer.Seats)})
+            return
+        }
+
+        var items []BookingSeat
+        if err := db.Preload("TicketType").Where("booking_id = ?", offer.BookingID).Order("seat_id asc").Find(&items).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load original booking"})
+            return
+        }
+        tickets := make([]TicketSelection, 0, len(req.SeatIDs))
+        for i, seatID := range req.SeatIDs {
+            code := defaultTicketType
+            if i < len(items) && items[i].TicketType != nil {
+                code = items[i].TicketType.Code
+            }
+            tickets = append(tickets, TicketSelection{SeatID: seatID, TicketType: code})
+        }
+        session, selections, ok := loadBookingSession(c, db, BookingRequest{
+            SessionID:     offer.ToSessionID,
+            PaymentMethod: req.PaymentMethod,
+            Tickets:       tickets,
+        })
+        if !ok {
+            return
+        }
+
+        var booking Booking
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var err error
+            booking, err = insertBooking(tx, userID, session, selections, req.PaymentMethod, 0)
+            if err != nil {
+                return err
+            }
+            res := tx.Model(&SessionTransferOffer{}).Where("id = ? AND status = ?", offer.ID, "open").
+                Updates(map[string]interface{}{"status": "accepted", "accepted_at": time.Now(), "new_booking_id": booking.ID})
+            if res.Error != nil {
+                return res.Error
+            }
+            if res.RowsAffected == 0 {
+                return errors.New("transfer offer already used")
+            }
+            return nil
+        })
+        if err != nil {
+            respondBookingConflict(c, err)
+            return
+        }
+        if _, err := startPayment(db, payments, currency, booking); err != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "failed to start payment"})
+            return
+        }
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").Preload("Items.TicketType").Preload("Payment").First(&booking, booking.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load booking"})
+            return
+        }
+        c.JSON(http.StatusCreated, booking)
+    }
+}
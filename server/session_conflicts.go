@@ -0,0 +1,95 @@
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+const (
+    defaultRuntimeMins  = 100
+    defaultCleaningMins = 20
+)
+
+// SessionConflictError names the session a new or moved session would
+// collide with and when the hall is free again after it, cleaning included.
+type SessionConflictError struct {
+    Session Session
+    Until   time.Time
+}
+
+func (e *SessionConflictError) Error() string {
+    return fmt.Sprintf("hall is busy until %s with session %d", e.Until.Format(time.RFC3339), e.Session.ID)
+}
+
+var errHallNotFound = errors.New("hall not found")
+var errMovieNotFound = errors.New("movie not found")
+
+// movieRuntime is the screen time of a movie; a missing duration counts as
+// 100 minutes so an incomplete catalogue entry cannot squeeze a hall.
+func movieRuntime(mins int) time.Duration {
+    if mins <= 0 {
+        mins = defaultRuntimeMins
+    }
+    return time.Duration(mins) * time.Minute
+}
+
+// checkSessionSlot rejects a session whose [start, start+runtime+cleaning)
+// overlaps another live session in the hall, using the hall's cleaning buffer
+// for both. It locks the hall row, so callers must run it in the same
+// transaction that writes the session.
+func checkSessionSlot(tx *gorm.DB, hallID, movieID uint, start time.Time, excludeID uint) error {
+    var hall Hall
+    if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&hall, hallID).Error; err != nil {
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            return errHallNotFound
+        }
+        return err
+    }
+    var movie Movie
+    if err := tx.Select("id", "duration_mins").First(&movie, movieID).Error; err != nil {
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            return errMovieNotFound
+        }
+        return err
+    }
+    end := start.Add(movieRuntime(movie.DurationMins) + time.Duration(hall.CleaningMinutes)*time.Minute)
+
+    var conflict Session
+    err := tx.Joins("JOIN movies ON movies.id = sessions.movie_id").
+        Where("sessions.hall_id = ? AND sessions.id <> ? AND sessions.status <> ?", hallID, excludeID, SessionCancelled).
+        Where("sessions.start_time < ?", end).
+        Where("sessions.start_time + (COALESCE(NULLIF(movies.duration_mins, 0), ?) + ?) * interval '1 minute' > ?", defaultRuntimeMins, hall.CleaningMinutes, start).
+        Order("sessions.start_time asc").
+        First(&conflict).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if err := tx.Preload("Movie").Preload("Hall").First(&conflict, conflict.ID).Error; err != nil {
+        return err
+    }
+    until := conflict.StartTime.Add(movieRuntime(conflict.Movie.DurationMins) + time.Duration(hall.CleaningMinutes)*time.Minute)
+    return &SessionConflictError{Session: conflict, Until: until}
+}
+
+// respondSessionError maps checkSessionSlot failures onto HTTP statuses.
+func respondSessionError(c *gin.Context, err error, fallback string) {
+    var conflict *SessionConflictError
+    switch {
+    case errors.As(err, &conflict):
+        c.JSON(http.StatusConflict, gin.H{"error": "session overlaps another session in this hall", "conflict": conflict.Session, "busy_until": conflict.Until})
+    case errors.Is(err, errHallNotFound), errors.Is(err, errMovieNotFound), errors.Is(err, errHallFormatUnsupported):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+    }
+}
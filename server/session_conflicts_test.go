@@ -0,0 +1,69 @@
+package main
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestCheckSessionSlot(t *testing.T) {
+    db := openTestDB(t)
+    existing, _ := testShowing(t, db, 1)
+    // 90 minute movie plus 20 minutes of cleaning: the hall is busy for
+    // [start, start+110m).
+    busyUntil := existing.StartTime.Add(110 * time.Minute)
+
+    cases := []struct {
+        name     string
+        start    time.Time
+        conflict bool
+    }{
+        {"same start", existing.StartTime, true},
+        {"starts during the screening", existing.StartTime.Add(60 * time.Minute), true},
+        {"starts during cleaning", existing.StartTime.Add(100 * time.Minute), true},
+        {"starts when the hall is free", busyUntil, false},
+        {"ends before it starts", existing.StartTime.Add(-110 * time.Minute), false},
+        {"ends during it", existing.StartTime.Add(-60 * time.Minute), true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            err := checkSessionSlot(db, existing.HallID, existing.MovieID, tc.start, 0)
+            var conflict *SessionConflictError
+            switch {
+            case tc.conflict && !errors.As(err, &conflict):
+                t.Fatalf("expected a conflict, got %v", err)
+            case tc.conflict && conflict.Session.ID != existing.ID:
+                t.Fatalf("conflict with session %d, want %d", conflict.Session.ID, existing.ID)
+            case tc.conflict && !conflict.Until.Equal(busyUntil):
+                t.Fatalf("busy until %s, want %s", conflict.Until, busyUntil)
+            case !tc.conflict && err != nil:
+                t.Fatalf("expected no conflict, got %v", err)
+            }
+        })
+    }
+
+    t.Run("moving a session onto itself", func(t *testing.T) {
+        if err := checkSessionSlot(db, existing.HallID, existing.MovieID, existing.StartTime, existing.ID); err != nil {
+            t.Fatalf("expected no conflict, got %v", err)
+        }
+    })
+    t.Run("cancelled sessions free the hall", func(t *testing.T) {
+        if err := db.Model(&Session{}).Where("id = ?", existing.ID).Update("status", SessionCancelled).Error; err != nil {
+            t.Fatalf("cancel: %v", err)
+        }
+        defer db.Model(&Session{}).Where("id = ?", existing.ID).Update("status", SessionScheduled)
+        if err := checkSessionSlot(db, existing.HallID, existing.MovieID, existing.StartTime, 0); err != nil {
+            t.Fatalf("expected no conflict, got %v", err)
+        }
+    })
+    t.Run("unknown hall", func(t *testing.T) {
+        if err := checkSessionSlot(db, existing.HallID+1000, existing.MovieID, existing.StartTime, 0); !errors.Is(err, errHallNotFound) {
+            t.Fatalf("expected errHallNotFound, got %v", err)
+        }
+    })
+    t.Run("unknown movie", func(t *testing.T) {
+        if err := checkSessionSlot(db, existing.HallID, existing.MovieID+1000, existing.StartTime, 0); !errors.Is(err, errMovieNotFound) {
+            t.Fatalf("expected errMovieNotFound, got %v", err)
+        }
+    })
+}
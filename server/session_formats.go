@@ -0,0 +1,188 @@
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    Format2D   = "2D"
+    Format3D   = "3D"
+    FormatIMAX = "IMAX"
+    Format4DX  = "4DX"
+)
+
+// SessionFormat prices a projection format. Surcharge is a fixed amount added
+// to the session's base price for every ticket, before seat category and
+// ticket type are applied.
+type SessionFormat struct {
+    ID        uint      `gorm:"primaryKey" json:"id"`
+    Code      string    `gorm:"uniqueIndex;not null" json:"code"`
+    Name      string    `json:"name"`
+    NameEN    string    `json:"name_en"`
+    NameKK    string    `json:"name_kk"`
+    Surcharge int       `gorm:"not null;default:0" json:"surcharge"`
+    SortOrder int       `gorm:"not null;default:0" json:"sort_order"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+type SessionFormatRequest struct {
+    Name      string `json:"name"`
+    NameEN    string `json:"name_en"`
+    NameKK    string `json:"name_kk"`
+    Surcharge int    `json:"surcharge"`
+    SortOrder int    `json:"sort_order"`
+}
+
+var builtinSessionFormats = []SessionFormat{
+    {Code: Format2D, Name: "2D", NameEN: "2D", NameKK: "2D", Surcharge: 0, SortOrder: 1},
+    {Code: Format3D, Name: "3D", NameEN: "3D", NameKK: "3D", Surcharge: 150, SortOrder: 2},
+    {Code: FormatIMAX, Name: "IMAX", NameEN: "IMAX", NameKK: "IMAX", Surcharge: 400, SortOrder: 3},
+    {Code: Format4DX, Name: "4DX", NameEN: "4DX", NameKK: "4DX", Surcharge: 600, SortOrder: 4},
+}
+
+var (
+    errUnknownFormat         = errors.New("format must be one of 2D, 3D, IMAX, 4DX")
+    errInvalidLanguage       = errors.New("languages must be ISO 639 codes such as ru, kk, en")
+    errHallFormatUnsupported = errors.New("hall does not support this format")
+    errHallFormatsInUse      = errors.New("hall has upcoming sessions in formats it would no longer support")
+    languageCode             = regexp.MustCompile(`^[a-z]{2,3}$`)
+)
+
+func seedSessionFormats(db *gorm.DB) error {
+    for _, format := range builtinSessionFormats {
+        format := format
+        if err := db.Where(SessionFormat{Code: format.Code}).FirstOrCreate(&format).Error; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// normalizeFormat upper-cases a requested format; empty means 2D.
+func normalizeFormat(raw string) (string, error) {
+    format := strings.ToUpper(strings.TrimSpace(raw))
+    switch format {
+    case "":
+        return Format2D, nil
+    case Format2D, Format3D, FormatIMAX, Format4DX:
+        return format, nil
+    }
+    return "", errUnknownFormat
+}
+
+// normalizeLanguage lower-cases a language code; empty means unspecified
+// audio or no subtitles.
+func normalizeLanguage(raw string) (string, error) {
+    code := strings.ToLower(strings.TrimSpace(raw))
+    if code != "" && !languageCode.MatchString(code) {
+        return "", errInvalidLanguage
+    }
+    return code, nil
+}
+
+// supportsFormat reports whether the hall's equipment can show format.
+// Every hall can show 2D.
+func (h Hall) supportsFormat(format string) bool {
+    switch format {
+    case Format3D:
+        return h.Supports3D
+    case FormatIMAX:
+        return h.SupportsIMAX
+    case Format4DX:
+        return h.Supports4DX
+    }
+    return true
+}
+
+func checkHallFormat(tx *gorm.DB, hallID uint, format string) error {
+    var hall Hall
+    if err := tx.First(&hall, hallID).Error; err != nil {
+        return errHallNotFound
+    }
+    if !hall.supportsFormat(format) {
+        return fmt.Errorf("%w: %s cannot show %s", errHallFormatUnsupported, hall.Name, format)
+    }
+    return nil
+}
+
+// formatsInUse lists the formats of upcoming live sessions in the hall that
+// the given capabilities would no longer allow.
+func formatsInUse(tx *gorm.DB, hall Hall) ([]string, error) {
+    var formats []string
+    err := tx.Model(&Session{}).
+        Where("hall_id = ? AND status <> ? AND start_time > ?", hall.ID, SessionCancelled, time.Now()).
+        Distinct("format").Pluck("format", &formats).Error
+    if err != nil {
+        return nil, err
+    }
+    blocked := make([]string, 0)
+    for _, format := range formats {
+        if !hall.supportsFormat(format) {
+            blocked = append(blocked, format)
+        }
+    }
+    return blocked, nil
+}
+
+func formatSurcharge(tx *gorm.DB, format string) (int, error) {
+    var sf SessionFormat
+    err := tx.Where("code = ?", format).First(&sf).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return 0, nil
+    }
+    return sf.Surcharge, err
+}
+
+func listSessionFormats(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var formats []SessionFormat
+        if err := db.Order("sort_order asc, id asc").Find(&formats).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load session formats"})
+            return
+        }
+        c.JSON(http.StatusOK, formats)
+    }
+}
+
+func updateSessionFormat(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var format SessionFormat
+        if err := db.Where("code = ?", strings.ToUpper(c.Param("code"))).First(&format).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "session format not found"})
+            return
+        }
+        var req SessionFormatRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        if strings.TrimSpace(req.Name) == "" || req.Surcharge < 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "name and a non-negative surcharge are required"})
+            return
+        }
+        if err := db.Model(&format).Updates(map[string]interface{}{
+            "name":       strings.TrimSpace(req.Name),
+            "name_en":    strings.TrimSpace(req.NameEN),
+            "name_kk":    strings.TrimSpace(req.NameKK),
+            "surcharge":  req.Surcharge,
+            "sort_order": req.SortOrder,
+        }).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update session format"})
+            return
+        }
+        if err := db.First(&format, format.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load session format"})
+            return
+        }
+        c.JSON(http.StatusOK, format)
+    }
+}
@@ -0,0 +1,199 @@
+
+package main
+
+import (
+    "errors"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    defaultSessionsPerPage = 20
+    maxSessionsPerPage     = 100
+    // maxUnpagedSessions bounds the legacy plain-array response.
+    maxUnpagedSessions = 500
+)
+
+// Seat counts are computed per row in SQL so the whole page needs one query.
+// Held seats count as taken until their hold expires. Only seats that are
+// still on sale count as taken, so a layout change that removed or disabled a
+// booked seat cannot push seats_available below zero.
+const (
+    sessionSeatsTotalSQL = "(SELECT COUNT(*) FROM seats WHERE seats.hall_id = sessions.hall_id AND seats.removed_at IS NULL AND seats.disabled = false)"
+    sessionSeatsTakenSQL = "(SELECT COUNT(*) FROM session_seats JOIN seats ON seats.id = session_seats.seat_id WHERE session_seats.session_id = sessions.id AND seats.removed_at IS NULL AND seats.disabled = false)"
+)
+
+// sessionPriceSQL is the base price including the format surcharge, which
+// is what priceTickets charges for an adult seat and listShowtimes shows.
+const sessionPriceSQL = "(sessions.base_price + COALESCE((SELECT session_formats.surcharge FROM session_formats WHERE session_formats.code = sessions.format), 0))"
+
+// SessionPage is the paginated form of GET /sessions, returned when page or
+// per_page is given.
+type SessionPage struct {
+    Items   []Session `json:"items"`
+    Total   int64     `json:"total"`
+    Page    int       `json:"page"`
+    PerPage int       `json:"per_page"`
+    Pages   int       `json:"pages"`
+}
+
+// filterSessions applies the listSessions query parameters:
+//
+//    movie_id, hall_id, status, format, audio_language, subtitle_language
+//    date, date_from, date_to   calendar days (YYYY-MM-DD) in the cinema time zone
+//    time_from, time_to         time of day (HH:MM), inclusive
+//    min_price, max_price       bounds on the base price plus format surcharge
+//    upcoming=0                 include past sessions; without a date filter
+//                               only sessions that have not started are listed
+//    available=1                only sessions with free seats
+func filterSessions(query *gorm.DB, c *gin.Context, loc *time.Location) (*gorm.DB, error) {
+    for _, param := range []string{"movie_id", "hall_id"} {
+        if raw := c.Query(param); raw != "" {
+            id, err := strconv.Atoi(raw)
+            if err != nil || id <= 0 {
+                return nil, errors.New(param + " must be a positive number")
+            }
+            query = query.Where("sessions."+param+" = ?", id)
+        }
+    }
+    if status := c.Query("status"); status == SessionScheduled || status == SessionCancelled {
+        query = query.Where("sessions.status = ?", status)
+    }
+    if raw := c.Query("format"); raw != "" {
+        format, err := normalizeFormat(raw)
+        if err != nil {
+            return nil, err
+        }
+        query = query.Where("sessions.format = ?", format)
+    }
+    if audio := c.Query("audio_language"); audio != "" {
+        query = query.Where("sessions.audio_language = ?", strings.ToLower(audio))
+    }
+    // subtitle_language=none asks for screenings without subtitles.
+    if subtitles := strings.ToLower(c.Query("subtitle_language")); subtitles == "none" {
+        query = query.Where("sessions.subtitle_language = ''")
+    } else if subtitles != "" {
+        query = query.Where("sessions.subtitle_language = ?", subtitles)
+    }
+
+    from, to := c.Query("date_from"), c.Query("date_to")
+    if date := c.Query("date"); date != "" {
+        from, to = date, date
+    }
+    if from != "" {
+        day, err := time.ParseInLocation(dateLayout, from, loc)
+        if err != nil {
+            return nil, errors.New("dates must be YYYY-MM-DD")
+        }
+        query = query.Where("sessions.start_time >= ?", day)
+    }
+    if to != "" {
+        day, err := time.ParseInLocation(dateLayout, to, loc)
+        if err != nil {
+            return nil, errors.New("dates must be YYYY-MM-DD")
+        }
+        query = query.Where("sessions.start_time < ?", day.AddDate(0, 0, 1))
+    }
+
+    for param, op := range map[string]string{"time_from": ">=", "time_to": "<="} {
+        if raw := c.Query(param); raw != "" {
+            offset, err := parseClock(raw, 0)
+            if err != nil {
+                return nil, errors.New(param + " must be HH:MM")
+            }
+            clock := time.Time{}.Add(offset).Format("15:04")
+            query = query.Where("(sessions.start_time AT TIME ZONE ?)::time "+op+" ?", loc.String(), clock)
+        }
+    }
+
+    for param, op := range map[string]string{"min_price": ">=", "max_price": "<="} {
+        if raw := c.Query(param); raw != "" {
+            price, err := strconv.Atoi(raw)
+            if err != nil || price < 0 {
+                return nil, errors.New(param + " must be a non-negative number")
+            }
+            query = query.Where(sessionPriceSQL+" "+op+" ?", price)
+        }
+    }
+    upcoming := c.Query("upcoming")
+    if upcoming == "" && from == "" && to == "" {
+        upcoming = "1"
+    }
+    if upcoming == "1" {
+        query = query.Where("sessions.start_time > ?", time.Now())
+    }
+    if c.Query("available") == "1" {
+        query = query.Where(sessionSeatsTotalSQL + " > " + sessionSeatsTakenSQL)
+    }
+    return query, nil
+}
+
+// listSessions returns sessions ordered by start time. Without page or
+// per_page it keeps answering with a plain array of at most
+// maxUnpagedSessions entries; with either it returns a SessionPage.
+// with_seats=1 adds seats_total and seats_available.
+func listSessions(db *gorm.DB, loc *time.Location) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        query, err := filterSessions(db.Model(&Session{}), c, loc)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+
+        paginate := c.Query("page") != "" || c.Query("per_page") != ""
+        page, perPage := 1, defaultSessionsPerPage
+        var total int64
+        if paginate {
+            if raw := c.Query("page"); raw != "" {
+                if page, err = strconv.Atoi(raw); err != nil || page < 1 {
+                    c.JSON(http.StatusBadRequest, gin.H{"error": "page must be a positive number"})
+                    return
+                }
+            }
+            if raw := c.Query("per_page"); raw != "" {
+                if perPage, err = strconv.Atoi(raw); err != nil || perPage < 1 || perPage > maxSessionsPerPage {
+                    c.JSON(http.StatusBadRequest, gin.H{"error": "per_page must be between 1 and 100"})
+                    return
+                }
+            }
+            if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count sessions"})
+                return
+            }
+        }
+
+        query = query.Preload("Movie").Preload("Hall").Order("sessions.start_time asc, sessions.id asc")
+        if c.Query("with_seats") == "1" {
+            query = query.Select("sessions.*, " +
+                sessionSeatsTotalSQL + " AS seats_total, " +
+                sessionSeatsTotalSQL + " - " + sessionSeatsTakenSQL + " AS seats_available")
+        }
+        if paginate {
+            query = query.Offset((page - 1) * perPage).Limit(perPage)
+        } else {
+            query = query.Limit(maxUnpagedSessions)
+        }
+        sessions := make([]Session, 0)
+        if err := query.Find(&sessions).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load sessions"})
+            return
+        }
+        if !paginate {
+            c.JSON(http.StatusOK, sessions)
+            return
+        }
+        c.JSON(http.StatusOK, SessionPage{
+            Items:   sessions,
+            Total:   total,
+            Page:    page,
+            PerPage: perPage,
+            Pages:   int(math.Ceil(float64(total) / float64(perPage))),
+        })
+    }
+}
@@ -0,0 +1,645 @@
+
+package main
+
+import (
+    "errors"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// SessionTemplate is a recurring rule such as "movie X in hall A at 14:00
+// and 19:30 on weekdays from D1 to D2". The materializer turns it into
+// concrete sessions over a rolling horizon.
+type SessionTemplate struct {
+    ID               uint                       `gorm:"primaryKey" json:"id"`
+    MovieID          uint                       `gorm:"index;not null" json:"movie_id"`
+    HallID           uint                       `gorm:"index;not null" json:"hall_id"`
+    StartTimes       string                     `gorm:"not null" json:"-"`
+    WeekdayMask      int                        `gorm:"not null" json:"-"`
+    StartDate        time.Time                  `gorm:"type:date;not null" json:"-"`
+    EndDate          *time.Time                 `gorm:"type:date" json:"-"`
+    BasePrice        int                        `gorm:"not null" json:"base_price"`
+    Format           string                     `gorm:"size:10;not null;default:2D" json:"format"`
+    AudioLanguage    string                     `gorm:"size:8" json:"audio_language"`
+    SubtitleLanguage string                     `gorm:"size:8" json:"subtitle_language,omitempty"`
+    Active           bool                       `gorm:"not null;default:true" json:"active"`
+    CreatedAt        time.Time                  `json:"created_at"`
+    UpdatedAt        time.Time                  `json:"updated_at"`
+    Movie            Movie                      `json:"movie"`
+    Hall             Hall                       `json:"hall"`
+    Exceptions       []SessionTemplateException `gorm:"foreignKey:TemplateID" json:"exceptions"`
+
+    Times    []string `gorm:"-" json:"times"`
+    Weekdays []int    `gorm:"-" json:"weekdays"`
+    From     string   `gorm:"-" json:"start_date"`
+    Until    string   `gorm:"-" json:"end_date,omitempty"`
+}
+
+// SessionTemplateException skips one date of a template, or with Time set
+// only that day's occurrence at that clock time. The latter are recorded when
+// staff delete or move a single materialized session, so the materializer
+// does not bring it back.
+type SessionTemplateException struct {
+    ID         uint      `gorm:"primaryKey" json:"id"`
+    TemplateID uint      `gorm:"uniqueIndex:idx_template_exception_slot;not null" json:"template_id"`
+    Date       string    `gorm:"uniqueIndex:idx_template_exception_slot;size:10;not null" json:"date"`
+    Time       string    `gorm:"uniqueIndex:idx_template_exception_slot;size:5;not null;default:''" json:"time,omitempty"`
+    Reason     string    `json:"reason"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+type SessionTemplateRequest struct {
+    MovieID          uint     `json:"movie_id"`
+    HallID           uint     `json:"hall_id"`
+    Times            []string `json:"times"`
+    Weekdays         []int    `json:"weekdays"`
+    StartDate        string   `json:"start_date"`
+    EndDate          string   `json:"end_date"`
+    BasePrice        int      `json:"base_price"`
+    Format           string   `json:"format"`
+    AudioLanguage    string   `json:"audio_language"`
+    SubtitleLanguage string   `json:"subtitle_language"`
+}
+
+type TemplateExceptionRequest struct {
+    Date   string `json:"date"`
+    Time   string `json:"time"`
+    Reason string `json:"reason"`
+}
+
+// MaterializeReport lists what a materializer run did for one template.
+// Skipped occurrences collided with another session in the hall; Kept ones
+// could not be removed because they already have bookings.
+type MaterializeReport struct {
+    Created []Session `json:"created"`
+    Removed []uint    `json:"removed"`
+    Kept    []Session `json:"kept"`
+    Skipped []gin.H   `json:"skipped"`
+}
+
+func newMaterializeReport() MaterializeReport {
+    return MaterializeReport{Created: []Session{}, Removed: []uint{}, Kept: []Session{}, Skipped: []gin.H{}}
+}
+
+const dateLayout = "2006-01-02"
+
+// fill exposes the stored rule in its request shape.
+func (t *SessionTemplate) fill() {
+    t.Times = strings.Split(t.StartTimes, ",")
+    t.Weekdays = make([]int, 0, 7)
+    for day := 1; day <= 7; day++ {
+        if t.WeekdayMask&(1<<uint(day)) != 0 {
+            t.Weekdays = append(t.Weekdays, day)
+        }
+    }
+    t.From = t.StartDate.Format(dateLayout)
+    if t.EndDate != nil {
+        t.Until = t.EndDate.Format(dateLayout)
+    }
+}
+
+// isoWeekday numbers days from Monday = 1 to Sunday = 7.
+func isoWeekday(d time.Time) int {
+    if d.Weekday() == time.Sunday {
+        return 7
+    }
+    return int(d.Weekday())
+}
+
+// apply validates req and copies it onto the template.
+func (req SessionTemplateRequest) apply(t *SessionTemplate) error {
+    if req.MovieID == 0 || req.HallID == 0 || req.BasePrice <= 0 {
+        return errors.New("movie_id, hall_id, base_price are required")
+    }
+    if len(req.Times) == 0 {
+        return errors.New("times are required")
+    }
+    times := make([]string, 0, len(req.Times))
+    seen := map[string]bool{}
+    for _, raw := range req.Times {
+        offset, err := parseClock(raw, -1)
+        if err != nil || offset < 0 {
+            return errors.New("times must be HH:MM")
+        }
+        clock := time.Time{}.Add(offset).Format("15:04")
+        if !seen[clock] {
+            seen[clock] = true
+            times = append(times, clock)
+        }
+    }
+    sort.Strings(times)
+    mask := 0
+    for _, day := range req.Weekdays {
+        if day < 1 || day > 7 {
+            return errors.New("weekdays must be 1 (Monday) to 7 (Sunday)")
+        }
+        mask |= 1 << uint(day)
+    }
+    if mask == 0 {
+        for day := 1; day <= 7; day++ {
+            mask |= 1 << uint(day)
+        }
+    }
+    start, err := time.Parse(dateLayout, req.StartDate)
+    if err != nil {
+        return errors.New("start_date must be YYYY-MM-DD")
+    }
+    var end *time.Time
+    if req.EndDate != "" {
+        parsed, err := time.Parse(dateLayout, req.EndDate)
+        if err != nil {
+            return errors.New("end_date must be YYYY-MM-DD")
+        }
+        if parsed.Before(start) {
+            return errors.New("end_date must not be before start_date")
+        }
+        end = &parsed
+    }
+    if err := normalizeSessionFormat(&req.Format, &req.AudioLanguage, &req.SubtitleLanguage); err != nil {
+        return err
+    }
+    t.MovieID = req.MovieID
+    t.HallID = req.HallID
+    t.StartTimes = strings.Join(times, ",")
+    t.WeekdayMask = mask
+    t.StartDate = start
+    t.EndDate = end
+    t.BasePrice = req.BasePrice
+    t.Format = req.Format
+    t.AudioLanguage = req.AudioLanguage
+    t.SubtitleLanguage = req.SubtitleLanguage
+    return nil
+}
+
+// occurrences lists the start times the template asks for between from and
+// until, skipping exception dates and single excepted occurrences.
+func (t SessionTemplate) occurrences(loc *time.Location, from, until time.Time) []time.Time {
+    skip := make(map[string]bool, len(t.Exceptions))
+    for _, e := range t.Exceptions {
+        if e.Time == "" {
+            skip[e.Date] = true
+        } else {
+            skip[e.Date+" "+e.Time] = true
+        }
+    }
+    first := time.Date(t.StartDate.Year(), t.StartDate.Month(), t.StartDate.Day(), 0, 0, 0, 0, loc)
+    day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+    if day.Before(first) {
+        day = first
+    }
+    var last time.Time
+    if t.EndDate != nil {
+        last = time.Date(t.EndDate.Year(), t.EndDate.Month(), t.EndDate.Day(), 0, 0, 0, 0, loc)
+    }
+    starts := make([]time.Time, 0)
+    for ; !day.After(until); day = day.AddDate(0, 0, 1) {
+        if !last.IsZero() && day.After(last) {
+            break
+        }
+        if t.WeekdayMask&(1<<uint(isoWeekday(day))) == 0 || skip[day.Format(dateLayout)] {
+            continue
+        }
+        for _, clock := range strings.Split(t.StartTimes, ",") {
+            offset, err := parseClock(clock, -1)
+            if err != nil || offset < 0 {
+                continue
+            }
+            start := atClock(day, offset)
+            if skip[day.Format(dateLayout)+" "+start.Format("15:04")] {
+                continue
+            }
+            if start.After(from) && !start.After(until) {
+                starts = append(starts, start)
+            }
+        }
+    }
+    return starts
+}
+
+// atClock is the wall-clock time offset after midnight on day. Adding the
+// offset to midnight directly would drift by an hour on DST change days.
+func atClock(day time.Time, offset time.Duration) time.Time {
+    return time.Date(day.Year(), day.Month(), day.Day(), int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// detachFromTemplate records that a materialized session no longer sits at
+// its template slot, because it was deleted or moved by hand, so the
+// materializer does not recreate it there.
+func detachFromTemplate(tx *gorm.DB, session Session, loc *time.Location, reason string) error {
+    if session.TemplateID == nil {
+        return nil
+    }
+    start := session.StartTime.In(loc)
+    return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&SessionTemplateException{
+        TemplateID: *session.TemplateID,
+        Date:       start.Format(dateLayout),
+        Time:       start.Format("15:04"),
+        Reason:     reason,
+    }).Error
+}
+
+// unbookedSessions narrows a session query to sessions nobody has bought or
+// held a seat for; only those may be dropped or moved by template edits.
+func unbookedSessions(query *gorm.DB) *gorm.DB {
+    return query.
+        Where("NOT EXISTS (SELECT 1 FROM bookings WHERE bookings.session_id = sessions.id)").
+        Where("NOT EXISTS (SELECT 1 FROM session_seats WHERE session_seats.session_id = sessions.id)")
+}
+
+// materializeTemplate creates the template's missing sessions up to the
+// horizon. Occurrences that collide with another session, or that the hall
+// can no longer show in the template's format, are reported and skipped
+// rather than failing the whole run.
+func materializeTemplate(db *gorm.DB, template SessionTemplate, loc *time.Location, now time.Time, horizon time.Duration, report *MaterializeReport) error {
+    if !template.Active {
+        return nil
+    }
+    for _, start := range template.occurrences(loc, now, now.Add(horizon)) {
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var count int64
+            if err := tx.Model(&Session{}).Where("template_id = ? AND start_time = ?", template.ID, start).Count(&count).Error; err != nil {
+                return err
+            }
+            if count > 0 {
+                return nil
+            }
+            if err := checkHallFormat(tx, template.HallID, template.Format); err != nil {
+                return err
+            }
+            if err := checkSessionSlot(tx, template.HallID, template.MovieID, start, 0); err != nil {
+                return err
+            }
+            session := Session{MovieID: template.MovieID, HallID: template.HallID, StartTime: start, BasePrice: template.BasePrice, TemplateID: &template.ID,
+                Format: template.Format, AudioLanguage: template.AudioLanguage, SubtitleLanguage: template.SubtitleLanguage}
+            if err := tx.Create(&session).Error; err != nil {
+                return err
+            }
+            report.Created = append(report.Created, session)
+            return nil
+        })
+        var conflict *SessionConflictError
+        if errors.As(err, &conflict) {
+            report.Skipped = append(report.Skipped, gin.H{"start_time": start, "conflict_session_id": conflict.Session.ID})
+            continue
+        }
+        if errors.Is(err, errHallFormatUnsupported) {
+            report.Skipped = append(report.Skipped, gin.H{"start_time": start, "error": err.Error()})
+            continue
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// dropFutureOccurrences removes the template's upcoming sessions matched by
+// scope. Sessions with bookings are kept and reported so staff can deal
+// with them individually.
+func dropFutureOccurrences(tx *gorm.DB, templateID uint, now time.Time, scope func(*gorm.DB) *gorm.DB, report *MaterializeReport) error {
+    base := func() *gorm.DB {
+        q := tx.Model(&Session{}).Where("template_id = ? AND start_time > ?", templateID, now)
+        if scope != nil {
+            q = scope(q)
+        }
+        return q
+    }
+    var ids []uint
+    if err := unbookedSessions(base()).Pluck("id", &ids).Error; err != nil {
+        return err
+    }
+    if len(ids) > 0 {
+        if err := tx.Where("id IN ?", ids).Delete(&Session{}).Error; err != nil {
+            return err
+        }
+        report.Removed = append(report.Removed, ids...)
+    }
+    var kept []Session
+    if err := base().Find(&kept).Error; err != nil {
+        return err
+    }
+    report.Kept = append(report.Kept, kept...)
+    return nil
+}
+
+func materializeTemplates(db *gorm.DB, loc *time.Location, horizon time.Duration) (int, error) {
+    var templates []SessionTemplate
+    if err := db.Preload("Exceptions").Where("active = ?", true).Find(&templates).Error; err != nil {
+        return 0, err
+    }
+    created := 0
+    now := time.Now()
+    for _, template := range templates {
+        report := newMaterializeReport()
+        if err := materializeTemplate(db, template, loc, now, horizon, &report); err != nil {
+            return created, err
+        }
+        created += len(report.Created)
+    }
+    return created, nil
+}
+
+func runTemplateMaterializer(db *gorm.DB, logger *zap.Logger, loc *time.Location, horizon, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        if created, err := materializeTemplates(db, loc, horizon); err != nil {
+            logger.Warn("failed to materialize session templates", zap.Error(err))
+        } else if created > 0 {
+            logger.Info("materialized template sessions", zap.Int("count", created))
+        }
+        <-ticker.C
+    }
+}
+
+func loadTemplate(db *gorm.DB, id interface{}) (SessionTemplate, error) {
+    var template SessionTemplate
+    err := db.Preload("Movie").Preload("Hall").Preload("Exceptions").First(&template, id).Error
+    template.fill()
+    return template, err
+}
+
+func listSessionTemplates(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var templates []SessionTemplate
+        query := db.Preload("Movie").Preload("Hall").Preload("Exceptions").Order("id desc")
+        if c.Query("all") != "1" {
+            query = query.Where("active = ?", true)
+        }
+        if err := query.Find(&templates).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load templates"})
+            return
+        }
+        for i := range templates {
+            templates[i].fill()
+        }
+        c.JSON(http.StatusOK, templates)
+    }
+}
+
+func createSessionTemplate(db *gorm.DB, loc *time.Location, horizon time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req SessionTemplateRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        template := SessionTemplate{Active: true}
+        if err := req.apply(&template); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if err := templateRefsExist(db, template); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Create(&template).Error; err != nil {
+                return err
+            }
+            return recordAudit(tx, c.GetUint("user_id"), "session_template.create", "session_template", template.ID, "", gin.H{
+                "movie_id":   template.MovieID,
+                "hall_id":    template.HallID,
+                "times":      template.StartTimes,
+                "base_price": template.BasePrice,
+                "format":     template.Format,
+            })
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create template"})
+            return
+        }
+        report := newMaterializeReport()
+        if err := materializeTemplate(db, template, loc, time.Now(), horizon, &report); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to materialize template"})
+            return
+        }
+        template, _ = loadTemplate(db, template.ID)
+        c.JSON(http.StatusCreated, gin.H{"template": template, "report": report})
+    }
+}
+
+// updateSessionTemplate is the bulk edit of all future occurrences. A new
+// base price is applied to every upcoming session (existing bookings keep
+// what they paid); a changed movie, hall, format, language, time or day rule
+// rebuilds the unbooked ones and reports the booked ones it could not move.
+func updateSessionTemplate(db *gorm.DB, loc *time.Location, horizon time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        template, err := loadTemplate(db, c.Param("id"))
+        if err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+            return
+        }
+        var req SessionTemplateRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        updated := template
+        if err := req.apply(&updated); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if err := templateRefsExist(db, updated); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        structural := updated.MovieID != template.MovieID || updated.HallID != template.HallID ||
+            updated.StartTimes != template.StartTimes || updated.WeekdayMask != template.WeekdayMask ||
+            updated.Format != template.Format || updated.AudioLanguage != template.AudioLanguage ||
+            updated.SubtitleLanguage != template.SubtitleLanguage ||
+            !updated.StartDate.Equal(template.StartDate) || !sameDate(updated.EndDate, template.EndDate)
+
+        now := time.Now()
+        report := newMaterializeReport()
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Model(&SessionTemplate{}).Where("id = ?", template.ID).Updates(map[string]interface{}{
+                "movie_id":          updated.MovieID,
+                "hall_id":           updated.HallID,
+                "start_times":       updated.StartTimes,
+                "weekday_mask":      updated.WeekdayMask,
+                "start_date":        updated.StartDate,
+                "end_date":          updated.EndDate,
+                "base_price":        updated.BasePrice,
+                "format":            updated.Format,
+                "audio_language":    updated.AudioLanguage,
+                "subtitle_language": updated.SubtitleLanguage,
+            }).Error; err != nil {
+                return err
+            }
+            var repriced int64
+            if updated.BasePrice != template.BasePrice {
+                res := tx.Model(&Session{}).Where("template_id = ? AND start_time > ?", template.ID, now).
+                    Update("base_price", updated.BasePrice)
+                if res.Error != nil {
+                    return res.Error
+                }
+                repriced = res.RowsAffected
+            }
+            if structural {
+                if err := dropFutureOccurrences(tx, template.ID, now, nil, &report); err != nil {
+                    return err
+                }
+            }
+            return recordAudit(tx, c.GetUint("user_id"), "session_template.update", "session_template", template.ID, "", gin.H{
+                "structural":     structural,
+                "old_base_price": template.BasePrice,
+                "base_price":     updated.BasePrice,
+                "repriced":       repriced,
+                "removed":        len(report.Removed),
+                "kept":           len(report.Kept),
+            })
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update template"})
+            return
+        }
+        if structural {
+            updated.Exceptions = template.Exceptions
+            if err := materializeTemplate(db, updated, loc, now, horizon, &report); err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to materialize template"})
+                return
+            }
+        }
+        template, _ = loadTemplate(db, c.Param("id"))
+        c.JSON(http.StatusOK, gin.H{"template": template, "report": report})
+    }
+}
+
+func templateRefsExist(db *gorm.DB, t SessionTemplate) error {
+    if err := db.First(&Movie{}, t.MovieID).Error; err != nil {
+        return errMovieNotFound
+    }
+    return checkHallFormat(db, t.HallID, t.Format)
+}
+
+func sameDate(a, b *time.Time) bool {
+    if a == nil || b == nil {
+        return a == nil && b == nil
+    }
+    return a.Equal(*b)
+}
+
+// cancelSessionTemplate stops a template and removes all its future
+// unbooked occurrences. Booked ones are left in place and reported.
+func cancelSessionTemplate(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        template, err := loadTemplate(db, c.Param("id"))
+        if err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+            return
+        }
+        report := newMaterializeReport()
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Model(&SessionTemplate{}).Where("id = ?", template.ID).Update("active", false).Error; err != nil {
+                return err
+            }
+            if err := dropFutureOccurrences(tx, template.ID, time.Now(), nil, &report); err != nil {
+                return err
+            }
+            return recordAudit(tx, c.GetUint("user_id"), "session_template.cancel", "session_template", template.ID, "", gin.H{
+                "removed": len(report.Removed),
+                "kept":    len(report.Kept),
+            })
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel template"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"report": report})
+    }
+}
+
+func addTemplateException(db *gorm.DB, loc *time.Location) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        template, err := loadTemplate(db, c.Param("id"))
+        if err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+            return
+        }
+        var req TemplateExceptionRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        day, err := time.ParseInLocation(dateLayout, req.Date, loc)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+            return
+        }
+        // Without a time the whole day is skipped.
+        from, until := day, day.AddDate(0, 0, 1)
+        clock := ""
+        if strings.TrimSpace(req.Time) != "" {
+            offset, err := parseClock(req.Time, -1)
+            if err != nil || offset < 0 {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "time must be HH:MM"})
+                return
+            }
+            from = atClock(day, offset)
+            until = from.Add(time.Minute)
+            clock = from.Format("15:04")
+        }
+        exception := SessionTemplateException{TemplateID: template.ID, Date: req.Date, Time: clock, Reason: strings.TrimSpace(req.Reason)}
+        report := newMaterializeReport()
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Where("template_id = ? AND date = ? AND time = ?", template.ID, req.Date, clock).
+                Assign(SessionTemplateException{Reason: exception.Reason}).FirstOrCreate(&exception).Error; err != nil {
+                return err
+            }
+            return dropFutureOccurrences(tx, template.ID, time.Now(), func(q *gorm.DB) *gorm.DB {
+                return q.Where("start_time >= ? AND start_time < ?", from, until)
+            }, &report)
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add exception"})
+            return
+        }
+        c.JSON(http.StatusCreated, gin.H{"exception": exception, "report": report})
+    }
+}
+
+func removeTemplateException(db *gorm.DB, loc *time.Location, horizon time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        template, err := loadTemplate(db, c.Param("id"))
+        if err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+            return
+        }
+        // ?time=HH:MM lifts a single-occurrence exception instead of the day.
+        result := db.Where("template_id = ? AND date = ? AND time = ?", template.ID, c.Param("date"), strings.TrimSpace(c.Query("time"))).Delete(&SessionTemplateException{})
+        if result.Error != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove exception"})
+            return
+        }
+        if result.RowsAffected == 0 {
+            c.JSON(http.StatusNotFound, gin.H{"error": "exception not found"})
+            return
+        }
+        template, _ = loadTemplate(db, c.Param("id"))
+        report := newMaterializeReport()
+        if err := materializeTemplate(db, template, loc, time.Now(), horizon, &report); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to materialize template"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"report": report})
+    }
+}
+
+func materializeTemplatesHandler(db *gorm.DB, loc *time.Location, horizon time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        created, err := materializeTemplates(db, loc, horizon)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to materialize templates"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"created": created})
+    }
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestSessionTemplateOccurrences(t *testing.T) {
+    loc, err := time.LoadLocation("Europe/Berlin")
+    if err != nil {
+        t.Fatal(err)
+    }
+    date := func(s string) time.Time {
+        d, err := time.ParseInLocation(dateLayout, s, time.UTC)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return d
+    }
+    at := func(s string) time.Time {
+        d, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return d
+    }
+    mask := func(days ...int) int {
+        m := 0
+        for _, d := range days {
+            m |= 1 << uint(d)
+        }
+        return m
+    }
+    endDate := date("2026-03-24")
+    everyDay := mask(1, 2, 3, 4, 5, 6, 7)
+
+    cases := []struct {
+        name     string
+        template SessionTemplate
+        from     string
+        until    string
+        want     []string
+    }{
+        {
+            "selected weekdays only",
+            SessionTemplate{StartTimes: "19:00", WeekdayMask: mask(1, 3), StartDate: date("2026-03-01")},
+            "2026-03-22 00:00", "2026-03-29 23:00",
+            []string{"2026-03-23 19:00 +0100", "2026-03-25 19:00 +0100"},
+        },
+        {
+            "sunday is weekday seven",
+            SessionTemplate{StartTimes: "19:00", WeekdayMask: mask(7), StartDate: date("2026-03-01")},
+            "2026-03-16 00:00", "2026-03-22 23:00",
+            []string{"2026-03-22 19:00 +0100"},
+        },
+        {
+            "several times a day",
+            SessionTemplate{StartTimes: "14:00,19:30", WeekdayMask: mask(2), StartDate: date("2026-03-01")},
+            "2026-03-23 00:00", "2026-03-29 23:00",
+            []string{"2026-03-24 14:00 +0100", "2026-03-24 19:30 +0100"},
+        },
+        {
+            "invalid times are skipped",
+            SessionTemplate{StartTimes: "25:00,19:00", WeekdayMask: mask(2), StartDate: date("2026-03-01")},
+            "2026-03-23 00:00", "2026-03-29 23:00",
+            []string{"2026-03-24 19:00 +0100"},
+        },
+        {
+            "whole day exception",
+            SessionTemplate{StartTimes: "19:00", WeekdayMask: mask(1, 3), StartDate: date("2026-03-01"),
+                Exceptions: []SessionTemplateException{{Date: "2026-03-25"}}},
+            "2026-03-22 00:00", "2026-03-29 23:00",
+            []string{"2026-03-23 19:00 +0100"},
+        },
+        {
+            "single time exception",
+            SessionTemplate{StartTimes: "14:00,19:30", WeekdayMask: mask(2), StartDate: date("2026-03-01"),
+                Exceptions: []SessionTemplateException{{Date: "2026-03-24", Time: "14:00"}}},
+            "2026-03-23 00:00", "2026-03-29 23:00",
+            []string{"2026-03-24 19:30 +0100"},
+        },
+        {
+            "exception for another time leaves the day alone",
+            SessionTemplate{StartTimes: "19:00", WeekdayMask: mask(2), StartDate: date("2026-03-01"),
+                Exceptions: []SessionTemplateException{{Date: "2026-03-24", Time: "14:00"}}},
+            "2026-03-23 00:00", "2026-03-29 23:00",
+            []string{"2026-03-24 19:00 +0100"},
+        },
+        {
+            "nothing before the start date",
+            SessionTemplate{StartTimes: "19:00", WeekdayMask: everyDay, StartDate: date("2026-03-26")},
+            "2026-03-23 00:00", "2026-03-27 23:00",
+            []string{"2026-03-26 19:00 +0100", "2026-03-27 19:00 +0100"},
+        },
+        {
+            "end date is inclusive",
+            SessionTemplate{StartTimes: "19:00", WeekdayMask: everyDay, StartDate: date("2026-03-01"), EndDate: &endDate},
+            "2026-03-23 00:00", "2026-03-29 23:00",
+            []string{"2026-03-23 19:00 +0100", "2026-03-24 19:00 +0100"},
+        },
+        {
+            "from is exclusive and until inclusive",
+            SessionTemplate{StartTimes: "19:00", WeekdayMask: everyDay, StartDate: date("2026-03-01")},
+            "2026-03-23 19:00", "2026-03-25 19:00",
+            []string{"2026-03-24 19:00 +0100", "2026-03-25 19:00 +0100"},
+        },
+        {
+            "clocks go forward",
+            SessionTemplate{StartTimes: "01:30,19:00", WeekdayMask: mask(7), StartDate: date("2026-03-01")},
+            "2026-03-28 00:00", "2026-03-29 23:00",
+            []string{"2026-03-29 01:30 +0100", "2026-03-29 19:00 +0200"},
+        },
+        {
+            "clocks go back",
+            SessionTemplate{StartTimes: "01:30,19:00", WeekdayMask: mask(7), StartDate: date("2026-10-01")},
+            "2026-10-24 00:00", "2026-10-25 23:00",
+            []string{"2026-10-25 01:30 +0200", "2026-10-25 19:00 +0100"},
+        },
+        {
+            "weeks on both sides of a change keep the wall clock",
+            SessionTemplate{StartTimes: "20:15", WeekdayMask: mask(6), StartDate: date("2026-03-01")},
+            "2026-03-20 00:00", "2026-04-05 00:00",
+            []string{"2026-03-21 20:15 +0100", "2026-03-28 20:15 +0100", "2026-04-04 20:15 +0200"},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            starts := tc.template.occurrences(loc, at(tc.from), at(tc.until))
+            got := make([]string, 0, len(starts))
+            for _, s := range starts {
+                got = append(got, s.In(loc).Format("2006-01-02 15:04 -0700"))
+            }
+            if !reflect.DeepEqual(got, tc.want) {
+                t.Errorf("occurrences = %v, want %v", got, tc.want)
+            }
+        })
+    }
+}
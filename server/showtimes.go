@@ -0,0 +1,124 @@
+
+package main
+
+import (
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// Showtime is one session on the "what's on" page, with its time already
+// converted to the cinema's zone.
+type Showtime struct {
+    SessionID        uint      `json:"session_id"`
+    StartTime        time.Time `json:"start_time"`
+    LocalTime        string    `json:"local_time"`
+    HallID           uint      `json:"hall_id"`
+    HallName         string    `json:"hall_name"`
+    Format           string    `json:"format"`
+    AudioLanguage    string    `json:"audio_language,omitempty"`
+    SubtitleLanguage string    `json:"subtitle_language,omitempty"`
+    BasePrice        int       `json:"base_price"`
+    SeatsTotal       int       `json:"seats_total"`
+    SeatsAvailable   int       `json:"seats_available"`
+    Occupancy        int       `json:"occupancy_percent"`
+}
+
+type MovieShowtimes struct {
+    Movie    Movie      `json:"movie"`
+    Sessions []Showtime `json:"sessions"`
+}
+
+// occupancyPercent rounds to the nearest whole percent; an empty hall
+// layout counts as unoccupied.
+func occupancyPercent(total, available int) int {
+    if total <= 0 {
+        return 0
+    }
+    taken := total - available
+    if taken < 0 {
+        taken = 0
+    }
+    return (taken*100 + total/2) / total
+}
+
+// listShowtimes answers GET /showtimes?date=YYYY-MM-DD with the movies
+// playing on that day in the cinema's time zone, each with its sessions in
+// time order. Movies are ordered by their first session. Without a date it
+// shows today. base_price includes the format surcharge, as charged at
+// checkout by priceTickets.
+func listShowtimes(db *gorm.DB, loc *time.Location) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        now := time.Now().In(loc)
+        day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+        if raw := c.Query("date"); raw != "" {
+            parsed, err := time.ParseInLocation(dateLayout, raw, loc)
+            if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+                return
+            }
+            day = parsed
+        }
+
+        var sessions []Session
+        if err := db.Model(&Session{}).Preload("Movie").Preload("Hall").
+            Select("sessions.*, "+
+                sessionSeatsTotalSQL+" AS seats_total, "+
+                sessionSeatsTotalSQL+" - "+sessionSeatsTakenSQL+" AS seats_available").
+            Where("sessions.status = ? AND sessions.start_time >= ? AND sessions.start_time < ?", SessionScheduled, day, day.AddDate(0, 0, 1)).
+            Order("sessions.start_time asc, sessions.id asc").
+            Find(&sessions).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load showtimes"})
+            return
+        }
+
+        var formats []SessionFormat
+        if err := db.Find(&formats).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load showtimes"})
+            return
+        }
+        surcharges := make(map[string]int, len(formats))
+        for _, f := range formats {
+            surcharges[f.Code] = f.Surcharge
+        }
+
+        movies := make([]MovieShowtimes, 0)
+        index := make(map[uint]int)
+        for _, s := range sessions {
+            i, ok := index[s.MovieID]
+            if !ok {
+                i = len(movies)
+                index[s.MovieID] = i
+                movies = append(movies, MovieShowtimes{Movie: s.Movie, Sessions: []Showtime{}})
+            }
+            total, available := 0, 0
+            if s.SeatsTotal != nil {
+                total = *s.SeatsTotal
+            }
+            if s.SeatsAvailable != nil {
+                available = *s.SeatsAvailable
+            }
+            movies[i].Sessions = append(movies[i].Sessions, Showtime{
+                SessionID:        s.ID,
+                StartTime:        s.StartTime,
+                LocalTime:        s.StartTime.In(loc).Format("15:04"),
+                HallID:           s.HallID,
+                HallName:         s.Hall.Name,
+                Format:           s.Format,
+                AudioLanguage:    s.AudioLanguage,
+                SubtitleLanguage: s.SubtitleLanguage,
+                BasePrice:        s.BasePrice + surcharges[s.Format],
+                SeatsTotal:       total,
+                SeatsAvailable:   available,
+                Occupancy:        occupancyPercent(total, available),
+            })
+        }
+        c.JSON(http.StatusOK, gin.H{
+            "date":     day.Format(dateLayout),
+            "timezone": loc.String(),
+            "movies":   movies,
+        })
+    }
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestOccupancyPercent(t *testing.T) {
+    cases := []struct {
+        total     int
+        available int
+        want      int
+    }{
+        {0, 0, 0},
+        {-5, 0, 0},
+        {10, 10, 0},
+        {10, 0, 100},
+        {3, 2, 33},
+        {3, 1, 67},
+        {200, 199, 1},
+        {201, 200, 0},
+        {8, 4, 50},
+        {10, 12, 0},
+    }
+    for _, tc := range cases {
+        t.Run(fmt.Sprintf("%d of %d free", tc.available, tc.total), func(t *testing.T) {
+            if got := occupancyPercent(tc.total, tc.available); got != tc.want {
+                t.Errorf("occupancy = %d%%, want %d%%", got, tc.want)
+            }
+        })
+    }
+}
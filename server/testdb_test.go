@@ -0,0 +1,106 @@
+
+package main
+
+import (
+    "net/url"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "gorm.io/driver/postgres"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+)
+
+// openTestDB connects to TEST_DATABASE_URL and migrates a throwaway schema
+// that is dropped when the test ends. Tests that need Postgres are skipped
+// when the variable is not set.
+func openTestDB(t *testing.T) *gorm.DB {
+    t.Helper()
+    dsn := strings.TrimSpace(os.Getenv("TEST_DATABASE_URL"))
+    if dsn == "" {
+        t.Skip("TEST_DATABASE_URL is not set")
+    }
+    quiet := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+    admin, err := gorm.Open(postgres.Open(dsn), quiet)
+    if err != nil {
+        t.Fatalf("connect: %v", err)
+    }
+    schema := "test_" + randomHex(6)
+    if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+        t.Fatalf("create schema: %v", err)
+    }
+    db, err := gorm.Open(postgres.Open(withSearchPath(dsn, schema)), quiet)
+    if err != nil {
+        t.Fatalf("connect to schema: %v", err)
+    }
+    t.Cleanup(func() {
+        if sqlDB, err := db.DB(); err == nil {
+            sqlDB.Close()
+        }
+        admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+        if sqlDB, err := admin.DB(); err == nil {
+            sqlDB.Close()
+        }
+    })
+    if err := migrate(db); err != nil {
+        t.Fatalf("migrate: %v", err)
+    }
+    return db
+}
+
+func withSearchPath(dsn, schema string) string {
+    if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+        u, err := url.Parse(dsn)
+        if err == nil {
+            q := u.Query()
+            q.Set("search_path", schema)
+            u.RawQuery = q.Encode()
+            return u.String()
+        }
+    }
+    return dsn + " search_path=" + schema
+}
+
+// testStart is a whole hour two days ahead, shifted by offset, so test
+// sessions are always bookable.
+func testStart(offset time.Duration) time.Time {
+    return time.Now().Add(48 * time.Hour).Truncate(time.Hour).Add(offset)
+}
+
+// testShowing creates a movie, a hall with a single row of cols seats and a
+// session two days ahead, plus the pricing catalogues bookings need.
+func testShowing(t *testing.T, db *gorm.DB, cols int) (Session, []Seat) {
+    t.Helper()
+    for _, seed := range []func(*gorm.DB) error{seedTicketTypes, seedSeatCategories, seedSessionFormats} {
+        if err := seed(db); err != nil {
+            t.Fatalf("seed: %v", err)
+        }
+    }
+    movie := Movie{Title: "Test movie", DurationMins: 90}
+    if err := db.Create(&movie).Error; err != nil {
+        t.Fatalf("create movie: %v", err)
+    }
+    layout, err := rectangleLayout(1, cols).normalize()
+    if err != nil {
+        t.Fatalf("layout: %v", err)
+    }
+    encoded, err := encodeLayout(layout)
+    if err != nil {
+        t.Fatalf("encode layout: %v", err)
+    }
+    hall := Hall{Name: "Test hall " + randomHex(3), Rows: 1, Cols: cols, Layout: encoded, CleaningMinutes: defaultCleaningMins}
+    if err := db.Create(&hall).Error; err != nil {
+        t.Fatalf("create hall: %v", err)
+    }
+    seats := layout.seats(hall.ID)
+    if err := db.Create(&seats).Error; err != nil {
+        t.Fatalf("create seats: %v", err)
+    }
+    session := Session{MovieID: movie.ID, HallID: hall.ID, StartTime: testStart(0), BasePrice: 500}
+    if err := db.Create(&session).Error; err != nil {
+        t.Fatalf("create session: %v", err)
+    }
+    return session, seats
+}
@@ -0,0 +1,424 @@
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "embed"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jung-kurt/gofpdf"
+    "github.com/skip2/go-qrcode"
+)
+
+//go:embed assets/fonts/DejaVuSans.ttf assets/fonts/DejaVuSans-Bold.ttf
+var ticketFonts embed.FS
+
+const ticketFontFamily = "DejaVu"
+
+var (
+    ticketFontsOnce sync.Once
+    ticketFontData  map[string][]byte
+    ticketFontErr   error
+)
+
+// loadTicketFonts reads the embedded font files once per process, keyed by
+// gofpdf style.
+func loadTicketFonts() (map[string][]byte, error) {
+    ticketFontsOnce.Do(func() {
+        data := map[string][]byte{}
+        for style, file := range map[string]string{"": "DejaVuSans.ttf", "B": "DejaVuSans-Bold.ttf"} {
+            font, err := ticketFonts.ReadFile("assets/fonts/" + file)
+            if err != nil {
+                ticketFontErr = err
+                return
+            }
+            data[style] = font
+        }
+        ticketFontData = data
+    })
+    return ticketFontData, ticketFontErr
+}
+
+var ticketLabels = map[string]map[string]string{
+    "ru": {
+        "heading": "Электронный билет",
+        "booking": "Бронирование",
+        "movie":   "Фильм",
+        "hall":    "Зал",
+        "start":   "Начало",
+        "seats":   "Места",
+        "price":   "Стоимость",
+        "status":  "Статус",
+        "seat":    "Ряд %s, место %d",
+        "footer":  "Покажите QR-код на входе в зал.",
+        "confirmed":       "подтверждено",
+        "pending_payment": "ожидает оплаты",
+        "cancelled":       "отменено",
+    },
+    "en": {
+        "heading": "E-ticket",
+        "booking": "Booking",
+        "movie":   "Movie",
+        "hall":    "Hall",
+        "start":   "Start",
+        "seats":   "Seats",
+        "price":   "Price",
+        "status":  "Status",
+        "seat":    "Row %s, seat %d",
+        "footer":  "Show the QR code at the hall entrance.",
+        "confirmed":       "confirmed",
+        "pending_payment": "awaiting payment",
+        "cancelled":       "cancelled",
+    },
+    "kk": {
+        "heading": "Электрондық билет",
+        "booking": "Брондау",
+        "movie":   "Фильм",
+        "hall":    "Зал",
+        "start":   "Басталуы",
+        "seats":   "Орындар",
+        "price":   "Құны",
+        "status":  "Күйі",
+        "seat":    "%s-қатар, %d-орын",
+        "footer":  "Залға кірер кезде QR-кодты көрсетіңіз.",
+        "confirmed":       "расталды",
+        "pending_payment": "төлем күтілуде",
+        "cancelled":       "бас тартылды",
+    },
+}
+
+// ticketLang normalises the lang query parameter, falling back to Russian
+// which is the primary language of the catalogue.
+func ticketLang(raw string) string {
+    lang := strings.ToLower(strings.TrimSpace(raw))
+    if _, ok := ticketLabels[lang]; ok {
+        return lang
+    }
+    return "ru"
+}
+
+func localizedTitle(movie Movie, lang string) string {
+    switch {
+    case lang == "en" && movie.TitleEN != "":
+        return movie.TitleEN
+    case lang == "kk" && movie.TitleKK != "":
+        return movie.TitleKK
+    }
+    return movie.Title
+}
+
+// seatRowLabel is the row name printed in the hall, which is what a layout
+// edit preserves; seats from before layouts existed only have the number.
+func seatRowLabel(seat Seat) string {
+    if seat.RowLabel != "" {
+        return seat.RowLabel
+    }
+    return strconv.Itoa(seat.Row)
+}
+
+func localizedSeatList(seats []Seat, lang string) string {
+    if len(seats) == 0 {
+        return "-"
+    }
+    labels := make([]string, 0, len(seats))
+    for _, seat := range seats {
+        labels = append(labels, fmt.Sprintf(ticketLabels[lang]["seat"], seatRowLabel(seat), seat.Number))
+    }
+    return strings.Join(labels, "; ")
+}
+
+// localizedTicketLines prints one line per seat with its ticket type and
+// price. Bookings made before ticket types existed, whose rows carry no type
+// or price, fall back to the plain seat list.
+func localizedTicketLines(booking Booking, lang, currency string) string {
+    if len(booking.Items) == 0 {
+        return localizedSeatList(booking.Seats, lang)
+    }
+    for _, item := range booking.Items {
+        if item.TicketTypeID == nil {
+            return localizedSeatList(booking.Seats, lang)
+        }
+    }
+    seats := make(map[uint]Seat, len(booking.Seats))
+    for _, seat := range booking.Seats {
+        seats[seat.ID] = seat
+    }
+    lines := make([]string, 0, len(booking.Items))
+    for _, item := range booking.Items {
+        seat := seats[item.SeatID]
+        line := fmt.Sprintf(ticketLabels[lang]["seat"], seatRowLabel(seat), seat.Number)
+        if name := localizedTicketType(item.TicketType, lang); name != "" {
+            line += " — " + name
+        }
+        lines = append(lines, fmt.Sprintf("%s: %d %s", line, item.Price, currency))
+    }
+    return strings.Join(lines, "\n")
+}
+
+// formatTicketTime prints the start in the cinema's time zone, whatever zone
+// the database driver returned it in.
+func formatTicketTime(t time.Time, lang string, loc *time.Location) string {
+    t = t.In(loc)
+    if lang == "en" {
+        return t.Format("Jan 2, 2006 15:04")
+    }
+    return t.Format("02.01.2006 15:04")
+}
+
+// renderTicketPDF lays out a one-page ticket with an embedded Unicode font,
+// so Cyrillic and Kazakh titles print as-is.
+func renderTicketPDF(booking Booking, lang, currency, qrPayload string, loc *time.Location, posters *posterCache) ([]byte, error) {
+    labels := ticketLabels[lang]
+    fonts, err := loadTicketFonts()
+    if err != nil {
+        return nil, err
+    }
+    pdf := gofpdf.New("P", "mm", "A4", "")
+    for style, font := range fonts {
+        pdf.AddUTF8FontFromBytes(ticketFontFamily, style, font)
+    }
+    pdf.SetMargins(20, 20, 20)
+    pdf.AddPage()
+
+    pdf.SetFont(ticketFontFamily, "B", 20)
+    pdf.Cell(0, 12, "Kinoform — "+labels["heading"])
+    pdf.Ln(16)
+
+    top := pdf.GetY()
+    textX := 20.0
+    if poster, imageType := posters.get(booking.Session.Movie.PosterURL); poster != nil {
+        opts := gofpdf.ImageOptions{ImageType: imageType, ReadDpi: false}
+        pdf.RegisterImageOptionsReader("poster", opts, bytes.NewReader(poster))
+        if pdf.Ok() {
+            pdf.ImageOptions("poster", 20, top, 45, 0, false, opts, 0, "")
+            textX = 72
+        } else {
+            pdf.ClearError()
+        }
+    }
+
+    pdf.SetFont(ticketFontFamily, "B", 16)
+    pdf.SetXY(textX, top)
+    pdf.MultiCell(0, 8, localizedTitle(booking.Session.Movie, lang), "", "L", false)
+    pdf.Ln(2)
+
+    rows := [][2]string{
+        {labels["booking"], fmt.Sprintf("#%d", booking.ID)},
+        {labels["hall"], booking.Session.Hall.Name},
+        {labels["start"], formatTicketTime(booking.Session.StartTime, lang, loc)},
+        {labels["seats"], localizedTicketLines(booking, lang, currency)},
+        {labels["price"], fmt.Sprintf("%d %s", booking.TotalPrice, currency)},
+        {labels["status"], localizedStatus(booking.Status, lang)},
+    }
+    for _, row := range rows {
+        pdf.SetX(textX)
+        pdf.SetFont(ticketFontFamily, "B", 11)
+        pdf.CellFormat(30, 7, row[0]+":", "", 0, "L", false, 0, "")
+        pdf.SetFont(ticketFontFamily, "", 11)
+        pdf.MultiCell(0, 7, row[1], "", "L", false)
+    }
+
+    y := pdf.GetY() + 8
+    if y < top+75 {
+        y = top + 75
+    }
+    if qr, err := qrcode.Encode(qrPayload, qrcode.Medium, 200); err == nil {
+        opts := gofpdf.ImageOptions{ImageType: "PNG", ReadDpi: true}
+        pdf.RegisterImageOptionsReader("qr", opts, bytes.NewReader(qr))
+        pdf.ImageOptions("qr", 20, y, 45, 45, false, opts, 0, "")
+        y += 50
+    }
+    pdf.SetXY(20, y)
+    pdf.SetFont(ticketFontFamily, "", 10)
+    pdf.MultiCell(0, 6, labels["footer"], "", "L", false)
+
+    var buf bytes.Buffer
+    if err := pdf.Output(&buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func localizedStatus(status, lang string) string {
+    if label, ok := ticketLabels[lang][status]; ok {
+        return label
+    }
+    return status
+}
+
+// posterCache fetches movie posters for tickets. Uploaded posters are read
+// from the uploads directory; remote ones only from the hosts listed in
+// POSTER_HOSTS, and the result (including a miss) is kept for a while so a
+// slow image CDN does not stall every ticket download.
+type posterCache struct {
+    hosts   map[string]bool
+    client  *http.Client
+    mu      sync.Mutex
+    entries map[string]posterEntry
+}
+
+type posterEntry struct {
+    data      []byte
+    imageType string
+    expires   time.Time
+}
+
+const (
+    maxPosterBytes   = 5 << 20
+    maxCachedPosters = 64
+    posterCacheTTL   = time.Hour
+    posterMissTTL    = 5 * time.Minute
+)
+
+func newPosterCache(hosts []string) *posterCache {
+    allowed := make(map[string]bool, len(hosts))
+    for _, host := range hosts {
+        if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+            allowed[host] = true
+        }
+    }
+    p := &posterCache{
+        hosts:   allowed,
+        entries: map[string]posterEntry{},
+    }
+    p.client = &http.Client{
+        Timeout: 5 * time.Second,
+        // Every hop must stay on an allowed host, or a redirect could reach
+        // internal addresses.
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if len(via) >= 3 {
+                return errors.New("too many poster redirects")
+            }
+            return p.allowed(req.URL)
+        },
+    }
+    return p
+}
+
+// get returns the poster image and its gofpdf type, or nil when there is
+// none. Any failure just leaves the ticket without a picture.
+func (p *posterCache) get(posterURL string) ([]byte, string) {
+    if p == nil || posterURL == "" {
+        return nil, ""
+    }
+    if strings.HasPrefix(posterURL, "/uploads/") {
+        data, err := readUploadedPoster(posterURL)
+        if err != nil {
+            return nil, ""
+        }
+        return posterImage(data)
+    }
+
+    now := time.Now()
+    p.mu.Lock()
+    entry, ok := p.entries[posterURL]
+    p.mu.Unlock()
+    if ok && now.Before(entry.expires) {
+        return entry.data, entry.imageType
+    }
+
+    entry = posterEntry{expires: now.Add(posterMissTTL)}
+    if data, err := p.fetchRemote(posterURL); err == nil {
+        if entry.data, entry.imageType = posterImage(data); entry.data != nil {
+            entry.expires = now.Add(posterCacheTTL)
+        }
+    }
+
+    p.mu.Lock()
+    if len(p.entries) >= maxCachedPosters {
+        for key, cached := range p.entries {
+            if now.After(cached.expires) {
+                delete(p.entries, key)
+            }
+        }
+        if len(p.entries) >= maxCachedPosters {
+            p.entries = map[string]posterEntry{}
+        }
+    }
+    p.entries[posterURL] = entry
+    p.mu.Unlock()
+    return entry.data, entry.imageType
+}
+
+func (p *posterCache) fetchRemote(posterURL string) ([]byte, error) {
+    parsed, err := url.Parse(posterURL)
+    if err != nil {
+        return nil, err
+    }
+    if err := p.allowed(parsed); err != nil {
+        return nil, err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+    if err != nil {
+        return nil, err
+    }
+    // gofpdf cannot decode WebP, so ask image CDNs for a classic format.
+    req.Header.Set("Accept", "image/jpeg,image/png")
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("poster fetch: status %d", resp.StatusCode)
+    }
+    return io.ReadAll(io.LimitReader(resp.Body, maxPosterBytes))
+}
+
+func (p *posterCache) allowed(u *url.URL) error {
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return errors.New("unsupported poster url")
+    }
+    if !p.hosts[strings.ToLower(u.Hostname())] {
+        return errors.New("poster host not allowed")
+    }
+    return nil
+}
+
+// readUploadedPoster reads a /uploads/ path, refusing anything that resolves
+// outside the uploads directory.
+func readUploadedPoster(posterURL string) ([]byte, error) {
+    root, err := filepath.Abs("uploads")
+    if err != nil {
+        return nil, err
+    }
+    target, err := filepath.Abs(filepath.FromSlash(strings.TrimPrefix(posterURL, "/")))
+    if err != nil {
+        return nil, err
+    }
+    rel, err := filepath.Rel(root, target)
+    if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return nil, errors.New("poster path outside uploads")
+    }
+    file, err := os.Open(target)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    return io.ReadAll(io.LimitReader(file, maxPosterBytes))
+}
+
+func posterImage(data []byte) ([]byte, string) {
+    switch http.DetectContentType(data) {
+    case "image/jpeg":
+        return data, "JPG"
+    case "image/png":
+        return data, "PNG"
+    case "image/gif":
+        return data, "GIF"
+    }
+    return nil, ""
+}
@@ -0,0 +1,321 @@
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    ModifierPercent = "percent"
+    ModifierFixed   = "fixed"
+
+    defaultTicketType = "adult"
+)
+
+var errUnknownTicketType = errors.New("unknown ticket type")
+
+// TicketType adjusts the session's base price for a category of visitor.
+// A percent modifier of -40 sells the seat at 60% of the base price; a fixed
+// modifier adds its value (negative for a discount) to the base price.
+type TicketType struct {
+    ID            uint      `gorm:"primaryKey" json:"id"`
+    Code          string    `gorm:"uniqueIndex;not null" json:"code"`
+    Name          string    `json:"name"`
+    NameEN        string    `json:"name_en"`
+    NameKK        string    `json:"name_kk"`
+    ModifierType  string    `gorm:"not null;default:percent" json:"modifier_type"`
+    ModifierValue int       `gorm:"not null;default:0" json:"modifier_value"`
+    Active        bool      `gorm:"not null;default:true" json:"active"`
+    SortOrder     int       `gorm:"not null;default:0" json:"sort_order"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+type TicketTypeRequest struct {
+    Code          string `json:"code"`
+    Name          string `json:"name"`
+    NameEN        string `json:"name_en"`
+    NameKK        string `json:"name_kk"`
+    ModifierType  string `json:"modifier_type"`
+    ModifierValue int    `json:"modifier_value"`
+    Active        *bool  `json:"active"`
+    SortOrder     int    `json:"sort_order"`
+}
+
+// TicketSelection picks the ticket type for one seat of a purchase.
+type TicketSelection struct {
+    SeatID     uint   `json:"seat_id"`
+    TicketType string `json:"ticket_type"`
+}
+
+var builtinTicketTypes = []TicketType{
+    {Code: defaultTicketType, Name: "Взрослый", NameEN: "Adult", NameKK: "Ересек", ModifierType: ModifierPercent, ModifierValue: 0, SortOrder: 1},
+    {Code: "child", Name: "Детский", NameEN: "Child", NameKK: "Балалар", ModifierType: ModifierPercent, ModifierValue: -40, SortOrder: 2},
+    {Code: "student", Name: "Студенческий", NameEN: "Student", NameKK: "Студенттік", ModifierType: ModifierPercent, ModifierValue: -25, SortOrder: 3},
+    {Code: "senior", Name: "Пенсионный", NameEN: "Senior", NameKK: "Зейнеткерлік", ModifierType: ModifierPercent, ModifierValue: -30, SortOrder: 4},
+}
+
+func seedTicketTypes(db *gorm.DB) error {
+    for _, tt := range builtinTicketTypes {
+        tt := tt
+        tt.Active = true
+        if err := db.Where(TicketType{Code: tt.Code}).FirstOrCreate(&tt).Error; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// backfillBookingSeatTypes gives seats sold before ticket types existed the
+// adult type and an even share of the booking total, so their tickets and
+// refunds show real prices instead of 0.
+func backfillBookingSeatTypes(db *gorm.DB) error {
+    return db.Exec(`UPDATE booking_seats
+        SET ticket_type_id = (SELECT id FROM ticket_types WHERE code = ?),
+            price = bookings.total_price / counts.seats
+        FROM bookings, (SELECT booking_id, COUNT(*) AS seats FROM booking_seats GROUP BY booking_id) AS counts
+        WHERE booking_seats.ticket_type_id IS NULL
+            AND bookings.id = booking_seats.booking_id
+            AND counts.booking_id = booking_seats.booking_id`, defaultTicketType).Error
+}
+
+// Apply returns the price of one seat sold with this ticket type.
+func (t TicketType) Apply(basePrice int) int {
+    price := basePrice
+    switch t.ModifierType {
+    case ModifierPercent:
+        price = basePrice * (100 + t.ModifierValue) / 100
+    case ModifierFixed:
+        price = basePrice + t.ModifierValue
+    }
+    if price < 0 {
+        price = 0
+    }
+    return price
+}
+
+func localizedTicketType(t *TicketType, lang string) string {
+    switch {
+    case t == nil:
+        return ""
+    case lang == "en" && t.NameEN != "":
+        return t.NameEN
+    case lang == "kk" && t.NameKK != "":
+        return t.NameKK
+    }
+    return t.Name
+}
+
+// ticketSelections pairs every requested seat with its ticket type code.
+// Seats listed only in tickets are added to seatIDs; seats without an entry
+// are sold as adult tickets.
+func ticketSelections(seatIDs []uint, tickets []TicketSelection) ([]uint, []TicketSelection, error) {
+    types := make(map[uint]string, len(tickets))
+    for _, t := range tickets {
+        if t.SeatID == 0 {
+            return nil, nil, errors.New("every ticket needs a seat_id")
+        }
+        types[t.SeatID] = strings.ToLower(strings.TrimSpace(t.TicketType))
+    }
+    requested := make(map[uint]bool, len(seatIDs))
+    ids := make([]uint, 0, len(seatIDs)+len(tickets))
+    for _, id := range seatIDs {
+        if !requested[id] {
+            requested[id] = true
+            ids = append(ids, id)
+        }
+    }
+    for _, t := range tickets {
+        if !requested[t.SeatID] {
+            requested[t.SeatID] = true
+            ids = append(ids, t.SeatID)
+        }
+    }
+    selections := make([]TicketSelection, 0, len(ids))
+    for _, id := range ids {
+        code := types[id]
+        if code == "" {
+            code = defaultTicketType
+        }
+        selections = append(selections, TicketSelection{SeatID: id, TicketType: code})
+    }
+    return ids, selections, nil
+}
+
+// priceTickets resolves the ticket types of a purchase and returns the
+// booked seat rows (without booking ID) together with the total. The format
+// surcharge is added to the base price, then the seat category multiplier
+// and finally the ticket type modifier are applied.
+func priceTickets(tx *gorm.DB, session Session, selections []TicketSelection) ([]BookingSeat, int, error) {
+    seatIDs := make([]uint, 0, len(selections))
+    for _, sel := range selections {
+        seatIDs = append(seatIDs, sel.SeatID)
+    }
+    multipliers, categories, err := seatMultipliers(tx, seatIDs)
+    if err != nil {
+        return nil, 0, err
+    }
+    var types []TicketType
+    if err := tx.Where("active = ?", true).Find(&types).Error; err != nil {
+        return nil, 0, err
+    }
+    byCode := make(map[string]TicketType, len(types))
+    for _, t := range types {
+        byCode[t.Code] = t
+    }
+    surcharge, err := formatSurcharge(tx, session.Format)
+    if err != nil {
+        return nil, 0, err
+    }
+    base := session.BasePrice + surcharge
+    items := make([]BookingSeat, 0, len(selections))
+    total := 0
+    for _, sel := range selections {
+        tt, ok := byCode[sel.TicketType]
+        if !ok {
+            return nil, 0, fmt.Errorf("%w: %s", errUnknownTicketType, sel.TicketType)
+        }
+        multiplier, ok := multipliers[sel.SeatID]
+        if !ok {
+            multiplier = 100
+        }
+        price := tt.Apply(base * multiplier / 100)
+        items = append(items, BookingSeat{SeatID: sel.SeatID, TicketTypeID: &tt.ID, SeatCategory: categories[sel.SeatID], Price: price})
+        total += price
+    }
+    return items, total, nil
+}
+
+func listTicketTypes(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        query := db.Order("sort_order asc, id asc")
+        if c.Query("all") != "1" {
+            query = query.Where("active = ?", true)
+        }
+        var types []TicketType
+        if err := query.Find(&types).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load ticket types"})
+            return
+        }
+        c.JSON(http.StatusOK, types)
+    }
+}
+
+func (req *TicketTypeRequest) validate() error {
+    req.Code = strings.ToLower(strings.TrimSpace(req.Code))
+    req.Name = strings.TrimSpace(req.Name)
+    req.ModifierType = strings.ToLower(strings.TrimSpace(req.ModifierType))
+    if req.ModifierType == "" {
+        req.ModifierType = ModifierPercent
+    }
+    if req.Code == "" || req.Name == "" {
+        return errors.New("code and name are required")
+    }
+    switch req.ModifierType {
+    case ModifierPercent:
+        if req.ModifierValue < -100 {
+            return errors.New("percent modifier cannot be below -100")
+        }
+    case ModifierFixed:
+    default:
+        return errors.New("modifier_type must be percent or fixed")
+    }
+    return nil
+}
+
+func createTicketType(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req TicketTypeRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        if err := req.validate(); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        tt := TicketType{
+            Code:          req.Code,
+            Name:          req.Name,
+            NameEN:        strings.TrimSpace(req.NameEN),
+            NameKK:        strings.TrimSpace(req.NameKK),
+            ModifierType:  req.ModifierType,
+            ModifierValue: req.ModifierValue,
+            Active:        req.Active == nil || *req.Active,
+            SortOrder:     req.SortOrder,
+        }
+        var count int64
+        if err := db.Model(&TicketType{}).Where("code = ?", tt.Code).Count(&count).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create ticket type"})
+            return
+        }
+        if count > 0 {
+            c.JSON(http.StatusConflict, gin.H{"error": "ticket type already exists"})
+            return
+        }
+        if err := db.Create(&tt).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create ticket type"})
+            return
+        }
+        c.JSON(http.StatusCreated, tt)
+    }
+}
+
+// updateTicketType edits a ticket type. Types are never deleted because sold
+// seats refer to them; set active to false to withdraw one from sale.
+func updateTicketType(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var tt TicketType
+        if err := db.First(&tt, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "ticket type not found"})
+            return
+        }
+        var req TicketTypeRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        if strings.TrimSpace(req.Code) == "" {
+            req.Code = tt.Code
+        }
+        if err := req.validate(); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if req.Code != tt.Code {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "code cannot be changed"})
+            return
+        }
+        active := tt.Active
+        if req.Active != nil {
+            active = *req.Active
+        }
+        if tt.Code == defaultTicketType && !active {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "the default ticket type cannot be deactivated"})
+            return
+        }
+        if err := db.Model(&tt).Updates(map[string]interface{}{
+            "name":           req.Name,
+            "name_en":        strings.TrimSpace(req.NameEN),
+            "name_kk":        strings.TrimSpace(req.NameKK),
+            "modifier_type":  req.ModifierType,
+            "modifier_value": req.ModifierValue,
+            "active":         active,
+            "sort_order":     req.SortOrder,
+        }).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update ticket type"})
+            return
+        }
+        if err := db.First(&tt, tt.ID).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load ticket type"})
+            return
+        }
+        c.JSON(http.StatusOK, tt)
+    }
+}
@@ -0,0 +1,247 @@
+
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/golang-jwt/jwt/v5"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+)
+
+// RefreshToken is stored hashed. Every refresh rotates the token within its
+// family; presenting an already rotated token means it leaked, so the whole
+// family is revoked.
+type RefreshToken struct {
+    ID           uint       `gorm:"primaryKey" json:"id"`
+    UserID       uint       `gorm:"index" json:"user_id"`
+    TokenHash    string     `gorm:"uniqueIndex" json:"-"`
+    FamilyID     string     `gorm:"index" json:"family_id"`
+    ExpiresAt    time.Time  `json:"expires_at"`
+    RevokedAt    *time.Time `json:"revoked_at"`
+    ReplacedByID *uint      `json:"replaced_by_id"`
+    UserAgent    string     `json:"user_agent"`
+    IP           string     `json:"ip"`
+    CreatedAt    time.Time  `json:"created_at"`
+}
+
+// RevokedToken blacklists a single access token (by jti) until it expires,
+// which is how logout ends the current access token early.
+type RevokedToken struct {
+    JTI       string    `gorm:"primaryKey" json:"jti"`
+    ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+}
+
+type RefreshRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+    RefreshToken string `json:"refresh_token"`
+    All          bool   `json:"all"`
+}
+
+type TokenPair struct {
+    AccessToken  string `json:"token"`
+    RefreshToken string `json:"refresh_token"`
+    ExpiresIn    int    `json:"expires_in"`
+}
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+func hashToken(raw string) string {
+    sum := sha256.Sum256([]byte(raw))
+    return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates an access token and a refresh token in familyID, or in
+// a new family when familyID is empty (i.e. on login).
+func issueTokens(db *gorm.DB, c *gin.Context, user User, cfg Config, familyID string) (TokenPair, uint, error) {
+    access, err := createToken(user, cfg.JwtSecret, cfg.AccessTokenTTL)
+    if err != nil {
+        return TokenPair{}, 0, err
+    }
+    if familyID == "" {
+        familyID = randomHex(16)
+    }
+    raw := randomHex(32)
+    refresh := RefreshToken{
+        UserID:    user.ID,
+        TokenHash: hashToken(raw),
+        FamilyID:  familyID,
+        ExpiresAt: time.Now().Add(cfg.RefreshTokenTTL),
+        UserAgent: c.Request.UserAgent(),
+        IP:        c.ClientIP(),
+    }
+    if err := db.Create(&refresh).Error; err != nil {
+        return TokenPair{}, 0, err
+    }
+    return TokenPair{AccessToken: access, RefreshToken: raw, ExpiresIn: int(cfg.AccessTokenTTL.Seconds())}, refresh.ID, nil
+}
+
+// revokeAllTokens invalidates every outstanding access token by bumping the
+// user's token version and revokes all of their refresh tokens.
+func revokeAllTokens(tx *gorm.DB, userID uint) error {
+    if err := tx.Model(&User{}).Where("id = ?", userID).
+        UpdateColumn("token_version", gorm.Expr("token_version + 1")).Error; err != nil {
+        return err
+    }
+    return tx.Model(&RefreshToken{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+        Update("revoked_at", time.Now()).Error
+}
+
+func refreshHandler(db *gorm.DB, cfg Config) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req RefreshRequest
+        if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.RefreshToken) == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+            return
+        }
+
+        var current RefreshToken
+        if err := db.Where("token_hash = ?", hashToken(strings.TrimSpace(req.RefreshToken))).First(&current).Error; err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+            return
+        }
+        if current.RevokedAt != nil {
+            // Reuse of a rotated token: someone else holds a copy.
+            if err := db.Model(&RefreshToken{}).Where("family_id = ? AND revoked_at IS NULL", current.FamilyID).
+                Update("revoked_at", time.Now()).Error; err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+                return
+            }
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+            return
+        }
+        if !current.ExpiresAt.After(time.Now()) {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+            return
+        }
+        var user User
+        if err := db.First(&user, current.UserID).Error; err != nil || user.DisabledAt != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+            return
+        }
+        if !user.TwoFactorEnabled {
+            // Staff must go through the 2FA login; a refresh token issued
+            // before they became staff does not get them around it.
+            mandatory, err := twoFactorMandatory(db, user.ID)
+            if err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+                return
+            }
+            if mandatory {
+                if err := db.Transaction(func(tx *gorm.DB) error {
+                    return revokeAllTokens(tx, user.ID)
+                }); err != nil {
+                    c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+                    return
+                }
+                c.JSON(http.StatusUnauthorized, gin.H{"error": "two-factor authentication is required for staff accounts"})
+                return
+            }
+        }
+
+        var pair TokenPair
+        err := db.Transaction(func(tx *gorm.DB) error {
+            res := tx.Model(&RefreshToken{}).Where("id = ? AND revoked_at IS NULL", current.ID).Update("revoked_at", time.Now())
+            if res.Error != nil {
+                return res.Error
+            }
+            if res.RowsAffected == 0 {
+                // Lost a race with a concurrent refresh of the same token.
+                return errInvalidRefreshToken
+            }
+            var newID uint
+            var err error
+            pair, newID, err = issueTokens(tx, c, user, cfg, current.FamilyID)
+            if err != nil {
+                return err
+            }
+            return tx.Model(&RefreshToken{}).Where("id = ?", current.ID).Update("replaced_by_id", newID).Error
+        })
+        if errors.Is(err, errInvalidRefreshToken) {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+            return
+        }
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "user": user})
+    }
+}
+
+func logoutHandler(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.GetUint("user_id")
+        var req LogoutRequest
+        if c.Request.ContentLength > 0 {
+            if err := c.ShouldBindJSON(&req); err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+                return
+            }
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            if req.All {
+                return revokeAllTokens(tx, userID)
+            }
+            if jti := c.GetString("token_id"); jti != "" {
+                expires, _ := c.Get("token_expires")
+                expiresAt, _ := expires.(time.Time)
+                if err := tx.Create(&RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error; err != nil {
+                    return err
+                }
+            }
+            if token := strings.TrimSpace(req.RefreshToken); token != "" {
+                return tx.Model(&RefreshToken{}).
+                    Where("token_hash = ? AND user_id = ? AND revoked_at IS NULL", hashToken(token), userID).
+                    Update("revoked_at", time.Now()).Error
+            }
+            return nil
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log out"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
+
+func parseAccessToken(tokenStr, secret string) (*Claims, error) {
+    token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+        if token.Method != jwt.SigningMethodHS256 {
+            return nil, errors.New("unexpected signing method")
+        }
+        return []byte(secret), nil
+    })
+    if err != nil || !token.Valid {
+        return nil, errors.New("invalid token")
+    }
+    claims, ok := token.Claims.(*Claims)
+    if !ok {
+        return nil, errors.New("invalid token")
+    }
+    return claims, nil
+}
+
+// runTokenSweeper drops revocation records that can no longer matter.
+func runTokenSweeper(db *gorm.DB, logger *zap.Logger, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        now := time.Now()
+        if err := db.Where("expires_at <= ?", now).Delete(&RevokedToken{}).Error; err != nil {
+            logger.Warn("failed to purge revoked tokens", zap.Error(err))
+        }
+        if err := db.Where("expires_at <= ?", now).Delete(&RefreshToken{}).Error; err != nil {
+            logger.Warn("failed to purge refresh tokens", zap.Error(err))
+        }
+    }
+}
@@ -0,0 +1,567 @@
+
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "encoding/base32"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    qrcode "github.com/skip2/go-qrcode"
+    "go.uber.org/zap"
+    "golang.org/x/crypto/bcrypt"
+    "gorm.io/gorm"
+)
+
+const (
+    totpPeriod        = 30
+    totpDigits        = 6
+    totpSkew          = 1
+    challengeTTL      = 5 * time.Minute
+    recoveryCodeCount = 10
+
+    challengeLogin = "login"
+    challengeSetup = "setup"
+)
+
+var errInvalidChallenge = errors.New("invalid or expired challenge")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCode is a single-use fallback for a lost authenticator. Only the
+// hash is stored.
+type RecoveryCode struct {
+    ID        uint       `gorm:"primaryKey" json:"id"`
+    UserID    uint       `gorm:"index;not null" json:"user_id"`
+    CodeHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+    UsedAt    *time.Time `json:"used_at"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+type ChallengeRequest struct {
+    ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+type TwoFactorVerifyRequest struct {
+    ChallengeToken string `json:"challenge_token" binding:"required"`
+    Code           string `json:"code"`
+    RecoveryCode   string `json:"recovery_code"`
+}
+
+type TwoFactorCodeRequest struct {
+    Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorDisableRequest struct {
+    Password string `json:"password" binding:"required"`
+    Code     string `json:"code" binding:"required"`
+}
+
+func newTOTPSecret() (string, error) {
+    buf := make([]byte, 20)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpCode implements RFC 6238 with the defaults authenticator apps expect:
+// HMAC-SHA1, 30 second steps, six digits.
+func totpCode(secret string, step int64) (string, error) {
+    key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return "", err
+    }
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// matchTOTP returns the time step the code belongs to, or -1. One step of
+// clock drift is tolerated either way.
+func matchTOTP(secret, code string, now time.Time) int64 {
+    code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+    if len(code) != totpDigits {
+        return -1
+    }
+    current := now.Unix() / totpPeriod
+    for d := -totpSkew; d <= totpSkew; d++ {
+        step := current + int64(d)
+        expected, err := totpCode(secret, step)
+        if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+            return step
+        }
+    }
+    return -1
+}
+
+func totpURI(issuer, account, secret string) string {
+    query := url.Values{}
+    query.Set("secret", secret)
+    query.Set("issuer", issuer)
+    query.Set("algorithm", "SHA1")
+    query.Set("digits", strconv.Itoa(totpDigits))
+    query.Set("period", strconv.Itoa(totpPeriod))
+    return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+// checkTOTP accepts a code for the user's active secret at most once: the
+// step is stored so a code seen on the wire cannot be replayed.
+func checkTOTP(db *gorm.DB, user User, code string) bool {
+    if !user.TwoFactorEnabled || user.TOTPSecret == "" {
+        return false
+    }
+    step := matchTOTP(user.TOTPSecret, code, time.Now())
+    if step < 0 {
+        return false
+    }
+    result := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+    return result.Error == nil && result.RowsAffected == 1
+}
+
+func normalizeRecoveryCode(code string) string {
+    code = strings.ToLower(strings.TrimSpace(code))
+    return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func useRecoveryCode(db *gorm.DB, userID uint, code string) bool {
+    code = normalizeRecoveryCode(code)
+    if code == "" {
+        return false
+    }
+    result := db.Model(&RecoveryCode{}).
+        Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+        Update("used_at", time.Now())
+    return result.Error == nil && result.RowsAffected == 1
+}
+
+// replaceRecoveryCodes invalidates any previous codes and returns a fresh set
+// in plain text; this is the only time the user gets to see them.
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+    if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+        return nil, err
+    }
+    codes := make([]string, 0, recoveryCodeCount)
+    rows := make([]RecoveryCode, 0, recoveryCodeCount)
+    for i := 0; i < recoveryCodeCount; i++ {
+        raw := randomHex(5)
+        codes = append(codes, raw[:5]+"-"+raw[5:])
+        rows = append(rows, RecoveryCode{UserID: userID, CodeHash: hashToken(raw)})
+    }
+    if err := tx.Create(&rows).Error; err != nil {
+        return nil, err
+    }
+    return codes, nil
+}
+
+// signChallenge issues the short-lived token handed out between the password
+// step and the second factor. It is bound to the password hash and token
+// version, so a password change or "log out everywhere" voids it.
+func signChallenge(key []byte, user User, purpose string, expires time.Time) string {
+    body := fmt.Sprintf("%d.%s.%d", user.ID, purpose, expires.Unix())
+    return body + "." + base64.RawURLEncoding.EncodeToString(ticketMAC(key, challengeData(body, user)))
+}
+
+func challengeData(body string, user User) string {
+    return fmt.Sprintf("%s.%d.%s", body, user.TokenVersion, user.PasswordHash)
+}
+
+func verifyChallenge(db *gorm.DB, key []byte, token, purpose string) (User, error) {
+    parts := strings.Split(strings.TrimSpace(token), ".")
+    if len(parts) != 4 || parts[1] != purpose {
+        return User{}, errInvalidChallenge
+    }
+    userID, err := strconv.ParseUint(parts[0], 10, 64)
+    if err != nil {
+        return User{}, errInvalidChallenge
+    }
+    expires, err := strconv.ParseInt(parts[2], 10, 64)
+    if err != nil || time.Now().Unix() > expires {
+        return User{}, errInvalidChallenge
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+    if err != nil {
+        return User{}, errInvalidChallenge
+    }
+    var user User
+    if err := db.First(&user, uint(userID)).Error; err != nil {
+        return User{}, errInvalidChallenge
+    }
+    if !hmac.Equal(sig, ticketMAC(key, challengeData(strings.Join(parts[:3], "."), user))) {
+        return User{}, errInvalidChallenge
+    }
+    if user.DisabledAt != nil {
+        return User{}, errInvalidChallenge
+    }
+    return user, nil
+}
+
+// twoFactorMandatory reports whether the user holds any staff permission;
+// those accounts cannot sign in with a password alone.
+func twoFactorMandatory(db *gorm.DB, userID uint) (bool, error) {
+    perms, err := userPermissions(db, userID)
+    if err != nil {
+        return false, err
+    }
+    return len(perms) > 0, nil
+}
+
+// revokeUnenrolledStaffTokens ends the sessions of staff who have not set up
+// a second factor, e.g. ones that predate the 2FA requirement. They have to
+// sign in again, which walks them through enrollment.
+func revokeUnenrolledStaffTokens(db *gorm.DB) error {
+    var userIDs []uint
+    if err := db.Model(&UserRole{}).
+        Distinct("user_roles.user_id").
+        Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+        Joins("JOIN users ON users.id = user_roles.user_id").
+        Where("users.two_factor_enabled = ?", false).
+        Where("EXISTS (SELECT 1 FROM refresh_tokens WHERE refresh_tokens.user_id = users.id AND refresh_tokens.revoked_at IS NULL)").
+        Pluck("user_roles.user_id", &userIDs).Error; err != nil {
+        return err
+    }
+    for _, userID := range userIDs {
+        if err := db.Transaction(func(tx *gorm.DB) error {
+            return revokeAllTokens(tx, userID)
+        }); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// respondTwoFactorChallenge answers the password step of the login when a
+// second factor is needed and reports whether it did so.
+func respondTwoFactorChallenge(c *gin.Context, db *gorm.DB, cfg Config, user User) bool {
+    purpose := challengeLogin
+    if !user.TwoFactorEnabled {
+        mandatory, err := twoFactorMandatory(db, user.ID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load permissions"})
+            return true
+        }
+        if !mandatory {
+            return false
+        }
+        purpose = challengeSetup
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "two_factor_required":       purpose == challengeLogin,
+        "two_factor_setup_required": purpose == challengeSetup,
+        "challenge_token":           signChallenge(cfg.TwoFactorKey, user, purpose, time.Now().Add(challengeTTL)),
+        "expires_in":                int(challengeTTL.Seconds()),
+    })
+    return true
+}
+
+// beginEnrollment stores a pending secret; it only becomes active once the
+// user proves their authenticator produces matching codes.
+func beginEnrollment(c *gin.Context, db *gorm.DB, cfg Config, user User) {
+    if user.TwoFactorEnabled {
+        c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication already enabled"})
+        return
+    }
+    secret, err := newTOTPSecret()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+        return
+    }
+    if err := db.Model(&User{}).Where("id = ?", user.ID).Update("totp_pending_secret", secret).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start enrollment"})
+        return
+    }
+    uri := totpURI(cfg.TOTPIssuer, user.Email, secret)
+    png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate qr"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "secret":      secret,
+        "otpauth_uri": uri,
+        "qr_png":      "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+    })
+}
+
+// completeEnrollment activates the pending secret and issues recovery codes.
+func completeEnrollment(db *gorm.DB, user User, code string) ([]string, bool, error) {
+    if user.TwoFactorEnabled || user.TOTPPendingSecret == "" {
+        return nil, false, nil
+    }
+    step := matchTOTP(user.TOTPPendingSecret, code, time.Now())
+    if step < 0 {
+        return nil, false, nil
+    }
+    var codes []string
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+            "totp_secret":         user.TOTPPendingSecret,
+            "totp_pending_secret": "",
+            "totp_last_step":      step,
+            "two_factor_enabled":  true,
+        }).Error; err != nil {
+            return err
+        }
+        var err error
+        codes, err = replaceRecoveryCodes(tx, user.ID)
+        if err != nil {
+            return err
+        }
+        return recordAudit(tx, user.ID, "user.2fa.enable", "user", user.ID, "", nil)
+    })
+    if err != nil {
+        return nil, false, err
+    }
+    return codes, true, nil
+}
+
+func twoFactorVerifyHandler(db *gorm.DB, cfg Config, limiter RateLimiter, logger *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req TwoFactorVerifyRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        user, err := verifyChallenge(db, cfg.TwoFactorKey, req.ChallengeToken, challengeLogin)
+        if err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+            return
+        }
+        if !checkRateLimit(c, limiter, logger, "2fa:user:"+strconv.FormatUint(uint64(user.ID), 10), 10, 15*time.Minute) {
+            return
+        }
+
+        ok := false
+        if strings.TrimSpace(req.RecoveryCode) != "" {
+            ok = useRecoveryCode(db, user.ID, req.RecoveryCode)
+        } else {
+            ok = checkTOTP(db, user, req.Code)
+        }
+        if !ok {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+            return
+        }
+
+        pair, _, err := issueTokens(db, c, user, cfg, "")
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "user": user})
+    }
+}
+
+// twoFactorSetupHandler lets staff without a second factor enroll using the
+// setup challenge from the login step, since they cannot get an access token
+// until they do.
+func twoFactorSetupHandler(db *gorm.DB, cfg Config) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req ChallengeRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        user, err := verifyChallenge(db, cfg.TwoFactorKey, req.ChallengeToken, challengeSetup)
+        if err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+            return
+        }
+        beginEnrollment(c, db, cfg, user)
+    }
+}
+
+func twoFactorSetupConfirmHandler(db *gorm.DB, cfg Config) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req TwoFactorVerifyRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        user, err := verifyChallenge(db, cfg.TwoFactorKey, req.ChallengeToken, challengeSetup)
+        if err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+            return
+        }
+        codes, ok, err := completeEnrollment(db, user, req.Code)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable two-factor authentication"})
+            return
+        }
+        if !ok {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+            return
+        }
+        user.TwoFactorEnabled = true
+        pair, _, err := issueTokens(db, c, user, cfg, "")
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"recovery_codes": codes, "token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "user": user})
+    }
+}
+
+func enrollTwoFactorHandler(db *gorm.DB, cfg Config) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var user User
+        if err := db.First(&user, c.GetUint("user_id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        beginEnrollment(c, db, cfg, user)
+    }
+}
+
+func confirmTwoFactorHandler(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req TwoFactorCodeRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        var user User
+        if err := db.First(&user, c.GetUint("user_id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        codes, ok, err := completeEnrollment(db, user, req.Code)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable two-factor authentication"})
+            return
+        }
+        if !ok {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+    }
+}
+
+func disableTwoFactorHandler(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req TwoFactorDisableRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        var user User
+        if err := db.First(&user, c.GetUint("user_id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        if !user.TwoFactorEnabled {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"})
+            return
+        }
+        mandatory, err := twoFactorMandatory(db, user.ID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load permissions"})
+            return
+        }
+        if mandatory {
+            c.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication is required for staff accounts"})
+            return
+        }
+        if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid password"})
+            return
+        }
+        if !checkTOTP(db, user, req.Code) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+            return
+        }
+        if err := clearTwoFactor(db, user.ID, user.ID, "user.2fa.disable", ""); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable two-factor authentication"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "disabled"})
+    }
+}
+
+func regenerateRecoveryCodesHandler(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req TwoFactorCodeRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        var user User
+        if err := db.First(&user, c.GetUint("user_id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        if !checkTOTP(db, user, req.Code) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+            return
+        }
+        var codes []string
+        err := db.Transaction(func(tx *gorm.DB) error {
+            var err error
+            codes, err = replaceRecoveryCodes(tx, user.ID)
+            return err
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate recovery codes"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+    }
+}
+
+func clearTwoFactor(db *gorm.DB, actorID, userID uint, action, reason string) error {
+    return db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+            "totp_secret":         "",
+            "totp_pending_secret": "",
+            "two_factor_enabled":  false,
+        }).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+            return err
+        }
+        return recordAudit(tx, actorID, action, "user", userID, reason, nil)
+    })
+}
+
+// adminResetTwoFactor removes a user's second factor, e.g. after a lost
+// phone. Staff accounts will be asked to enroll again on the next login.
+func adminResetTwoFactor(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req UserStatusRequest
+        if c.Request.ContentLength > 0 {
+            if err := c.ShouldBindJSON(&req); err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+                return
+            }
+        }
+        var user User
+        if err := db.First(&user, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        if !canManageUser(c, db, user) {
+            return
+        }
+        if err := clearTwoFactor(db, c.GetUint("user_id"), user.ID, "user.2fa.reset", strings.TrimSpace(req.Reason)); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset two-factor authentication"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "reset"})
+    }
+}
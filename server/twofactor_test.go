@@ -0,0 +1,205 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// rfcSecret is the RFC 6238 SHA-1 test key "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+    // The RFC lists eight digit codes; ours are the last six of them.
+    cases := []struct {
+        unix int64
+        want string
+    }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1111111111, "050471"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+        {20000000000, "353130"},
+    }
+    for _, tc := range cases {
+        t.Run(strconv.FormatInt(tc.unix, 10), func(t *testing.T) {
+            got, err := totpCode(rfcSecret, tc.unix/totpPeriod)
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if got != tc.want {
+                t.Errorf("code = %s, want %s", got, tc.want)
+            }
+        })
+    }
+
+    t.Run("lower case secret", func(t *testing.T) {
+        got, err := totpCode(strings.ToLower(rfcSecret), 59/totpPeriod)
+        if err != nil || got != "287082" {
+            t.Errorf("code = %s, %v; want 287082", got, err)
+        }
+    })
+    t.Run("invalid secret", func(t *testing.T) {
+        if _, err := totpCode("not base32!", 1); err == nil {
+            t.Error("expected an error")
+        }
+    })
+}
+
+func TestMatchTOTP(t *testing.T) {
+    now := time.Unix(1234567890, 0)
+    current := now.Unix() / totpPeriod
+    codeAt := func(step int64) string {
+        code, err := totpCode(rfcSecret, step)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return code
+    }
+    current0 := codeAt(current)
+
+    cases := []struct {
+        name string
+        code string
+        want int64
+    }{
+        {"current step", current0, current},
+        {"one step behind", codeAt(current - 1), current - 1},
+        {"one step ahead", codeAt(current + 1), current + 1},
+        {"two steps behind", codeAt(current - 2), -1},
+        {"two steps ahead", codeAt(current + 2), -1},
+        {"spaces are ignored", " " + current0[:3] + " " + current0[3:] + " ", current},
+        {"too short", current0[:5], -1},
+        {"too long", current0 + "0", -1},
+        {"empty", "", -1},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            if got := matchTOTP(rfcSecret, tc.code, now); got != tc.want {
+                t.Errorf("step = %d, want %d", got, tc.want)
+            }
+        })
+    }
+
+    t.Run("last second of the step still accepts the previous code", func(t *testing.T) {
+        end := time.Unix((current+1)*totpPeriod-1, 0)
+        if got := matchTOTP(rfcSecret, codeAt(current-1), end); got != current-1 {
+            t.Errorf("step = %d, want %d", got, current-1)
+        }
+    })
+}
+
+func TestVerifyChallengeRejectsMalformed(t *testing.T) {
+    key := deriveKey("test-secret", "two-factor")
+    user := User{ID: 5, PasswordHash: "hash"}
+    valid := signChallenge(key, user, challengeLogin, time.Now().Add(challengeTTL))
+    parts := strings.Split(valid, ".")
+
+    // None of these reach the database, so no connection is needed.
+    cases := []struct {
+        name  string
+        token string
+    }{
+        {"expired", signChallenge(key, user, challengeLogin, time.Now().Add(-time.Second))},
+        {"wrong purpose", signChallenge(key, user, challengeSetup, time.Now().Add(challengeTTL))},
+        {"non-numeric user", "x." + strings.Join(parts[1:], ".")},
+        {"non-numeric expiry", parts[0] + "." + parts[1] + ".soon." + parts[3]},
+        {"signature not base64", strings.Join(parts[:3], ".") + ".!!!"},
+        {"missing signature", strings.Join(parts[:3], ".")},
+        {"empty", ""},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            if _, err := verifyChallenge(nil, key, tc.token, challengeLogin); !errors.Is(err, errInvalidChallenge) {
+                t.Errorf("expected errInvalidChallenge, got %v", err)
+            }
+        })
+    }
+}
+
+func TestVerifyChallenge(t *testing.T) {
+    db := openTestDB(t)
+    key := deriveKey("test-secret", "two-factor")
+    user := User{Name: "Staff", Email: "staff-" + randomHex(3) + "@example.com", PasswordHash: "hash"}
+    if err := db.Create(&user).Error; err != nil {
+        t.Fatalf("create user: %v", err)
+    }
+    expires := time.Now().Add(challengeTTL)
+    valid := signChallenge(key, user, challengeLogin, expires)
+    parts := strings.Split(valid, ".")
+
+    cases := []struct {
+        name   string
+        token  string
+        mutate map[string]interface{}
+        ok     bool
+    }{
+        {"valid", valid, nil, true},
+        {"another user's id", fmt.Sprintf("%d.", user.ID+1) + strings.Join(parts[1:], "."), nil, false},
+        {"expiry pushed back", parts[0] + "." + parts[1] + "." + strconv.FormatInt(expires.Add(time.Hour).Unix(), 10) + "." + parts[3], nil, false},
+        {"signed with another key", signChallenge(deriveKey("test-secret", "other"), user, challengeLogin, expires), nil, false},
+        {"password changed", valid, map[string]interface{}{"password_hash": "new hash"}, false},
+        {"logged out everywhere", valid, map[string]interface{}{"token_version": user.TokenVersion + 1}, false},
+        {"account disabled", valid, map[string]interface{}{"disabled_at": time.Now()}, false},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            if tc.mutate != nil {
+                if err := db.Model(&User{}).Where("id = ?", user.ID).Updates(tc.mutate).Error; err != nil {
+                    t.Fatalf("update user: %v", err)
+                }
+                t.Cleanup(func() {
+                    db.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+                        "password_hash": user.PasswordHash,
+                        "token_version": user.TokenVersion,
+                        "disabled_at":   nil,
+                    })
+                })
+            }
+            got, err := verifyChallenge(db, key, tc.token, challengeLogin)
+            if !tc.ok {
+                if !errors.Is(err, errInvalidChallenge) {
+                    t.Fatalf("expected errInvalidChallenge, got %v", err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if got.ID != user.ID {
+                t.Errorf("user = %d, want %d", got.ID, user.ID)
+            }
+        })
+    }
+}
+
+func TestCheckTOTPRejectsReplay(t *testing.T) {
+    db := openTestDB(t)
+    user := User{Name: "Staff", Email: "staff-" + randomHex(3) + "@example.com", TwoFactorEnabled: true, TOTPSecret: rfcSecret}
+    if err := db.Create(&user).Error; err != nil {
+        t.Fatalf("create user: %v", err)
+    }
+    current := time.Now().Unix() / totpPeriod
+    code, err := totpCode(rfcSecret, current)
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous, err := totpCode(rfcSecret, current-1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !checkTOTP(db, user, code) {
+        t.Fatal("first use of the code was rejected")
+    }
+    if checkTOTP(db, user, code) {
+        t.Error("the same code was accepted twice")
+    }
+    if checkTOTP(db, user, previous) {
+        t.Error("a code older than the last accepted one was accepted")
+    }
+}
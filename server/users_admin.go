@@ -0,0 +1,340 @@
+
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "golang.org/x/crypto/bcrypt"
+    "gorm.io/gorm"
+)
+
+type UserStatusRequest struct {
+    Reason string `json:"reason"`
+}
+
+type AdminResetPasswordRequest struct {
+    Password string `json:"password"`
+    Reason   string `json:"reason"`
+}
+
+type AdminFlagRequest struct {
+    IsAdmin bool   `json:"is_admin"`
+    Reason  string `json:"reason"`
+}
+
+// pageParams reads page/per_page query parameters with sane bounds.
+func pageParams(c *gin.Context, defaultPerPage, maxPerPage int) (int, int) {
+    page, err := strconv.Atoi(c.Query("page"))
+    if err != nil || page < 1 {
+        page = 1
+    }
+    perPage, err := strconv.Atoi(c.Query("per_page"))
+    if err != nil || perPage < 1 {
+        perPage = defaultPerPage
+    }
+    if perPage > maxPerPage {
+        perPage = maxPerPage
+    }
+    return page, perPage
+}
+
+func listUsers(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        page, perPage := pageParams(c, 20, 100)
+        query := db.Model(&User{})
+        if q := strings.TrimSpace(c.Query("q")); q != "" {
+            like := "%" + strings.ToLower(q) + "%"
+            query = query.Where("LOWER(name) LIKE ? OR LOWER(email) LIKE ?", like, like)
+        }
+        switch c.Query("status") {
+        case "disabled":
+            query = query.Where("disabled_at IS NOT NULL")
+        case "active":
+            query = query.Where("disabled_at IS NULL")
+        }
+        if c.Query("admin") == "true" {
+            query = query.Where("is_admin = ?", true)
+        }
+
+        var total int64
+        if err := query.Count(&total).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load users"})
+            return
+        }
+        users := make([]User, 0)
+        if err := query.Order("created_at desc").Offset((page - 1) * perPage).Limit(perPage).Find(&users).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load users"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"items": users, "total": total, "page": page, "per_page": perPage})
+    }
+}
+
+func getUserDetail(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var user User
+        if err := db.First(&user, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        perms, err := userPermissions(db, user.ID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load permissions"})
+            return
+        }
+        user.Permissions = permissionList(perms)
+
+        roles := make([]Role, 0)
+        if err := db.Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+            Where("user_roles.user_id = ?", user.ID).Order("roles.name asc").Find(&roles).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load roles"})
+            return
+        }
+        bookings := make([]Booking, 0)
+        if err := db.Preload("Session.Movie").Preload("Session.Hall").Preload("Seats").
+            Where("user_id = ?", user.ID).Order("created_at desc").Find(&bookings).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load bookings"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"user": user, "roles": roles, "bookings": bookings})
+    }
+}
+
+// canManageUser answers 403 itself when target holds full access and the
+// acting user does not; users.manage must not be a path to taking over a
+// super admin's account.
+func canManageUser(c *gin.Context, db *gorm.DB, target User) bool {
+    actorPerms := c.MustGet("permissions").(map[string]bool)
+    if hasPermission(actorPerms, PermAll) {
+        return true
+    }
+    targetPerms, err := userPermissions(db, target.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load permissions"})
+        return false
+    }
+    if targetPerms[PermAll] {
+        c.JSON(http.StatusForbidden, gin.H{"error": "only super admins can manage a super admin"})
+        return false
+    }
+    return true
+}
+
+func setUserDisabled(db *gorm.DB, disabled bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        actorID := c.GetUint("user_id")
+        var req UserStatusRequest
+        if c.Request.ContentLength > 0 {
+            if err := c.ShouldBindJSON(&req); err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+                return
+            }
+        }
+        var user User
+        if err := db.First(&user, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        if user.ID == actorID {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot change your own account status"})
+            return
+        }
+        if !canManageUser(c, db, user) {
+            return
+        }
+        reason := strings.TrimSpace(req.Reason)
+        err := db.Transaction(func(tx *gorm.DB) error {
+            if disabled {
+                if err := tx.Model(&user).Update("disabled_at", time.Now()).Error; err != nil {
+                    return err
+                }
+                if err := revokeAllTokens(tx, user.ID); err != nil {
+                    return err
+                }
+                return recordAudit(tx, actorID, "user.disable", "user", user.ID, reason, nil)
+            }
+            if err := tx.Model(&user).Update("disabled_at", nil).Error; err != nil {
+                return err
+            }
+            return recordAudit(tx, actorID, "user.enable", "user", user.ID, reason, nil)
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+            return
+        }
+        if err := db.First(&user, user.ID).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        c.JSON(http.StatusOK, user)
+    }
+}
+
+// adminResetPassword either sets the given password directly or, without
+// one, mails the user a regular reset link. Existing sessions end either way.
+func adminResetPassword(db *gorm.DB, mailer Mailer, appURL string, logger *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        actorID := c.GetUint("user_id")
+        var req AdminResetPasswordRequest
+        if c.Request.ContentLength > 0 {
+            if err := c.ShouldBindJSON(&req); err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+                return
+            }
+        }
+        var user User
+        if err := db.First(&user, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        if !canManageUser(c, db, user) {
+            return
+        }
+        password := strings.TrimSpace(req.Password)
+        reason := strings.TrimSpace(req.Reason)
+
+        if password == "" {
+            err := db.Transaction(func(tx *gorm.DB) error {
+                if err := revokeAllTokens(tx, user.ID); err != nil {
+                    return err
+                }
+                return recordAudit(tx, actorID, "user.password.reset_link", "user", user.ID, reason, nil)
+            })
+            if err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+                return
+            }
+            // The sessions are already revoked; the link follows in the
+            // background and can be re-sent through forgot-password.
+            go func() {
+                if err := sendPasswordReset(db, mailer, appURL, user); err != nil {
+                    logger.Warn("failed to send password reset", zap.Uint("user_id", user.ID), zap.Error(err))
+                }
+            }()
+            c.JSON(http.StatusAccepted, gin.H{"status": "queued", "method": "email"})
+            return
+        }
+
+        if len(password) < 6 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "password must be at least 6 characters"})
+            return
+        }
+        hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+            return
+        }
+        err = db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Model(&user).Update("password_hash", string(hash)).Error; err != nil {
+                return err
+            }
+            if err := revokeAllTokens(tx, user.ID); err != nil {
+                return err
+            }
+            return recordAudit(tx, actorID, "user.password.set", "user", user.ID, reason, nil)
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok", "method": "password"})
+    }
+}
+
+// setUserAdmin grants or revokes full admin rights. Only super admins may do
+// this since the flag is equivalent to every permission.
+func setUserAdmin(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        actorID := c.GetUint("user_id")
+        perms := c.MustGet("permissions").(map[string]bool)
+        if !hasPermission(perms, PermAll) {
+            c.JSON(http.StatusForbidden, gin.H{"error": "only super admins can change admin rights"})
+            return
+        }
+        var req AdminFlagRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+            return
+        }
+        var user User
+        if err := db.First(&user, c.Param("id")).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        if user.ID == actorID && !req.IsAdmin {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot revoke your own admin rights"})
+            return
+        }
+        var role Role
+        if err := db.Where("name = ?", RoleSuperAdmin).First(&role).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "super_admin role missing"})
+            return
+        }
+        err := db.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Model(&user).Update("is_admin", req.IsAdmin).Error; err != nil {
+                return err
+            }
+            action := "user.admin.grant"
+            if req.IsAdmin {
+                if err := tx.Where(UserRole{UserID: user.ID, RoleID: role.ID}).FirstOrCreate(&UserRole{}).Error; err != nil {
+                    return err
+                }
+                if !user.TwoFactorEnabled {
+                    if err := revokeAllTokens(tx, user.ID); err != nil {
+                        return err
+                    }
+                }
+            } else {
+                action = "user.admin.revoke"
+                if err := tx.Where("user_id = ? AND role_id = ?", user.ID, role.ID).Delete(&UserRole{}).Error; err != nil {
+                    return err
+                }
+            }
+            return recordAudit(tx, actorID, action, "user", user.ID, strings.TrimSpace(req.Reason), nil)
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+            return
+        }
+        if err := db.First(&user, user.ID).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        c.JSON(http.StatusOK, user)
+    }
+}
+
+func listAuditLogs(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        page, perPage := pageParams(c, 50, 200)
+        query := db.Model(&AuditLog{})
+        if entityType := c.Query("entity_type"); entityType != "" {
+            query = query.Where("entity_type = ?", entityType)
+        }
+        if entityID, err := strconv.Atoi(c.Query("entity_id")); err == nil {
+            query = query.Where("entity_id = ?", entityID)
+        }
+        if actorID, err := strconv.Atoi(c.Query("actor_id")); err == nil {
+            query = query.Where("actor_id = ?", actorID)
+        }
+        if action := c.Query("action"); action != "" {
+            query = query.Where("action = ?", action)
+        }
+        var total int64
+        if err := query.Count(&total).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load audit log"})
+            return
+        }
+        entries := make([]AuditLog, 0)
+        if err := query.Order("created_at desc").Offset((page - 1) * perPage).Limit(perPage).Find(&entries).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load audit log"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"items": entries, "total": total, "page": page, "per_page": perPage})
+    }
+}
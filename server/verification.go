@@ -0,0 +1,167 @@
+
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+    "gorm.io/gorm"
+)
+
+const (
+    verificationTTL      = 72 * time.Hour
+    verificationThrottle = time.Minute
+)
+
+var errInvalidVerification = errors.New("invalid or expired verification link")
+
+// signVerification builds a "<user>.<expiry>.<signature>" token. The email is
+// part of the signed data, so a link stops working if the address changes.
+func signVerification(key []byte, user User, expires time.Time) string {
+    body := fmt.Sprintf("%d.%d", user.ID, expires.Unix())
+    return body + "." + base64.RawURLEncoding.EncodeToString(ticketMAC(key, body+"."+user.Email))
+}
+
+func verifyVerification(db *gorm.DB, key []byte, token string) (User, error) {
+    parts := strings.Split(strings.TrimSpace(token), ".")
+    if len(parts) != 3 {
+        return User{}, errInvalidVerification
+    }
+    userID, err := strconv.ParseUint(parts[0], 10, 64)
+    if err != nil {
+        return User{}, errInvalidVerification
+    }
+    expires, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || time.Now().Unix() > expires {
+        return User{}, errInvalidVerification
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return User{}, errInvalidVerification
+    }
+    var user User
+    if err := db.First(&user, uint(userID)).Error; err != nil {
+        return User{}, errInvalidVerification
+    }
+    if !hmac.Equal(sig, ticketMAC(key, parts[0]+"."+parts[1]+"."+user.Email)) {
+        return User{}, errInvalidVerification
+    }
+    return user, nil
+}
+
+func sendVerificationEmail(db *gorm.DB, mailer Mailer, cfg Config, user User) error {
+    token := signVerification(cfg.VerificationKey, user, time.Now().Add(verificationTTL))
+    link := strings.TrimRight(cfg.PublicURL, "/") + "/api/auth/verify?token=" + token
+    ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+    defer cancel()
+    err := mailer.Send(ctx, Mail{
+        To:      user.Email,
+        Subject: "Kinoform: подтверждение email",
+        Text: fmt.Sprintf("Здравствуйте, %s!\n\nПодтвердите адрес электронной почты, перейдя по ссылке:\n%s\n\n"+
+            "Ссылка действует %d часа.\n", user.Name, link, int(verificationTTL.Hours())),
+    })
+    if err != nil {
+        return err
+    }
+    return db.Model(&User{}).Where("id = ?", user.ID).Update("verification_sent_at", time.Now()).Error
+}
+
+func verifyEmailHandler(db *gorm.DB, cfg Config) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        user, err := verifyVerification(db, cfg.VerificationKey, c.Query("token"))
+        browser := strings.Contains(c.GetHeader("Accept"), "text/html")
+        if err != nil {
+            if browser {
+                c.Redirect(http.StatusFound, strings.TrimRight(cfg.AppURL, "/")+"/?email_verified=0")
+                return
+            }
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        // Proving the address also hands over bookings made as a guest with it.
+        err = db.Transaction(func(tx *gorm.DB) error {
+            now := time.Now()
+            updates := map[string]interface{}{"email_confirmed_at": now}
+            if user.EmailVerifiedAt == nil {
+                updates["email_verified_at"] = now
+            }
+            if user.EmailConfirmedAt == nil {
+                if err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(updates).Error; err != nil {
+                    return err
+                }
+            }
+            _, err := claimGuestBookings(tx, user)
+            return err
+        })
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email"})
+            return
+        }
+        // Links are opened from a mail client, so browsers are sent back to the app.
+        if browser {
+            c.Redirect(http.StatusFound, strings.TrimRight(cfg.AppURL, "/")+"/?email_verified=1")
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
+
+func resendVerificationHandler(db *gorm.DB, mailer Mailer, cfg Config, logger *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.GetUint("user_id")
+        var user User
+        if err := db.First(&user, userID).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+            return
+        }
+        // Accounts verified by the backfill may still ask for a link, which
+        // they need before claiming guest bookings.
+        if user.EmailConfirmedAt != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "email already verified"})
+            return
+        }
+        if user.VerificationSentAt != nil {
+            if wait := verificationThrottle - time.Since(*user.VerificationSentAt); wait > 0 {
+                c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+                c.JSON(http.StatusTooManyRequests, gin.H{"error": "verification email was sent recently"})
+                return
+            }
+        }
+        if err := sendVerificationEmail(db, mailer, cfg, user); err != nil {
+            logger.Warn("failed to send verification email", zap.Uint("user_id", user.ID), zap.Error(err))
+            c.JSON(http.StatusBadGateway, gin.H{"error": "failed to send verification email"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
+
+// requireVerifiedEmail blocks purchases from unverified accounts when the
+// REQUIRE_EMAIL_VERIFICATION rule is enabled.
+func requireVerifiedEmail(db *gorm.DB, enabled bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !enabled {
+            c.Next()
+            return
+        }
+        var user User
+        if err := db.Select("id", "email_verified_at").First(&user, c.GetUint("user_id")).Error; err != nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+            return
+        }
+        if user.EmailVerifiedAt == nil {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "email verification required"})
+            return
+        }
+        c.Next()
+    }
+}